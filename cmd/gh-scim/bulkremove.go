@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// removeAttempts is how many times bulk-remove tries each user before
+// giving up on it; removeBackoff is the wait before the first retry, doubled
+// for each one after.
+const (
+	removeAttempts = 4
+	removeBackoff  = time.Second
+)
+
+// readLines reads the non-blank lines of path, skipping # comments.
+func readLines(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var lines []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, scanner.Err()
+}
+
+// retryable reports whether err may succeed if the request is sent again.
+func retryable(err error) bool {
+	return errors.Is(err, errServer) || errors.Is(err, errNetwork)
+}
+
+// bulkRemoveHandler removes each user listed in path, identified as for
+// remove. Users that can't be found count as already removed, and failures
+// are retried with backoff instead of aborting the rest. With dryRun, the
+// users are only looked up.
+func (c *apiClient) bulkRemoveHandler(path, by string, dryRun bool) error {
+	users, err := readLines(path)
+	if err != nil {
+		return err
+	}
+
+	removed, absent := 0, 0
+	var failures []string
+	for _, user := range users {
+		var gone bool
+		err := c.retry(func() error {
+			// only a lookup that finds no user means it's absent; a 404
+			// from the endpoint itself, such as for a mistyped
+			// organization, is a failure
+			guid, err := c.resolveID(user, by)
+			if errors.Is(err, errNoUser) {
+				gone = true
+				return nil
+			}
+			if err != nil || dryRun {
+				return err
+			}
+			gone, err = c.remove(guid)
+			return err
+		})
+
+		switch {
+		case err != nil:
+			failures = append(failures, fmt.Sprintf("%s: %s", user, err))
+		case gone:
+			absent++
+			log.Printf("bulk-remove: %s already absent", user)
+		case dryRun:
+			removed++
+			log.Printf("bulk-remove: would remove %s", user)
+		default:
+			removed++
+			log.Printf("bulk-remove: removed %s", user)
+		}
+	}
+
+	for _, failure := range failures {
+		log.Printf("bulk-remove: failed: %s", failure)
+	}
+	verb := "removed"
+	if dryRun {
+		verb = "to remove"
+	}
+	log.Printf("bulk-remove: %d %s, %d already absent, %d failed", removed, verb, absent, len(failures))
+
+	if len(failures) > 0 {
+		return fmt.Errorf("bulk-remove: %d of %d users weren't removed", len(failures), len(users))
+	}
+	return nil
+}
+
+// retry calls f until it succeeds, fails with an error that isn't
+// retryable, or has been tried removeAttempts times. Rate limits are waited
+// out by do, on top of the backoff.
+func (c *apiClient) retry(f func() error) error {
+	backoff := removeBackoff
+	for attempt := 1; ; attempt++ {
+		err := f()
+		if err == nil || !retryable(err) || attempt == removeAttempts {
+			return err
+		}
+
+		log.Printf("retrying in %s: %s", backoff, err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	scim "github.com/mtodd/scimtool"
+)
+
+// comparison is the result of comparing the users of two servers, A and B.
+type comparison struct {
+	OnlyA  []scim.User  `json:"onlyA"`
+	OnlyB  []scim.User  `json:"onlyB"`
+	Differ []difference `json:"differ"`
+}
+
+// difference is a user present on both servers with different attributes.
+type difference struct {
+	Key   string       `json:"key"`
+	A     scim.User    `json:"a"`
+	B     scim.User    `json:"b"`
+	Patch scim.PatchOp `json:"patch"`
+}
+
+// compareKey identifies a user across servers, whose ids differ, by its
+// externalId or userName. Users without an externalId are matched by
+// userName either way.
+func compareKey(user scim.User, match string) string {
+	if match == "externalId" && user.ExternalID != "" {
+		return "externalId:" + user.ExternalID
+	}
+	return "userName:" + strings.ToLower(user.UserName)
+}
+
+// compareHandler lists the users of c (A) and b (B) and reports the users
+// only on one of them, or whose attributes differ.
+func (c *apiClient) compareHandler(b *apiClient, match string, asJSON bool) error {
+	users := func(client *apiClient) (map[string]scim.User, error) {
+		byKey := make(map[string]scim.User)
+		err := client.listAll(listOptions{}, 0, func(user scim.User) error {
+			byKey[compareKey(user, match)] = user
+			return nil
+		})
+		return byKey, err
+	}
+
+	a, err := users(c)
+	if err != nil {
+		return fmt.Errorf("list %s: %w", c.baseURL, err)
+	}
+	bUsers, err := users(b)
+	if err != nil {
+		return fmt.Errorf("list %s: %w", b.baseURL, err)
+	}
+
+	keys := make([]string, 0, len(a)+len(bUsers))
+	for key := range a {
+		keys = append(keys, key)
+	}
+	for key := range bUsers {
+		if _, ok := a[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	result := comparison{OnlyA: []scim.User{}, OnlyB: []scim.User{}, Differ: []difference{}}
+	for _, key := range keys {
+		ua, inA := a[key]
+		ub, inB := bUsers[key]
+		switch {
+		case !inB:
+			result.OnlyA = append(result.OnlyA, ua)
+		case !inA:
+			result.OnlyB = append(result.OnlyB, ub)
+		case !ua.Equal(ub):
+			result.Differ = append(result.Differ, difference{Key: key, A: ua, B: ub, Patch: scim.Diff(ua, ub)})
+		}
+	}
+
+	if asJSON {
+		buf, err := json.Marshal(result)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+	} else {
+		printComparison(result)
+	}
+
+	n := len(result.OnlyA) + len(result.OnlyB) + len(result.Differ)
+	if n > 0 {
+		return fmt.Errorf("compare: %d users only in A, %d only in B, %d differ", len(result.OnlyA), len(result.OnlyB), len(result.Differ))
+	}
+	return nil
+}
+
+// printComparison writes result as a table of the mismatched users, with the
+// attributes that differ.
+func printComparison(result comparison) {
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "USER\tSTATUS\tATTRIBUTES")
+	for _, user := range result.OnlyA {
+		fmt.Fprintf(w, "%s\tonly in A\t\n", user.UserName)
+	}
+	for _, user := range result.OnlyB {
+		fmt.Fprintf(w, "%s\tonly in B\t\n", user.UserName)
+	}
+	for _, d := range result.Differ {
+		var paths []string
+		for _, op := range d.Patch.Operations {
+			path := op.Path
+			if strings.HasPrefix(path, "emails") {
+				path = "emails"
+			}
+			if !containsPath(paths, path) {
+				paths = append(paths, path)
+			}
+		}
+		fmt.Fprintf(w, "%s\tdiffers\t%s\n", d.A.UserName, strings.Join(paths, ","))
+	}
+	w.Flush()
+}
+
+func containsPath(paths []string, path string) bool {
+	for _, p := range paths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
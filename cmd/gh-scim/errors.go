@@ -0,0 +1,76 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+// Exit codes, so scripts can tell failures apart.
+const (
+	exitError      = 1 // any other failure, including invalid usage
+	exitAuth       = 2
+	exitNotFound   = 3
+	exitValidation = 4
+	exitServer     = 5
+	exitNetwork    = 6
+)
+
+// The kinds of failure with their own exit code. Errors are attached to one
+// with classify.
+var (
+	errAuth       = errors.New("authentication failed")
+	errNotFound   = errors.New("not found")
+	errValidation = errors.New("invalid request")
+	errServer     = errors.New("server error")
+	errNetwork    = errors.New("network error")
+)
+
+// classified is an error of one of the kinds above. It keeps err's message.
+type classified struct {
+	kind error
+	err  error
+}
+
+func (e classified) Error() string   { return e.err.Error() }
+func (e classified) Unwrap() []error { return []error{e.kind, e.err} }
+
+// classify marks err as being of kind, one of the errors above.
+func classify(kind, err error) error {
+	return classified{kind: kind, err: err}
+}
+
+// responseError formats an error for the unexpected response res, classified
+// by its status code.
+func responseError(res *http.Response, format string, args ...interface{}) error {
+	err := fmt.Errorf(format, args...)
+
+	switch code := res.StatusCode; {
+	case code == http.StatusUnauthorized || code == http.StatusForbidden:
+		return classify(errAuth, err)
+	case code == http.StatusNotFound:
+		return classify(errNotFound, err)
+	case code == http.StatusTooManyRequests || code >= 500:
+		return classify(errServer, err)
+	case code >= 400:
+		return classify(errValidation, err)
+	}
+	return err
+}
+
+// exitCode returns the code gh-scim exits with after err.
+func exitCode(err error) int {
+	switch {
+	case errors.Is(err, errAuth):
+		return exitAuth
+	case errors.Is(err, errNotFound), errors.Is(err, errNoUser), errors.Is(err, errMeUnsupported):
+		return exitNotFound
+	case errors.Is(err, errValidation), errors.Is(err, errConflict), errors.Is(err, errChanged):
+		return exitValidation
+	case errors.Is(err, errServer):
+		return exitServer
+	case errors.Is(err, errNetwork):
+		return exitNetwork
+	}
+	return exitError
+}
@@ -3,12 +3,17 @@ package main
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
 
 	scim "github.com/mtodd/scimtool"
 )
@@ -17,45 +22,198 @@ const usage = `
 gh-scim <command> -o <org> [guid|filter]
 
 commands:
-* list [filter]
-  [filter] is a SCIM filter
+* list [-attributes a,b] [-excludedAttributes a,b] [-sortBy attr] [-sortOrder order] [-max N] [-username x] [-external-id x] [-active|-inactive] [-filter filter] [filter]
+  lists every matching identity, paging through results
+  [filter] (or -filter) is a SCIM filter
   example: 'userName eq "alice"'
-* remove [guid]
-  [guid] is required
+  -username, -external-id, -active, and -inactive build the filter for
+  you, e.g. -username alice -active for 'userName eq "alice" and active eq
+  true'; they're combined with [filter] using "and"
+  -attributes limits the returned attributes, e.g. "id,userName"
+  -excludedAttributes omits the given attributes
+  -sortBy orders results by the given attribute, e.g. "userName"
+  -sortOrder is "ascending" or "descending"
+  -max stops after N identities
+* search [-max N] <filter>
+  lists every identity and prints those matching <filter>, evaluating it
+  locally for consistent results on servers with weak filter support
+  -max stops after N matches
+* count [filter]
+  prints the number of identities matching [filter]
+* compare -baseurl-a <url> -baseurl-b <url> [-match externalId|userName] [-json]
+  lists the identities on two servers and reports those only on A, only on
+  B, or with different attributes, as a table or with -json as JSON;
+  identities are matched by externalId (default, falling back to userName
+  for identities without one) or userName. Exits non-zero on any difference
+* remove [-by id|userName|externalId] [user]
+  [user] is required: the user's id, or their userName or externalId, which
+  are looked up to find the id. Without -by, arguments that look like an id
+  (a UUID) are used as one, and others are tried as a userName then an
+  externalId
+* bulk-remove -f <file> [-by id|userName|externalId] [-dry-run]
+  removes the users listed in <file>, one per line as for remove; blank
+  lines and lines starting with # are ignored. Failures are retried with
+  backoff, users that are already gone count as removed, and a summary is
+  printed at the end. -dry-run only prints what would be removed
 * add...
+* me
+  prints the identity the token is authenticated as, from /scim/v2/Me; -o
+  isn't required
+* activate [guid]
+  sets active to true for the user; [guid] is required
+* deactivate [guid]
+  sets active to false for the user; [guid] is required
+* export -f <file> [-ndjson]
+  writes every identity to <file> as a JSON array, or one JSON object per
+  line with -ndjson; the fields in REDACT_FIELDS are hidden
+* import -f <file> [-concurrency N]
+  re-creates the identities in <file>, written by export; identities whose
+  externalId is already provisioned are skipped, and ones whose userName is
+  taken are reported as conflicts
+  -concurrency creates up to N identities at a time (default 1); results
+  are still reported in the order of <file>
+* version
+  prints the build version
+* patch -from <file> -to <file>
+  prints the PatchOp that turns the user in -from into the user in -to
+* patch -f <file> [-if-match <version>] [guid]
+  validates the PatchOp in <file>, applies it to the user, and prints the
+  resulting user; [guid] is required. The patch is refused if the user
+  changed since <version>, its meta.version, or since it's read first
 
 environment variables:
-* TOKEN: used to authenticate requests; required
+* TOKEN: used to authenticate requests; required unless -token-file is given
+* AUTH: how TOKEN is sent: "bearer" (default), "basic" (TOKEN is
+  "user:password"), or "header" (TOKEN is sent in AUTH_HEADER)
+* AUTH_HEADER: the header name used when AUTH is "header"
+* USER_AGENT: the User-Agent header; defaults to "scimtool/<version>"
 * BASEURL: the API base URL; defaults to "https://api.github.com/"
+* TOKEN_B: the token used for -baseurl-b with compare; defaults to TOKEN
+* REDACT_FIELDS: user fields hidden in export, any of email, name, userName,
+  and externalId, separated by commas
+* REDACT_HASH: set to "true" to replace redacted fields with a short hash of
+  their value instead of "[redacted]"
 
 flags:
 * -o <org>: the organization name, e.g. "acme"; required for all commands
+  except me and version
+* -token-file <path>: read the token from a file instead of TOKEN
 * -d: debug logging
+* -color <auto|always|never>: color text output and errors; "auto" (default)
+  colors only when writing to a terminal and NO_COLOR is unset. JSON output is
+  never colored
+* -quiet: don't show progress bars
+* -no-redact: ignore REDACT_FIELDS
+* -page-size <N>: the number of identities to request per page when listing
+  (default 100; 0 leaves it to the server); it's lowered to the server's
+  limit from its ServiceProviderConfig, or once a page comes back capped
+* -version: print the build version and exit
+
+exit codes:
+* 0: success
+* 1: any other failure, including invalid usage
+* 2: authentication failed (401 or 403)
+* 3: the user or endpoint wasn't found
+* 4: the request or input was invalid, or conflicts with an existing user
+* 5: the server failed (5xx or rate limited)
+* 6: the server couldn't be reached
 `
 
 const defaultBaseURL = "https://api.github.com"
 
 type apiClient struct {
-	client  *http.Client
-	baseURL string
-	token   string
-	org     string
-	debug   bool
+	client     *http.Client
+	baseURL    string
+	token      string
+	authMethod string
+	authHeader string
+	userAgent  string
+	org        string
+	debug      bool
+	color      colorizer
+	progress   bool
+	limit      *rateLimit
+	redactor   *scim.Redactor
+
+	// pageSize is the count of users listAll requests per page, limited to
+	// maxPage, the server's limit once known; maxPageRead is set once the
+	// ServiceProviderConfig was asked for it.
+	pageSize    int
+	maxPage     int
+	maxPageRead bool
+}
+
+// colorizer wraps text in ANSI colors when enabled.
+type colorizer bool
+
+const (
+	red   = "31"
+	green = "32"
+)
+
+func (c colorizer) paint(color, s string) string {
+	if !c {
+		return s
+	}
+	return "\x1b[" + color + "m" + s + "\x1b[0m"
+}
+
+// isTerminal reports whether f is a terminal rather than a pipe or file.
+func isTerminal(f *os.File) bool {
+	fi, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	return fi.Mode()&os.ModeCharDevice != 0
+}
+
+// newColorizer resolves a -color mode for output written to f.
+func newColorizer(mode string, f *os.File) (colorizer, error) {
+	switch mode {
+	case "always":
+		return true, nil
+	case "never":
+		return false, nil
+	case "auto":
+		if os.Getenv("NO_COLOR") != "" {
+			return false, nil
+		}
+		return colorizer(isTerminal(f)), nil
+	default:
+		return false, fmt.Errorf("unknown -color %q: expected auto, always, or never", mode)
+	}
 }
 
 func (c *apiClient) buildRequest(method, endpoint string) (*http.Request, error) {
 	req, err := http.NewRequest(method, c.buildEndpointURL(endpoint), nil)
 
 	req.Header.Set("Accept", "application/vnd.github.cloud-9-preview+json+scim")
-	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("User-Agent", c.userAgent)
+	c.authorize(req)
 
-	if method == "POST" {
+	if method == "POST" || method == "PATCH" {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
 	return req, err
 }
 
+// authorize applies the configured authentication to req.
+func (c *apiClient) authorize(req *http.Request) {
+	switch c.authMethod {
+	case "basic":
+		user, pass := c.token, ""
+		if i := strings.Index(c.token, ":"); i >= 0 {
+			user, pass = c.token[:i], c.token[i+1:]
+		}
+		req.SetBasicAuth(user, pass)
+	case "header":
+		req.Header.Set(c.authHeader, c.token)
+	default:
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
 func (c *apiClient) buildEndpointURL(path string) string {
 	return fmt.Sprintf("%s%s", c.baseURL, path)
 }
@@ -65,114 +223,726 @@ func (c *apiClient) do(req *http.Request) (*http.Response, error) {
 		log.Printf("debug: %v", req)
 	}
 
+	c.limit.wait()
+
 	res, err := c.client.Do(req)
+	if err != nil {
+		return res, classify(errNetwork, err)
+	}
 
-	if c.debug && err == nil {
+	if c.debug {
 		log.Printf("debug: %v", res)
 	}
 
-	return res, err
+	c.limit.update(res)
+
+	return res, nil
+}
+
+// listOptions are the query parameters supported by the Users list endpoint.
+type listOptions struct {
+	filter             string
+	attributes         string
+	excludedAttributes string
+	sortBy             string
+	sortOrder          string
+	startIndex         string
+	count              string
 }
 
 // GET https://api.github.com/scim/v2/organizations/:organization/Users
-func (c *apiClient) listHandler(filter string) error {
+func (c *apiClient) list(opts listOptions) (scim.ListResponse, error) {
+	var list scim.ListResponse
+
 	req, err := c.buildRequest("GET", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
 	if err != nil {
-		return err
+		return list, err
 	}
 
-	if len(filter) > 0 {
-		q := req.URL.Query()
-		q.Add("filter", filter)
-		req.URL.RawQuery = q.Encode()
+	q := req.URL.Query()
+	if len(opts.filter) > 0 {
+		q.Add("filter", opts.filter)
+	}
+	if len(opts.attributes) > 0 {
+		q.Add("attributes", opts.attributes)
+	}
+	if len(opts.excludedAttributes) > 0 {
+		q.Add("excludedAttributes", opts.excludedAttributes)
+	}
+	if len(opts.sortBy) > 0 {
+		q.Add("sortBy", opts.sortBy)
 	}
+	if len(opts.sortOrder) > 0 {
+		q.Add("sortOrder", opts.sortOrder)
+	}
+	if len(opts.startIndex) > 0 {
+		q.Add("startIndex", opts.startIndex)
+	}
+	if len(opts.count) > 0 {
+		q.Add("count", opts.count)
+	}
+	req.URL.RawQuery = q.Encode()
 
 	res, err := c.do(req)
 	if err != nil {
-		return err
+		return list, err
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return err
+		return list, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusBadRequest {
-		return fmt.Errorf("list: bad request: %s", string(body))
+		return list, responseError(res, "list: bad request: %s", string(body))
 	}
 
 	if res.StatusCode == http.StatusNotFound {
-		return fmt.Errorf("list: not found: %s", string(body))
+		return list, responseError(res, "list: not found: %s", string(body))
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return list, responseError(res, "list failed: %s: %s", res.Status, string(body))
 	}
 
 	if c.debug {
 		log.Printf("debug: %v", string(body))
 	}
 
-	var list scim.ListResponse
 	if err := json.Unmarshal(body, &list); err != nil {
-		return err
+		return list, err
+	}
+
+	return list, nil
+}
+
+// listAll pages through every user matching opts, calling each for every
+// user until max users have been seen (0 for no limit). A progress bar is
+// drawn on stderr when the results span multiple pages.
+func (c *apiClient) listAll(opts listOptions, max int, each func(scim.User) error) error {
+	seen := 0
+	startIndex := 1
+
+	var bar *progress
+	defer func() { bar.finish() }()
+
+	count := 0
+	if opts.count == "" {
+		count = c.pageCount()
+		if count > 0 {
+			opts.count = strconv.Itoa(count)
+		}
 	}
+	size := count
+
+	for {
+		opts.startIndex = strconv.Itoa(startIndex)
+
+		list, err := c.list(opts)
+		if err != nil {
+			return err
+		}
 
-	for _, user := range list.Resources {
+		// a server that silently caps pages keeps doing so
+		if capped := scim.CappedPageSize(count, startIndex, list); capped > 0 {
+			log.Printf("list: the server returned %d of the %d users requested per page; requesting %d from now on", capped, count, capped)
+			c.maxPage = capped
+			count, size = capped, capped
+			opts.count = strconv.Itoa(count)
+		}
+
+		if bar == nil && c.progress && len(list.Resources) < list.TotalResults {
+			total := list.TotalResults
+			if max > 0 && max < total {
+				total = max
+			}
+			bar = newProgress(os.Stderr, total)
+		}
+
+		for _, user := range list.Resources {
+			if max > 0 && seen >= max {
+				return nil
+			}
+
+			if err := each(user); err != nil {
+				return err
+			}
+			seen++
+			bar.add(1)
+		}
+
+		// some servers report a wrong totalResults, so pages are sized too
+		if size == 0 {
+			size = len(list.Resources)
+		}
+		more := scim.MorePages(startIndex, size, list)
+		startIndex += len(list.Resources)
+		if !more {
+			return nil
+		}
+	}
+}
+
+func (c *apiClient) listHandler(opts listOptions, max int) error {
+	return c.listAll(opts, max, func(user scim.User) error {
 		json, err := json.Marshal(user)
 		if err != nil {
 			return err
 		}
 
 		fmt.Println(string(json))
+
+		return nil
+	})
+}
+
+// errSearchDone stops listAll once search has found enough matches.
+var errSearchDone = errors.New("search: done")
+
+// searchHandler lists every user and prints those matching expr, evaluated
+// client-side, until max have matched (0 for no limit).
+func (c *apiClient) searchHandler(expr string, max int) error {
+	filter, err := scim.ParseFilter(expr)
+	if err != nil {
+		return classify(errValidation, err)
 	}
 
+	listed, matched := 0, 0
+	err = c.listAll(listOptions{}, 0, func(user scim.User) error {
+		listed++
+		if !filter.Match(user) {
+			return nil
+		}
+
+		json, err := json.Marshal(user)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(json))
+
+		matched++
+		if max > 0 && matched >= max {
+			return errSearchDone
+		}
+		return nil
+	})
+	if err != nil && err != errSearchDone {
+		return err
+	}
+
+	log.Printf("search: filter evaluated client-side; %d of %d users listed matched", matched, listed)
 	return nil
 }
 
-// DELETE /scim/v2/organizations/:organization/Users/:id
+// countHandler prints the number of users matching filter. It requests
+// count=0 so the server returns only totalResults.
+func (c *apiClient) countHandler(filter string) error {
+	list, err := c.list(listOptions{filter: filter, count: "0"})
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(list.TotalResults)
+
+	return nil
+}
+
+// idPattern matches the UUIDs GitHub assigns as SCIM ids.
+var idPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+
+// resolveID returns the id of the user identified by value, looking it up by
+// the attribute named by by: "id", "userName", "externalId", or "" to guess.
+func (c *apiClient) resolveID(value, by string) (string, error) {
+	switch by {
+	case "id":
+		return value, nil
+	case "userName", "externalId":
+		return c.lookupID(by, value)
+	case "":
+		if idPattern.MatchString(value) {
+			return value, nil
+		}
+		id, err := c.lookupID("userName", value)
+		if err == errNoUser {
+			id, err = c.lookupID("externalId", value)
+		}
+		if err == errNoUser {
+			return "", classify(errNoUser, fmt.Errorf("no user with userName or externalId %q", value))
+		}
+		return id, err
+	default:
+		return "", classify(errValidation, fmt.Errorf("unknown -by %q: expected id, userName, or externalId", by))
+	}
+}
+
+var errNoUser = errors.New("no such user")
+
+// lookupID finds the id of the single user whose attr equals value.
+func (c *apiClient) lookupID(attr, value string) (string, error) {
+	quoted, err := json.Marshal(value)
+	if err != nil {
+		return "", err
+	}
+
+	list, err := c.list(listOptions{filter: fmt.Sprintf("%s eq %s", attr, quoted), attributes: "id"})
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case list.TotalResults == 0 || len(list.Resources) == 0:
+		return "", errNoUser
+	case list.TotalResults > 1:
+		return "", fmt.Errorf("%d users have %s %q; remove by id instead", list.TotalResults, attr, value)
+	}
+
+	log.Printf("remove: %s %q is %s", attr, value, list.Resources[0].ID)
+	return list.Resources[0].ID, nil
+}
+
 func (c *apiClient) removeHandler(guid string) error {
-	req, err := c.buildRequest("DELETE", fmt.Sprintf("/scim/v2/organizations/%s/Users/%s", c.org, guid))
+	absent, err := c.remove(guid)
 	if err != nil {
 		return err
 	}
 
+	if absent {
+		log.Printf("%s already absent", guid)
+	} else {
+		log.Printf("removed %s", guid)
+	}
+	return nil
+}
+
+// DELETE /scim/v2/organizations/:organization/Users/:id
+//
+// Already deleted counts as success so retries are idempotent; absent
+// reports whether the user was already gone.
+func (c *apiClient) remove(guid string) (absent bool, err error) {
+	req, err := c.buildRequest("DELETE", fmt.Sprintf("/scim/v2/organizations/%s/Users/%s", c.org, guid))
+	if err != nil {
+		return false, err
+	}
+
 	res, err := c.do(req)
 	if err != nil {
-		return err
+		return false, err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusNotFound {
+		return true, nil
 	}
 
 	if res.StatusCode != http.StatusNoContent {
-		return fmt.Errorf("remove failed: %v", res)
+		return false, responseError(res, "remove failed: %v", res)
 	}
 
-	log.Printf("removed %s", guid)
-	return nil
+	return false, nil
 }
 
 func (c *apiClient) addHandler(user scim.User) error {
-	req, err := c.buildRequest("POST", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
+	user, err := c.create(user)
 	if err != nil {
 		return err
 	}
 
+	log.Printf("added: %s", user.ID)
+
+	return nil
+}
+
+// errConflict is returned by create when the server already has a user
+// with the same unique attributes, such as userName.
+var errConflict = errors.New("user already exists")
+
+// createAttempts is how many times create sends a user that's rejected
+// with 429 Too Many Requests.
+const createAttempts = 3
+
+// POST /scim/v2/organizations/:organization/Users
+func (c *apiClient) create(user scim.User) (scim.User, error) {
 	jsonBody, err := json.Marshal(user)
+	if err != nil {
+		return user, err
+	}
+
+	var res *http.Response
+	var body []byte
+	for attempt := 1; ; attempt++ {
+		req, err := c.buildRequest("POST", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
+		if err != nil {
+			return user, err
+		}
+
+		req.Body = ioutil.NopCloser(bytes.NewBufferString(string(jsonBody)))
+
+		res, err = c.do(req)
+		if err != nil {
+			return user, err
+		}
+
+		body, err = ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return user, err
+		}
+
+		// do waits out the rate limit before the next attempt
+		if res.StatusCode != http.StatusTooManyRequests || attempt == createAttempts {
+			break
+		}
+	}
+
+	if res.StatusCode == http.StatusConflict {
+		return user, errConflict
+	}
+
+	if res.StatusCode != http.StatusCreated {
+		return user, responseError(res, "add failed: %v", res)
+	}
+
+	if c.debug {
+		log.Printf("debug: %v", string(body))
+	}
+
+	if err := json.Unmarshal(body, &user); err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// exportHandler writes every user to path as a JSON array, or as one JSON
+// object per line with ndjson.
+func (c *apiClient) exportHandler(path string, ndjson bool) error {
+	f, err := os.Create(path)
 	if err != nil {
 		return err
 	}
+	defer f.Close()
 
-	req.Body = ioutil.NopCloser(bytes.NewBufferString(string(jsonBody)))
+	sep := "[\n"
+	if ndjson {
+		sep = ""
+	}
 
-	res, err := c.do(req)
+	n := 0
+	err = c.listAll(listOptions{}, 0, func(user scim.User) error {
+		buf, err := json.Marshal(c.redactor.Redact(user))
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(f, "%s%s", sep, buf); err != nil {
+			return err
+		}
+
+		n++
+		sep = ",\n"
+		if ndjson {
+			sep = "\n"
+		}
+		return nil
+	})
 	if err != nil {
 		return err
 	}
 
+	end := "\n"
+	switch {
+	case ndjson && n == 0:
+		end = ""
+	case !ndjson && n == 0:
+		end = "[]\n"
+	case !ndjson:
+		end = "\n]\n"
+	}
+	if _, err := fmt.Fprint(f, end); err != nil {
+		return err
+	}
+
+	log.Printf("export: wrote %d users to %s", n, path)
+	return f.Close()
+}
+
+// readUsers reads the users in path, written by export as a JSON array or
+// as newline-delimited JSON.
+func readUsers(path string) ([]scim.User, error) {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var list []scim.User
+	if trimmed := bytes.TrimSpace(buf); len(trimmed) > 0 && trimmed[0] == '[' {
+		if err := json.Unmarshal(trimmed, &list); err != nil {
+			return nil, classify(errValidation, fmt.Errorf("%s: %s", path, err))
+		}
+		return list, nil
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(buf))
+	for dec.More() {
+		var user scim.User
+		if err := dec.Decode(&user); err != nil {
+			return nil, classify(errValidation, fmt.Errorf("%s: user %d: %s", path, len(list)+1, err))
+		}
+		list = append(list, user)
+	}
+	return list, nil
+}
+
+// importResult is the outcome of importing one user.
+type importResult struct {
+	user    scim.User
+	skipped bool
+	err     error
+}
+
+// importHandler re-creates the users in path, concurrency at a time. Users
+// whose externalId is already provisioned are skipped; users whose userName
+// is taken by another user are reported as conflicts. Results are reported
+// in the order of the file.
+func (c *apiClient) importHandler(path string, concurrency int) error {
+	list, err := readUsers(path)
+	if err != nil {
+		return err
+	}
+
+	externalIDs := make(map[string]bool)
+	userNames := make(map[string]bool)
+	err = c.listAll(listOptions{attributes: "id,userName,externalId"}, 0, func(user scim.User) error {
+		if user.ExternalID != "" {
+			externalIDs[user.ExternalID] = true
+		}
+		userNames[strings.ToLower(user.UserName)] = true
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	results := make([]importResult, len(list))
+	pending := make(chan int, len(list))
+	for i, user := range list {
+		results[i].user = user
+		switch {
+		case user.ExternalID != "" && externalIDs[user.ExternalID]:
+			results[i].skipped = true
+		case userNames[strings.ToLower(user.UserName)]:
+			results[i].err = errConflict
+		default:
+			pending <- i
+		}
+	}
+	close(pending)
+
+	var wg sync.WaitGroup
+	for w := 0; w < concurrency; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range pending {
+				// the server assigns the id and meta
+				user := results[i].user
+				user.ID = ""
+				user.Metadata = scim.Metadata{}
+
+				added, err := c.create(user)
+				if err == nil {
+					results[i].user.ID = added.ID
+				}
+				results[i].err = err
+			}
+		}()
+	}
+	wg.Wait()
+
+	created, skipped := 0, 0
+	var conflicts, failures []string
+	for i, result := range results {
+		userName := result.user.UserName
+		switch {
+		case result.skipped:
+			skipped++
+		case result.err == errConflict:
+			conflicts = append(conflicts, userName)
+		case result.err != nil:
+			failures = append(failures, fmt.Sprintf("#%d %s: %s", i+1, userName, result.err))
+		default:
+			created++
+			log.Printf("import: added %s as %s", userName, result.user.ID)
+		}
+	}
+
+	for _, userName := range conflicts {
+		log.Printf("import: conflict: userName %s is taken by another user", userName)
+	}
+	for _, failure := range failures {
+		log.Printf("import: failed: %s", failure)
+	}
+	log.Printf("import: %d added, %d skipped (already provisioned), %d conflicts, %d failed", created, skipped, len(conflicts), len(failures))
+
+	if len(conflicts) > 0 || len(failures) > 0 {
+		return fmt.Errorf("import: %d of %d users weren't imported", len(conflicts)+len(failures), len(list))
+	}
+	return nil
+}
+
+// GET /scim/v2/organizations/:organization/Users/:id
+func (c *apiClient) get(guid string) (scim.User, error) {
+	var user scim.User
+
+	req, err := c.buildRequest("GET", fmt.Sprintf("/scim/v2/organizations/%s/Users/%s", c.org, guid))
+	if err != nil {
+		return user, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return user, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return user, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return user, responseError(res, "get failed: %s: %s", res.Status, string(body))
+	}
+
+	if c.debug {
+		log.Printf("debug: %v", string(body))
+	}
+
+	if err := json.Unmarshal(body, &user); err != nil {
+		return user, err
+	}
+
+	// some servers only report the version as an ETag
+	if user.Metadata.Version == "" {
+		user.Metadata.Version = res.Header.Get("ETag")
+	}
+
+	return user, nil
+}
+
+// errMeUnsupported is returned by me when the server doesn't implement the
+// /Me endpoint.
+var errMeUnsupported = errors.New("the server doesn't support /Me; it's only available to tokens authenticated as a user, and not every server implements it")
+
+// GET /scim/v2/Me
+func (c *apiClient) me() (scim.User, error) {
+	var user scim.User
+
+	req, err := c.buildRequest("GET", "/scim/v2/Me")
+	if err != nil {
+		return user, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return user, err
+	}
+
 	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return user, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotFound, http.StatusMethodNotAllowed, http.StatusNotImplemented:
+		return user, errMeUnsupported
+	default:
+		return user, responseError(res, "me failed: %s: %s", res.Status, string(body))
+	}
+
+	if c.debug {
+		log.Printf("debug: %v", string(body))
+	}
+
+	if err := json.Unmarshal(body, &user); err != nil {
+		return user, err
+	}
+
+	// a server without /Me may answer with something else entirely
+	if user.ID == "" {
+		return user, fmt.Errorf("me failed: the response isn't a user: %s", string(body))
+	}
+
+	return user, nil
+}
+
+func (c *apiClient) meHandler() error {
+	user, err := c.me()
 	if err != nil {
 		return err
 	}
+
+	json, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(json))
+
+	return nil
+}
+
+// errChanged is returned by patch when the user no longer matches the version
+// it was read at, so the patch wasn't applied.
+var errChanged = errors.New("user changed since it was read")
+
+// patch applies op to the user with the given guid. version, the user's
+// meta.version when the caller read it, is sent as If-Match so a concurrent
+// change by another system isn't overwritten; the patch is then refused with
+// errChanged, since op was decided on the user as read. An empty version
+// patches unconditionally.
+//
+// PATCH /scim/v2/organizations/:organization/Users/:id
+func (c *apiClient) patch(guid string, op scim.PatchOp, version string) (scim.User, error) {
+	var user scim.User
+
+	req, err := c.buildRequest("PATCH", fmt.Sprintf("/scim/v2/organizations/%s/Users/%s", c.org, guid))
+	if err != nil {
+		return user, err
+	}
+
+	if version != "" {
+		req.Header.Set("If-Match", version)
+	}
+
+	jsonBody, err := json.Marshal(op)
+	if err != nil {
+		return user, err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewBuffer(jsonBody))
+	req.ContentLength = int64(len(jsonBody))
+
+	res, err := c.do(req)
+	if err != nil {
+		return user, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return user, err
+	}
 	defer res.Body.Close()
 
-	if res.StatusCode != http.StatusCreated {
-		return fmt.Errorf("remove failed: %v", res)
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return user, classify(errChanged, fmt.Errorf("patch failed: %s changed since version %s; read it again before patching", guid, version))
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return user, responseError(res, "patch failed: %s: %s", res.Status, string(body))
 	}
 
 	if c.debug {
@@ -180,14 +950,119 @@ func (c *apiClient) addHandler(user scim.User) error {
 	}
 
 	if err := json.Unmarshal(body, &user); err != nil {
+		return user, err
+	}
+
+	return user, nil
+}
+
+// activeHandler sets the active attribute of the user with the given guid and
+// prints the resulting state.
+func (c *apiClient) activeHandler(guid string, active bool) error {
+	current, err := c.get(guid)
+	if err != nil {
 		return err
 	}
 
-	log.Printf("added: %s", user.ID)
+	user, err := c.patch(guid, scim.PatchOp{
+		Schemas: []string{scim.PatchOpSchema},
+		Operations: []scim.Operation{
+			{Op: "replace", Path: "active", Value: active},
+		},
+	}, current.Metadata.Version)
+	if err != nil {
+		return err
+	}
+
+	state := c.color.paint(red, "active=false")
+	if user.Active {
+		state = c.color.paint(green, "active=true")
+	}
+	fmt.Printf("%s %s\n", guid, state)
+
+	return nil
+}
+
+// patchHandler applies the PatchOp document in path to the user with the
+// given guid and prints the resulting user. The patch is conditioned on
+// version, the user's meta.version when it was read, or on the version read
+// now when it's "".
+func (c *apiClient) patchHandler(guid, path, version string) error {
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var op scim.PatchOp
+	if err := json.Unmarshal(buf, &op); err != nil {
+		return classify(errValidation, fmt.Errorf("%s: %s", path, err))
+	}
+
+	if err := op.Validate(); err != nil {
+		return classify(errValidation, fmt.Errorf("%s: %s", path, err))
+	}
+
+	if version == "" {
+		current, err := c.get(guid)
+		if err != nil {
+			return err
+		}
+		version = current.Metadata.Version
+	}
+
+	user, err := c.patch(guid, op, version)
+	if err != nil {
+		return err
+	}
+
+	json, err := json.Marshal(user)
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(json))
+
+	return nil
+}
+
+// patchPreviewHandler prints the PATCH operations needed to go from the user
+// in one JSON file to the user in another.
+func patchPreviewHandler(fromPath, toPath string) error {
+	from, err := readUserFile(fromPath)
+	if err != nil {
+		return err
+	}
+
+	to, err := readUserFile(toPath)
+	if err != nil {
+		return err
+	}
+
+	json, err := json.Marshal(scim.Diff(from, to))
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(string(json))
 
 	return nil
 }
 
+func readUserFile(path string) (scim.User, error) {
+	var user scim.User
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return user, err
+	}
+
+	if err := json.Unmarshal(buf, &user); err != nil {
+		return user, classify(errValidation, fmt.Errorf("%s: %s", path, err))
+	}
+
+	return user, nil
+}
+
 func main() {
 	var err error
 
@@ -199,20 +1074,66 @@ func main() {
 		baseURL = defaultBaseURL
 	}
 
+	authMethod := os.Getenv("AUTH")
+	if authMethod == "" {
+		authMethod = "bearer"
+	}
+	authHeader := os.Getenv("AUTH_HEADER")
+
+	userAgent := os.Getenv("USER_AGENT")
+	if userAgent == "" {
+		userAgent = scim.UserAgent()
+	}
+
 	// required flags
 	org := flag.String("o", "", "")
 
 	// general flags
+	tokenFile := flag.String("token-file", "", "")
 	debug := flag.Bool("d", false, "")
+	colorMode := flag.String("color", "auto", "")
+	quiet := flag.Bool("quiet", false, "")
+	showVersion := flag.Bool("version", false, "")
+	noRedact := flag.Bool("no-redact", false, "")
+	pageSize := flag.Int("page-size", 100, "")
 
 	flag.Parse()
 
-	if *org == "" {
+	color, err := newColorizer(*colorMode, os.Stdout)
+	if err != nil {
+		log.Fatalf("error: %s\n\n%s", err, usage)
+	}
+	errColor, _ := newColorizer(*colorMode, os.Stderr)
+
+	if *showVersion || flag.Arg(0) == "version" {
+		fmt.Println(scim.VersionString())
+		return
+	}
+
+	// /Me isn't scoped to an organization
+	if *org == "" && flag.Arg(0) != "me" {
 		log.Fatalf("error: -o organization is required\n\n%s", usage)
 	}
 
+	// a token file keeps the token out of the environment and shell history
+	if *tokenFile != "" {
+		if token, err = scim.ReadSecretFile(*tokenFile); err != nil {
+			log.Fatalf("error: -token-file: %s", err)
+		}
+	}
+
 	if token == "" {
-		log.Fatalf("error: TOKEN environment variable is required\n\n%s", usage)
+		log.Fatalf("error: TOKEN environment variable or -token-file is required\n\n%s", usage)
+	}
+
+	switch authMethod {
+	case "bearer", "basic":
+	case "header":
+		if authHeader == "" {
+			log.Fatalf("error: AUTH_HEADER environment variable is required when AUTH is \"header\"\n\n%s", usage)
+		}
+	default:
+		log.Fatalf("error: unknown AUTH %q\n\n%s", authMethod, usage)
 	}
 
 	if len(flag.Args()) < 1 {
@@ -221,28 +1142,180 @@ func main() {
 
 	// HTTP client
 	client := &apiClient{
-		client:  &http.Client{},
-		baseURL: baseURL,
-		token:   token,
-		org:     *org,
-		debug:   *debug,
+		client:     &http.Client{},
+		baseURL:    baseURL,
+		token:      token,
+		authMethod: authMethod,
+		authHeader: authHeader,
+		userAgent:  userAgent,
+		org:        *org,
+		debug:      *debug,
+		color:      color,
+		progress:   !*quiet && isTerminal(os.Stderr),
+		limit:      &rateLimit{},
+		pageSize:   *pageSize,
+	}
+
+	if fields := os.Getenv("REDACT_FIELDS"); fields != "" && !*noRedact {
+		if client.redactor, err = scim.NewRedactor(fields, os.Getenv("REDACT_HASH") == "true"); err != nil {
+			log.Fatalf("error: invalid REDACT_FIELDS %q: %s\n\n%s", fields, err, usage)
+		}
 	}
 
 	switch flag.Arg(0) {
 	case "list":
-		var filter string
-		if flag.Arg(1) != "" {
-			filter = flag.Arg(1)
+		// `list` command flags
+		listCommand := flag.NewFlagSet("list", flag.ExitOnError)
+		listCommandFlags := struct {
+			attributes         *string
+			excludedAttributes *string
+			sortBy             *string
+			sortOrder          *string
+			max                *int
+			filter             *string
+			userName           *string
+			externalID         *string
+			active             *bool
+			inactive           *bool
+		}{
+			attributes:         listCommand.String("attributes", "", ""),
+			excludedAttributes: listCommand.String("excludedAttributes", "", ""),
+			sortBy:             listCommand.String("sortBy", "", ""),
+			sortOrder:          listCommand.String("sortOrder", "", ""),
+			max:                listCommand.Int("max", 0, ""),
+			filter:             listCommand.String("filter", "", ""),
+			userName:           listCommand.String("username", "", ""),
+			externalID:         listCommand.String("external-id", "", ""),
+			active:             listCommand.Bool("active", false, ""),
+			inactive:           listCommand.Bool("inactive", false, ""),
+		}
+
+		listCommand.Parse(flag.Args()[1:])
+
+		if *listCommandFlags.active && *listCommandFlags.inactive {
+			log.Fatalf("error: -active and -inactive can't be combined\n\n%s", usage)
+		}
+
+		var filter scim.FilterBuilder
+		filter.Expr(*listCommandFlags.filter).Expr(listCommand.Arg(0))
+		if *listCommandFlags.userName != "" {
+			filter.Eq("userName", *listCommandFlags.userName)
+		}
+		if *listCommandFlags.externalID != "" {
+			filter.Eq("externalId", *listCommandFlags.externalID)
+		}
+		if *listCommandFlags.active || *listCommandFlags.inactive {
+			filter.Eq("active", *listCommandFlags.active)
 		}
 
-		err = client.listHandler(filter)
+		err = client.listHandler(listOptions{
+			filter:             filter.String(),
+			attributes:         *listCommandFlags.attributes,
+			excludedAttributes: *listCommandFlags.excludedAttributes,
+			sortBy:             *listCommandFlags.sortBy,
+			sortOrder:          *listCommandFlags.sortOrder,
+		}, *listCommandFlags.max)
+	case "search":
+		searchCommand := flag.NewFlagSet("search", flag.ExitOnError)
+		searchCommandFlags := struct {
+			max *int
+		}{
+			max: searchCommand.Int("max", 0, ""),
+		}
+
+		searchCommand.Parse(flag.Args()[1:])
+
+		if searchCommand.Arg(0) == "" {
+			log.Fatalf("error: filter is required\n\n%s", usage)
+		}
+
+		err = client.searchHandler(searchCommand.Arg(0), *searchCommandFlags.max)
+	case "compare":
+		compareCommand := flag.NewFlagSet("compare", flag.ExitOnError)
+		compareCommandFlags := struct {
+			baseURLA *string
+			baseURLB *string
+			match    *string
+			json     *bool
+		}{
+			baseURLA: compareCommand.String("baseurl-a", "", ""),
+			baseURLB: compareCommand.String("baseurl-b", "", ""),
+			match:    compareCommand.String("match", "externalId", ""),
+			json:     compareCommand.Bool("json", false, ""),
+		}
+
+		compareCommand.Parse(flag.Args()[1:])
+
+		if *compareCommandFlags.baseURLA == "" || *compareCommandFlags.baseURLB == "" {
+			log.Fatalf("error: -baseurl-a and -baseurl-b are required\n\n%s", usage)
+		}
+		switch *compareCommandFlags.match {
+		case "externalId", "userName":
+		default:
+			log.Fatalf("error: unknown -match %q: expected externalId or userName\n\n%s", *compareCommandFlags.match, usage)
+		}
+
+		a, b := *client, *client
+		a.baseURL = strings.TrimSuffix(*compareCommandFlags.baseURLA, "/")
+		b.baseURL = strings.TrimSuffix(*compareCommandFlags.baseURLB, "/")
+		if tokenB := os.Getenv("TOKEN_B"); tokenB != "" {
+			b.token = tokenB
+		}
+
+		err = a.compareHandler(&b, *compareCommandFlags.match, *compareCommandFlags.json)
+	case "count":
+		err = client.countHandler(flag.Arg(1))
 	case "remove":
+		removeCommand := flag.NewFlagSet("remove", flag.ExitOnError)
+		removeCommandFlags := struct {
+			by *string
+		}{
+			by: removeCommand.String("by", "", ""),
+		}
+
+		removeCommand.Parse(flag.Args()[1:])
+
+		// allow flags after the user, e.g. `remove alice -by userName`
+		user := removeCommand.Arg(0)
+		if removeCommand.NArg() > 1 {
+			removeCommand.Parse(removeCommand.Args()[1:])
+		}
+
+		if user == "" {
+			log.Fatalf("error: user is required\n\n%s", usage)
+		}
+
+		var guid string
+		if guid, err = client.resolveID(user, *removeCommandFlags.by); err == nil {
+			err = client.removeHandler(guid)
+		}
+	case "bulk-remove":
+		bulkRemoveCommand := flag.NewFlagSet("bulk-remove", flag.ExitOnError)
+		bulkRemoveCommandFlags := struct {
+			file   *string
+			by     *string
+			dryRun *bool
+		}{
+			file:   bulkRemoveCommand.String("f", "", ""),
+			by:     bulkRemoveCommand.String("by", "", ""),
+			dryRun: bulkRemoveCommand.Bool("dry-run", false, ""),
+		}
+
+		bulkRemoveCommand.Parse(flag.Args()[1:])
+
+		if *bulkRemoveCommandFlags.file == "" {
+			log.Fatalf("error: -f is required\n\n%s", usage)
+		}
+
+		err = client.bulkRemoveHandler(*bulkRemoveCommandFlags.file, *bulkRemoveCommandFlags.by, *bulkRemoveCommandFlags.dryRun)
+	case "me":
+		err = client.meHandler()
+	case "activate", "deactivate":
 		if flag.Arg(1) == "" {
 			log.Fatalf("error: guid is required\n\n%s", usage)
 		}
 
-		guid := flag.Arg(1)
-		err = client.removeHandler(guid)
+		err = client.activeHandler(flag.Arg(1), flag.Arg(0) == "activate")
 	case "add":
 		// `add` command flags
 		addCommand := flag.NewFlagSet("add", flag.ExitOnError)
@@ -287,7 +1360,6 @@ func main() {
 		}
 
 		user := scim.User{
-			Schemas:    []string{scim.UserSchema},
 			ExternalID: *addCommandFlags.externalID,
 			UserName:   *addCommandFlags.userName,
 			Name: scim.Name{
@@ -307,11 +1379,87 @@ func main() {
 		}
 
 		err = client.addHandler(user)
+	case "export":
+		exportCommand := flag.NewFlagSet("export", flag.ExitOnError)
+		exportCommandFlags := struct {
+			file   *string
+			ndjson *bool
+		}{
+			file:   exportCommand.String("f", "", ""),
+			ndjson: exportCommand.Bool("ndjson", false, ""),
+		}
+
+		exportCommand.Parse(flag.Args()[1:])
+
+		if *exportCommandFlags.file == "" {
+			log.Fatalf("error: -f is required\n\n%s", usage)
+		}
+
+		err = client.exportHandler(*exportCommandFlags.file, *exportCommandFlags.ndjson)
+	case "import":
+		importCommand := flag.NewFlagSet("import", flag.ExitOnError)
+		importCommandFlags := struct {
+			file        *string
+			concurrency *int
+		}{
+			file:        importCommand.String("f", "", ""),
+			concurrency: importCommand.Int("concurrency", 1, ""),
+		}
+
+		importCommand.Parse(flag.Args()[1:])
+
+		if *importCommandFlags.file == "" {
+			log.Fatalf("error: -f is required\n\n%s", usage)
+		}
+
+		if *importCommandFlags.concurrency < 1 {
+			log.Fatalf("error: -concurrency must be at least 1\n\n%s", usage)
+		}
+
+		err = client.importHandler(*importCommandFlags.file, *importCommandFlags.concurrency)
+	case "patch":
+		// `patch` command flags
+		patchCommand := flag.NewFlagSet("patch", flag.ExitOnError)
+		patchCommandFlags := struct {
+			from    *string
+			to      *string
+			file    *string
+			ifMatch *string
+		}{
+			from:    patchCommand.String("from", "", ""),
+			to:      patchCommand.String("to", "", ""),
+			file:    patchCommand.String("f", "", ""),
+			ifMatch: patchCommand.String("if-match", "", ""),
+		}
+
+		patchCommand.Parse(flag.Args()[1:])
+
+		// allow flags after the guid, e.g. `patch $id -f ops.json`
+		guid := patchCommand.Arg(0)
+		if patchCommand.NArg() > 1 {
+			patchCommand.Parse(patchCommand.Args()[1:])
+		}
+
+		if *patchCommandFlags.file != "" {
+			if guid == "" {
+				log.Fatalf("error: guid is required\n\n%s", usage)
+			}
+
+			err = client.patchHandler(guid, *patchCommandFlags.file, *patchCommandFlags.ifMatch)
+			break
+		}
+
+		if *patchCommandFlags.from == "" || *patchCommandFlags.to == "" {
+			log.Fatalf("error: -f, or -from and -to, are required\n\n%s", usage)
+		}
+
+		err = patchPreviewHandler(*patchCommandFlags.from, *patchCommandFlags.to)
 	default:
 		log.Fatalf("error: unknown command\n\n%s", usage)
 	}
 
 	if err != nil {
-		log.Fatalf("error: %s", err)
+		log.Printf("%s %s", errColor.paint(red, "error:"), err)
+		os.Exit(exitCode(err))
 	}
 }
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// newTestClient returns an apiClient for org "org" on a server running h.
+func newTestClient(t *testing.T, h http.HandlerFunc) *apiClient {
+	t.Helper()
+
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+
+	return &apiClient{
+		client:    srv.Client(),
+		baseURL:   srv.URL,
+		token:     "token",
+		userAgent: "gh-scim-test",
+		org:       "org",
+	}
+}
+
+func TestListEncodesFilterOnce(t *testing.T) {
+	filter := `userName eq "a+b c&d=%e"`
+
+	var got string
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		got = req.URL.Query().Get("filter")
+		w.Write([]byte(`{"totalResults":0,"Resources":[]}`))
+	})
+
+	if _, err := c.list(listOptions{filter: filter}); err != nil {
+		t.Fatal(err)
+	}
+
+	// a filter encoded twice decodes to its encoded form
+	if got != filter {
+		t.Errorf("the server decoded filter %q, want %q", got, filter)
+	}
+}
+
+func TestBulkRemoveCountsEndpointNotFoundAsFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "users")
+	if err := os.WriteFile(path, []byte("alice\nbob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// alice isn't on the server, while bob's lookup gets a 404 like one
+	// for an organization that doesn't exist
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		if strings.Contains(req.URL.Query().Get("filter"), "bob") {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`{"totalResults":0,"Resources":[]}`))
+	})
+
+	if _, err := c.resolveID("alice", ""); !errors.Is(err, errNoUser) {
+		t.Errorf("resolveID(alice) error = %v, want errNoUser", err)
+	}
+
+	err := c.bulkRemoveHandler(path, "", false)
+	if err == nil || err.Error() != "bulk-remove: 1 of 2 users weren't removed" {
+		t.Errorf("bulkRemoveHandler() = %v, want bob to fail", err)
+	}
+}
+
+func TestPatchRefusesChangedUser(t *testing.T) {
+	var patches []string
+	c := newTestClient(t, func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			w.Header().Set("ETag", `W/"2"`)
+			w.Write([]byte(`{"id":"1","userName":"alice","active":true}`))
+		case "PATCH":
+			patches = append(patches, req.Header.Get("If-Match"))
+			if req.Header.Get("If-Match") != `W/"2"` {
+				w.WriteHeader(http.StatusPreconditionFailed)
+				return
+			}
+			w.Write([]byte(`{"id":"1","userName":"alice","active":false}`))
+		}
+	})
+
+	path := filepath.Join(t.TempDir(), "ops.json")
+	if err := os.WriteFile(path, []byte(`{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false}]}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// a version read earlier is sent as is, and the patch isn't retried
+	// when the user changed since
+	err := c.patchHandler("1", path, `W/"1"`)
+	if !errors.Is(err, errChanged) || exitCode(err) != exitValidation {
+		t.Errorf("patch at a stale version = %v (exit %d), want errChanged (exit %d)", err, exitCode(err), exitValidation)
+	}
+	if len(patches) != 1 || patches[0] != `W/"1"` {
+		t.Errorf("patch at a stale version sent If-Match %q, want only W/\"1\"", patches)
+	}
+
+	// without a version, the user is read first
+	patches = nil
+	if err := c.patchHandler("1", path, ""); err != nil {
+		t.Errorf("patch at the current version = %v", err)
+	}
+	if len(patches) != 1 || patches[0] != `W/"2"` {
+		t.Errorf("patch at the current version sent If-Match %q, want only W/\"2\"", patches)
+	}
+}
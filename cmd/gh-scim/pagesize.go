@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	scim "github.com/mtodd/scimtool"
+)
+
+// pageCount returns the count to request per page: -page-size clamped to
+// the server's limit. The first call reads the limit from the
+// ServiceProviderConfig; servers without one are only limited once listAll
+// sees a page come back capped.
+func (c *apiClient) pageCount() int {
+	if !c.maxPageRead {
+		c.maxPageRead = true
+		max, err := c.maxResults()
+		if err != nil {
+			if c.debug {
+				log.Printf("debug: ServiceProviderConfig: %s", err)
+			}
+		} else if max > 0 && (c.maxPage == 0 || max < c.maxPage) {
+			c.maxPage = max
+		}
+	}
+
+	return scim.PageSize(c.pageSize, c.maxPage)
+}
+
+// GET /scim/v2/ServiceProviderConfig
+func (c *apiClient) maxResults() (int, error) {
+	req, err := c.buildRequest("GET", "/scim/v2/ServiceProviderConfig")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", res.Status)
+	}
+
+	var config scim.ServiceProviderConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		return 0, err
+	}
+
+	return config.Filter.MaxResults, nil
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const progressWidth = 30
+
+// progress draws a single-line progress bar with a count and ETA, redrawn in
+// place. A nil progress draws nothing.
+type progress struct {
+	w       io.Writer
+	total   int
+	done    int
+	started time.Time
+	drawn   time.Time
+}
+
+func newProgress(w io.Writer, total int) *progress {
+	return &progress{w: w, total: total, started: time.Now()}
+}
+
+// add records n more processed items, redrawing at most every 100ms.
+func (p *progress) add(n int) {
+	if p == nil {
+		return
+	}
+
+	p.done += n
+	if time.Since(p.drawn) < 100*time.Millisecond && p.done < p.total {
+		return
+	}
+	p.drawn = time.Now()
+	p.draw()
+}
+
+func (p *progress) draw() {
+	done, total := p.done, p.total
+	if total < done {
+		total = done
+	}
+
+	filled := 0
+	if total > 0 {
+		filled = progressWidth * done / total
+	}
+
+	eta := "--"
+	if done > 0 && done < total {
+		elapsed := time.Since(p.started)
+		eta = (elapsed * time.Duration(total-done) / time.Duration(done)).Round(time.Second).String()
+	}
+
+	fmt.Fprintf(p.w, "\r[%s%s] %d/%d ETA %s ", strings.Repeat("#", filled), strings.Repeat(" ", progressWidth-filled), done, total, eta)
+}
+
+// finish draws the final state and ends the line.
+func (p *progress) finish() {
+	if p == nil {
+		return
+	}
+
+	p.draw()
+	fmt.Fprintln(p.w)
+}
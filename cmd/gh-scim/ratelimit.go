@@ -0,0 +1,62 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimit holds requests back once the server reports the rate limit is
+// exhausted, so concurrent workers pause together instead of each running
+// into 429s. A nil rateLimit never waits.
+type rateLimit struct {
+	mu    sync.Mutex
+	until time.Time
+}
+
+// wait blocks until the rate limit has reset.
+func (r *rateLimit) wait() {
+	if r == nil {
+		return
+	}
+
+	r.mu.Lock()
+	d := time.Until(r.until)
+	r.mu.Unlock()
+
+	if d > 0 {
+		time.Sleep(d)
+	}
+}
+
+// update records the reset time reported by res: Retry-After on a 429, or
+// X-RateLimit-Reset once X-RateLimit-Remaining reaches 0.
+func (r *rateLimit) update(res *http.Response) {
+	if r == nil {
+		return
+	}
+
+	var until time.Time
+	if res.StatusCode == http.StatusTooManyRequests {
+		secs, err := strconv.Atoi(res.Header.Get("Retry-After"))
+		if err != nil {
+			secs = 1
+		}
+		until = time.Now().Add(time.Duration(secs) * time.Second)
+	} else if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return
+		}
+		until = time.Unix(reset, 0)
+	} else {
+		return
+	}
+
+	r.mu.Lock()
+	if until.After(r.until) {
+		r.until = until
+	}
+	r.mu.Unlock()
+}
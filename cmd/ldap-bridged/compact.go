@@ -0,0 +1,93 @@
+package main
+
+import (
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// compactQuiet is how long provisioning must have been idle for a scheduled
+// compaction to run; a busy bridge retries after as long again.
+const compactQuiet = time.Minute
+
+// backupTimeFormat names backups so they sort chronologically.
+const backupTimeFormat = "20060102T150405Z"
+
+// compaction is the outcome of a database compaction, shown in /_debug.
+type compaction struct {
+	Time   time.Time `json:"time"`
+	Before int64     `json:"sizeBefore"`
+	After  int64     `json:"sizeAfter"`
+	Backup string    `json:"backup,omitempty"`
+	Error  string    `json:"error,omitempty"`
+}
+
+// compactions holds the last compaction for readers on other goroutines.
+type compactions struct {
+	mu   sync.Mutex
+	last *compaction
+}
+
+func (c *compactions) set(last compaction) {
+	c.mu.Lock()
+	c.last = &last
+	c.mu.Unlock()
+}
+
+func (c *compactions) get() *compaction {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.last
+}
+
+// compact backs up and compacts the database unless provisioning was busy
+// within compactQuiet, returning how long to wait until the next attempt.
+// It runs on the run loop, so it doesn't race the bridge's own writes.
+func (b *bridge) compact() time.Duration {
+	if idle := time.Since(b.lastActivity); idle < compactQuiet {
+		log.Printf("compact: provisioning was active %s ago; retrying in %s", idle.Round(time.Second), compactQuiet)
+		return compactQuiet
+	}
+
+	// the database keeps its path across compactions
+	path := b.db.Path()
+	result := compaction{Time: time.Now()}
+	if b.cfg.backupRetain > 0 {
+		result.Backup = path + "." + result.Time.UTC().Format(backupTimeFormat) + ".bak"
+	}
+
+	var err error
+	result.Before, result.After, err = b.store.Compact(result.Backup)
+	if err != nil {
+		result.Error = err.Error()
+		log.Printf("compact: %s: %s", path, err)
+	} else {
+		log.Printf("compact: %s: %d -> %d bytes in %s", path, result.Before, result.After, time.Since(result.Time))
+		if result.Backup != "" {
+			pruneBackups(path, b.cfg.backupRetain)
+		}
+	}
+	b.compactions.set(result)
+
+	return b.cfg.compactInterval
+}
+
+// pruneBackups removes all but the newest retain backups of path.
+func pruneBackups(path string, retain int) {
+	backups, err := filepath.Glob(path + ".*.bak")
+	if err != nil {
+		log.Printf("compact: list backups: %s", err)
+		return
+	}
+	sort.Strings(backups)
+
+	for len(backups) > retain {
+		if err := os.Remove(backups[0]); err != nil {
+			log.Printf("compact: remove backup: %s", err)
+		}
+		backups = backups[1:]
+	}
+}
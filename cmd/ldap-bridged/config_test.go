@@ -0,0 +1,65 @@
+package main
+
+import (
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+// loadConfigEnv is set when the test binary is re-run to load the
+// configuration, so settings that exit the bridge can be tested.
+const loadConfigEnv = "LDAP_BRIDGED_TEST_LOAD_CONFIG"
+
+func TestMain(m *testing.M) {
+	if os.Getenv(loadConfigEnv) != "" {
+		loadConfig()
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+// loadConfigWith loads the configuration in a new process with env set,
+// returning what it logged and whether it exited successfully.
+func loadConfigWith(t *testing.T, env ...string) (string, bool) {
+	t.Helper()
+
+	cmd := exec.Command(os.Args[0])
+	cmd.Env = append(os.Environ(), append([]string{loadConfigEnv + "=1"}, env...)...)
+	out, err := cmd.CombinedOutput()
+	if _, exited := err.(*exec.ExitError); err != nil && !exited {
+		t.Fatal(err)
+	}
+	return string(out), err == nil
+}
+
+func TestLoadConfigRejectsInvalidNumbers(t *testing.T) {
+	tests := []struct {
+		env  string
+		want string // "" when the setting is valid
+	}{
+		{"SYNC_MAX_REMOVALS=10", ""},
+		{"SYNC_MAX_REMOVALS=0", ""},
+		{"SYNC_MAX_REMOVALS=ten", "invalid SYNC_MAX_REMOVALS"},
+		{"SYNC_MAX_REMOVALS=-1", "invalid SYNC_MAX_REMOVALS"},
+		{"SYNC_MAX_REMOVAL_PERCENT=10", ""},
+		{"SYNC_MAX_REMOVAL_PERCENT=10%", "invalid SYNC_MAX_REMOVAL_PERCENT"},
+		{"SYNC_MAX_REMOVAL_PERCENT=150", "invalid SYNC_MAX_REMOVAL_PERCENT"},
+		{"SYNC_CONCURRENCY=8", ""},
+		{"SYNC_CONCURRENCY=0", "invalid SYNC_CONCURRENCY"},
+		{"SYNC_CONCURRENCY=eight", "invalid SYNC_CONCURRENCY"},
+		{"SCIM_RATE_LIMIT=2.5", ""},
+		{"SCIM_RATE_LIMIT=0", ""},
+		{"SCIM_RATE_LIMIT=fast", "invalid SCIM_RATE_LIMIT"},
+	}
+
+	for _, tt := range tests {
+		out, ok := loadConfigWith(t, tt.env)
+		switch {
+		case tt.want == "" && !ok:
+			t.Errorf("%s: the configuration was rejected: %s", tt.env, out)
+		case tt.want != "" && (ok || !strings.Contains(out, tt.want)):
+			t.Errorf("%s: exited successfully %t, logging %q; want %q", tt.env, ok, out, tt.want)
+		}
+	}
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"time"
+)
+
+// deprovisionCheck is how often pending deprovisions are checked for passed
+// deadlines.
+const deprovisionCheck = time.Minute
+
+// deprovision removes dn, which left the watched groups. With a grace period,
+// dn is first only marked pending deprovision, and is removed once a removal
+// is observed after the deadline, so a member removed by mistake can be
+// re-added without losing their account. A removal first found by a sync,
+// rather than the watch, is reported as drift.
+func (b *bridge) deprovision(ctx context.Context, dn string) error {
+	drift := triggerFrom(ctx) == "sync"
+
+	if b.cfg.deprovisionGrace <= 0 {
+		guid, found, err := b.users.GetGUID(dn)
+		if err != nil {
+			return err
+		}
+		if err := b.Del(ctx, dn); err != nil {
+			return err
+		}
+		if drift && found {
+			b.driftCorrected(ctx, dn, guid, "removed a user who is no longer a member")
+		}
+		return nil
+	}
+
+	deadline, err := b.users.GetPendingDeprovision(dn)
+	if err != nil {
+		return err
+	}
+	if !deadline.IsZero() && time.Now().After(deadline) {
+		return b.Del(ctx, dn)
+	}
+
+	if r := reportFrom(ctx); r != nil {
+		r.skip(1)
+	}
+	if !deadline.IsZero() {
+		return nil
+	}
+
+	deadline = time.Now().Add(b.cfg.deprovisionGrace)
+	if err := b.users.SetPendingDeprovision(dn, deadline); err != nil {
+		return err
+	}
+	log.Printf("remove: %s is pending deprovision until %s", dn, deadline.Format(time.RFC3339))
+	if drift {
+		b.driftCorrected(ctx, dn, "", fmt.Sprintf("marked a user who is no longer a member pending deprovision until %s", deadline.Format(time.RFC3339)))
+	}
+	return nil
+}
+
+// cancelDeprovision clears the pending deprovision of dn, which is a member
+// again.
+func (b *bridge) cancelDeprovision(dn string) error {
+	deadline, err := b.users.GetPendingDeprovision(dn)
+	if err != nil || deadline.IsZero() {
+		return err
+	}
+
+	log.Printf("add: %s is a member again; cancelling its pending deprovision", dn)
+	return b.users.DelPendingDeprovision(dn)
+}
+
+// expireDeprovisions deprovisions the users whose deadline has passed and who
+// are still missing from the watched groups, and cancels the rest.
+func (b *bridge) expireDeprovisions(ctx context.Context) {
+	pending, err := b.users.PendingDeprovisions()
+	if err != nil {
+		log.Printf("remove: pending deprovisions: %s", err)
+		return
+	}
+
+	var expired []string
+	for dn, deadline := range pending {
+		if time.Now().After(deadline) {
+			expired = append(expired, dn)
+		}
+	}
+	if len(expired) == 0 {
+		return
+	}
+
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		log.Printf("remove: pending deprovisions: %s", err)
+		return
+	}
+	if len(res.Entries) == 0 {
+		log.Printf("remove: LDAP search failed to find group; keeping %d pending deprovisions", len(expired))
+		return
+	}
+	members := newDNSet(groupMembers(res.Entries))
+
+	for _, dn := range expired {
+		if members.has(dn) {
+			err = b.cancelDeprovision(dn)
+		} else {
+			err = b.Del(ctx, dn)
+		}
+		if err != nil {
+			log.Printf("remove: %s", err)
+		}
+	}
+}
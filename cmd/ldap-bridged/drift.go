@@ -0,0 +1,63 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// driftWebhookTimeout bounds each DRIFT_WEBHOOK request.
+const driftWebhookTimeout = 10 * time.Second
+
+// driftCorrected reports that a sync corrected drift between the SP and the
+// directory: it added a member the SP was missing, or removed a user that was
+// no longer a member. The watch should have made these changes, so drift may
+// mean a missed event. It's logged as a warning, published as a "drift"
+// event, and posted to the drift webhook, if any.
+func (b *bridge) driftCorrected(ctx context.Context, dn, guid, detail string) {
+	log.Printf("warning: sync: drift corrected: %s: %s", dn, detail)
+
+	e := event{
+		Time:   time.Now(),
+		Action: "drift",
+		DN:     dn,
+		GUID:   guid,
+		Detail: detail,
+	}
+	b.events.publish(e)
+	if r := reportFrom(ctx); r != nil {
+		r.drifted()
+	}
+
+	if b.cfg.driftWebhook != "" {
+		go func() {
+			if err := postDrift(b.cfg.driftWebhook, e); err != nil {
+				log.Printf("drift: webhook: %s", err)
+			}
+		}()
+	}
+}
+
+// postDrift posts e to url as JSON.
+func postDrift(url string, e event) error {
+	buf, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	client := http.Client{Timeout: driftWebhookTimeout}
+	res, err := client.Post(url, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("%s", res.Status)
+	}
+	return nil
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	scim "github.com/mtodd/scimtool"
+)
+
+// event describes a provisioning change made by the bridge.
+//
+//	{
+//	  "time":"2018-01-25T14:35:31-05:00",
+//	  "action":"add",
+//	  "dn":"cn=alice,ou=people,dc=example,dc=com",
+//	  "guid":"e7818cf4-0206-11e8-8526-afbcdd6f73fd"
+//	}
+//
+// "drift" events, for drift a sync corrected, describe the correction in
+// detail, and updates list the attributes they changed.
+type event struct {
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	DN      string                 `json:"dn"`
+	GUID    string                 `json:"guid,omitempty"`
+	Detail  string                 `json:"detail,omitempty"`
+	Changes []scim.AttributeChange `json:"changes,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
+// eventBroker fans bridge events out to any number of subscribers.
+type eventBroker struct {
+	mu   sync.Mutex
+	subs map[chan event]struct{}
+}
+
+func newEventBroker() *eventBroker {
+	return &eventBroker{
+		subs: make(map[chan event]struct{}),
+	}
+}
+
+// publish delivers e to every subscriber. Subscribers that aren't keeping up
+// miss the event rather than blocking provisioning.
+func (b *eventBroker) publish(e event) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	for c := range b.subs {
+		select {
+		case c <- e:
+		default:
+		}
+	}
+}
+
+func (b *eventBroker) subscribe() chan event {
+	c := make(chan event, 64)
+
+	b.mu.Lock()
+	b.subs[c] = struct{}{}
+	b.mu.Unlock()
+
+	return c
+}
+
+func (b *eventBroker) unsubscribe(c chan event) {
+	b.mu.Lock()
+	delete(b.subs, c)
+	b.mu.Unlock()
+}
+
+// ServeHTTP streams events as Server-Sent Events until the client
+// disconnects.
+func (b *eventBroker) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpError(w, http.StatusInternalServerError, errors.New("streaming unsupported"))
+		return
+	}
+
+	c := b.subscribe()
+	defer b.unsubscribe(c)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	flusher.Flush()
+
+	for {
+		select {
+		case e := <-c:
+			buf, err := json.Marshal(e)
+			if err != nil {
+				log.Printf("events: %s", err)
+				continue
+			}
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Action, buf)
+			flusher.Flush()
+		case <-req.Context().Done():
+			return
+		}
+	}
+}
+
+// jsonLogWriter wraps each log line in a JSON object for LOG_FORMAT=json.
+type jsonLogWriter struct {
+	w io.Writer
+}
+
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	buf, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Message string    `json:"message"`
+	}{time.Now(), strings.TrimSuffix(string(p), "\n")})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := j.w.Write(append(buf, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// health tracks conditions that need an operator's attention, keyed by the
+// subsystem that raised them. Alerts are either set as they happen or polled
+// from checks when requested.
+//
+//	{
+//	  "status":"degraded",
+//	  "alerts":{"sync":"refusing to remove 40 of 42 provisioned users"}
+//	}
+type health struct {
+	mu     sync.Mutex
+	alerts map[string]string
+	checks map[string]func() string
+
+	// role is "leader" or "standby" when running with -standby.
+	role string
+}
+
+func newHealth() *health {
+	return &health{
+		alerts: make(map[string]string),
+		checks: make(map[string]func() string),
+	}
+}
+
+// check registers fn to be polled for key's alert on every request; fn
+// returns "" when there's nothing to report.
+func (h *health) check(key string, fn func() string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.checks[key] = fn
+}
+
+func (h *health) setRole(role string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.role = role
+}
+
+// set raises an alert for key, or clears it when msg is empty.
+func (h *health) set(key, msg string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if msg == "" {
+		delete(h.alerts, key)
+		return
+	}
+	h.alerts[key] = msg
+}
+
+// ServeHTTP reports 200 when there are no alerts and 503 otherwise.
+func (h *health) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	h.mu.Lock()
+	alerts := make(map[string]string, len(h.alerts))
+	for k, v := range h.alerts {
+		alerts[k] = v
+	}
+	for k, fn := range h.checks {
+		if msg := fn(); msg != "" {
+			alerts[k] = msg
+		}
+	}
+	role := h.role
+	h.mu.Unlock()
+
+	status := struct {
+		Status string            `json:"status"`
+		Role   string            `json:"role,omitempty"`
+		Alerts map[string]string `json:"alerts,omitempty"`
+	}{Status: "ok", Role: role}
+	if len(alerts) > 0 {
+		status.Status = "degraded"
+		status.Alerts = alerts
+	}
+
+	buf, err := json.Marshal(status)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	if status.Status != "ok" {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
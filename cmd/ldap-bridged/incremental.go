@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+
+	scim "github.com/mtodd/scimtool"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// syncSince reconciles what changed in the directory since watermark, the
+// most recent change the last sync saw, without listing the SP or reading
+// every member: the members of the watched groups modified since are diffed
+// against the bridge store, and the users whose entries were modified since
+// are re-mapped.
+func (b *bridge) syncSince(ctx context.Context, watermark string) error {
+	report := reportFrom(ctx)
+
+	changedGroups, err := b.idp.SearchSince(watermark)
+	if err != nil {
+		return err
+	}
+	changedUsers, err := b.idp.UsersSince(watermark)
+	if err != nil {
+		return err
+	}
+	if len(changedGroups.Entries) == 0 && len(changedUsers) == 0 {
+		log.Printf("sync: nothing changed since %s", watermark)
+		return nil
+	}
+	log.Printf("sync: %d groups and %d users changed since %s", len(changedGroups.Entries), len(changedUsers), watermark)
+
+	// a member of a changed group may still be in an unchanged one, so
+	// removals are decided against every watched group
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		return err
+	}
+	if len(res.Entries) == 0 {
+		return fmt.Errorf("LDAP search failed to find group (or, with LDAP_USER_FILTER, any users)")
+	}
+	groups := res.Entries
+	members := newDNSet(groupMembers(groups))
+	known, err := b.users.GetMemberDNs()
+	if err != nil {
+		return err
+	}
+	// the SP isn't listed, but its users are counted for the report
+	provisioned, err := b.sp.CountUsers(ctx, "")
+	if err != nil {
+		log.Printf("sync: count SP users: %s; reporting those the bridge provisioned", err)
+		provisioned = len(known)
+	}
+	report.LDAPMembers = len(members)
+	report.SPBefore = provisioned
+
+	failed := 0
+	added := make(dnSet)
+	if len(changedGroups.Entries) > 0 {
+		if added, failed, err = b.syncMembership(ctx, changedGroups.Entries, groups, members, newDNSet(known)); err != nil {
+			return err
+		}
+	}
+
+	for _, entry := range changedUsers {
+		// members just added were mapped from their current entries
+		if !members.has(entry.DN) || added.has(entry.DN) {
+			continue
+		}
+		if err := b.remap(ctx, entry); err != nil {
+			log.Printf("sync: %s", err)
+			failed++
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("sync: %d changes since %s failed", failed, watermark)
+	}
+
+	ts := latest(latest(watermark, changedGroups.Entries), changedUsers)
+	if ts != watermark {
+		return b.users.SetWatermark(ts)
+	}
+	return nil
+}
+
+// syncMembership removes the provisioned users that are no longer in any of
+// groups, the watched groups, and adds the members of the changed groups that
+// aren't provisioned. It returns the members it added and how many of the
+// removals and adds failed.
+func (b *bridge) syncMembership(ctx context.Context, changed, groups []*ldap.Entry, members, known dnSet) (added dnSet, failed int, err error) {
+	var removals []string
+	for dn := range known {
+		if !members.has(dn) {
+			removals = append(removals, dn)
+			continue
+		}
+		if b.teamsEnabled() {
+			if err := b.reconcileTeamsOf(ctx, dn, groups); err != nil {
+				log.Printf("sync: %s", err)
+			}
+		}
+	}
+	sort.Strings(removals)
+
+	proceed := b.cfg.prune
+	if !proceed {
+		for _, dn := range removals {
+			log.Printf("sync: would remove %s (pruning disabled)", dn)
+		}
+	} else if proceed, err = b.confirmRemovals(removals, len(known)); err != nil {
+		return nil, 0, err
+	}
+	if proceed {
+		for _, dn := range removals {
+			if err := b.deprovision(ctx, dn); err != nil {
+				log.Printf("sync: remove %s: %s", dn, err)
+				failed++
+			}
+		}
+	} else {
+		reportFrom(ctx).skip(len(removals))
+	}
+
+	added = make(dnSet)
+	for _, dn := range groupMembers(changed) {
+		if known.has(dn) {
+			if err := b.cancelDeprovision(dn); err != nil {
+				log.Printf("sync: %s", err)
+			}
+			continue
+		}
+		if err := b.Add(ctx, dn); err != nil {
+			log.Printf("sync: add %s: %s", dn, err)
+			failed++
+			continue
+		}
+		added[dn] = struct{}{}
+	}
+
+	return added, failed, nil
+}
+
+// reconcileTeamsOf updates the team memberships of the provisioned dn to
+// match groups, under the userName it was provisioned with.
+func (b *bridge) reconcileTeamsOf(ctx context.Context, dn string, groups []*ldap.Entry) error {
+	guid, found, err := b.users.GetGUID(dn)
+	if err != nil || !found {
+		return err
+	}
+	user, found, err := b.users.GetUser(guid)
+	if err != nil || !found {
+		return err
+	}
+	return b.syncTeams(ctx, dn, user.UserName, b.teamsFor(groups, dn))
+}
+
+// remap maps the modified entry of a member again and patches the SP with
+// the attributes that differ from those last provisioned. A member that
+// isn't provisioned is added, e.g. one re-enabled since, and a disabled one
+// is deprovisioned when disabled accounts are.
+func (b *bridge) remap(ctx context.Context, entry *ldap.Entry) error {
+	dn := entry.DN
+	guid, found, err := b.users.GetGUID(dn)
+	if err != nil {
+		return err
+	}
+	if b.skipDisabled(entry) {
+		if !found {
+			return nil
+		}
+		return b.Del(ctx, dn)
+	}
+	if !found {
+		return b.Add(ctx, dn)
+	}
+
+	current, found, err := b.users.GetUser(guid)
+	if err != nil || !found {
+		return err
+	}
+	mapped, err := b.mapEntry(entry)
+	if err != nil {
+		return fmt.Errorf("map %s: %s", dn, err)
+	}
+
+	desired := b.desiredUser(mapped, current)
+	patch, changes := scim.DiffChanges(current, desired)
+	if len(patch.Operations) == 0 {
+		return nil
+	}
+
+	err = b.sp.Patch(ctx, guid, "", patch)
+	b.publish(ctx, "update", dn, guid, changes, err)
+	if err != nil {
+		return fmt.Errorf("patch %s: %s", dn, err)
+	}
+	return b.users.Add(dn, desired)
+}
+
+// latest returns the most recent modifyTimestamp of entries, or ts when none
+// is more recent. Timestamps in the directory's GeneralizedTime format sort
+// lexically.
+func latest(ts string, entries []*ldap.Entry) string {
+	for _, entry := range entries {
+		if t := entry.GetAttributeValue("modifyTimestamp"); t > ts {
+			ts = t
+		}
+	}
+	return ts
+}
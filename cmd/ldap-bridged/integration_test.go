@@ -0,0 +1,92 @@
+//go:build integration
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/idp"
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/ldaptest"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// TestBridge runs the bridge against a directory and the dry-run SP: the
+// startup sync, a sync removing a member who left while it was down, and the
+// watch adding, removing, and suspending members.
+func TestBridge(t *testing.T) {
+	s := ldaptest.Start(t)
+	ou := s.NewOU(t)
+	conn := s.Dial(t)
+
+	active := map[string][]string{"description": {"active"}}
+	fry := ldaptest.AddUser(t, conn, ou, "fry", active)
+	leela := ldaptest.AddUser(t, conn, ou, "leela", active)
+	zoidberg := ldaptest.AddUser(t, conn, ou, "zoidberg", active)
+	group := ldaptest.AddGroup(t, conn, ou, "crew", fry, zoidberg)
+
+	cfg := testConfig()
+
+	lb := idp.NewLDAPProvider(s.Dial(t), ldap.NewSearchRequest(
+		ou,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(cn=crew)",
+		[]string{"*", "modifyTimestamp"},
+		nil,
+	))
+	lb.Attributes = []string{"mail", "description"}
+	lb.DisabledFilter = disabledFilter(cfg.mapping)
+
+	b := newTestBridge(t, &lb, newDryRunSP(t), cfg)
+
+	// startup sync
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	for dn, userName := range map[string]string{fry: "fry", zoidberg: "zoidberg"} {
+		if !provisioned(t, b, dn, userName) {
+			t.Errorf("the startup sync didn't provision %s", dn)
+		}
+	}
+	if !deprovisioned(t, b, leela, "leela") {
+		t.Errorf("the startup sync provisioned %s, who isn't a member", leela)
+	}
+
+	// a member removed while the bridge wasn't watching
+	ldaptest.RemoveMember(t, conn, group, zoidberg)
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !deprovisioned(t, b, zoidberg, "zoidberg") {
+		t.Errorf("the sync didn't deprovision %s", zoidberg)
+	}
+	if !provisioned(t, b, fry, "fry") {
+		t.Errorf("the sync deprovisioned %s", fry)
+	}
+
+	go b.run()
+	go lb.Start()
+	t.Cleanup(lb.Stop)
+	// the watcher's first search sets the baseline later changes are
+	// compared with
+	time.Sleep(3 * time.Second)
+
+	ldaptest.AddMember(t, conn, group, leela)
+	eventually(t, "leela is provisioned", func() bool { return provisioned(t, b, leela, "leela") })
+
+	ldaptest.RemoveMember(t, conn, group, fry)
+	eventually(t, "fry is deprovisioned", func() bool { return deprovisioned(t, b, fry, "fry") })
+
+	ldaptest.Replace(t, conn, leela, "description", "disabled")
+	eventually(t, "leela is suspended", func() bool {
+		user, ok := spUser(t, b.sp, "leela")
+		return ok && !user.Active
+	})
+
+	ldaptest.Replace(t, conn, leela, "description", "active")
+	eventually(t, "leela is reactivated", func() bool {
+		user, ok := spUser(t, b.sp, "leela")
+		return ok && user.Active
+	})
+}
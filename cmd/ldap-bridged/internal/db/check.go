@@ -0,0 +1,120 @@
+package users
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+
+	"github.com/boltdb/bolt"
+
+	scim "github.com/mtodd/scimtool"
+)
+
+// bucketNames are the buckets Prepare creates under the root bucket.
+var bucketNames = []string{
+	membersBucketName,
+	guidIdxBucketName,
+	dnIdxBucketName,
+	metaBucketName,
+	tombBucketName,
+	queueBucketName,
+	auditBucketName,
+	teamBucketName,
+	nameBucketName,
+	deprovBucketName,
+}
+
+// checkSchemaVersion returns an error unless v is a schema version this
+// package understands.
+func checkSchemaVersion(v []byte) error {
+	version, err := strconv.Atoi(string(v))
+	if err != nil {
+		return fmt.Errorf("invalid schema version %q", v)
+	}
+	if version > SchemaVersion {
+		return fmt.Errorf("schema version %d is newer than this bridge's %d", version, SchemaVersion)
+	}
+	return nil
+}
+
+// Check verifies the store's integrity: that its buckets exist and its
+// schema version is one this package understands. With sample > 0 it also
+// checks that many DN/GUID mappings, spread across the store, against each
+// other and the stored users; with sample < 0 it checks every mapping and
+// bolt's page structure.
+func (u *Users) Check(sample int) error {
+	return u.view(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		if root == nil {
+			return fmt.Errorf("missing %s bucket", u.rootBucketName)
+		}
+
+		// a store without a schema version was written by a version of the
+		// bridge that predates some of the buckets, and is only missing them if
+		// it's opened read-only, so Prepare couldn't add them
+		var version []byte
+		if meta := root.Bucket([]byte(metaBucketName)); meta != nil {
+			version = meta.Get([]byte(schemaVersionKey))
+		}
+		required := bucketNames
+		if version == nil {
+			required = []string{membersBucketName, guidIdxBucketName, dnIdxBucketName}
+		}
+		for _, name := range required {
+			if root.Bucket([]byte(name)) == nil {
+				return fmt.Errorf("missing %s bucket", name)
+			}
+		}
+
+		if version != nil {
+			if err := checkSchemaVersion(version); err != nil {
+				return err
+			}
+		}
+
+		if sample == 0 {
+			return nil
+		}
+
+		if sample < 0 {
+			for err := range tx.Check() {
+				return fmt.Errorf("page check: %s", err)
+			}
+		}
+
+		members := root.Bucket([]byte(membersBucketName))
+		guidIdx := root.Bucket([]byte(guidIdxBucketName))
+		dnIdx := root.Bucket([]byte(dnIdxBucketName))
+
+		// checking every step-th mapping spreads the sample across the store
+		step := 1
+		if n := guidIdx.Stats().KeyN; sample > 0 && n > sample {
+			step = n / sample
+		}
+
+		i := 0
+		return guidIdx.ForEach(func(guid, dn []byte) error {
+			i++
+			if (i-1)%step != 0 {
+				return nil
+			}
+
+			if got := dnIdx.Get(dn); string(got) != string(guid) {
+				return fmt.Errorf("index mismatch: guid %s maps to dn %s, which maps to guid %q", guid, dn, got)
+			}
+
+			buf := members.Get(guid)
+			if buf == nil {
+				return fmt.Errorf("guid %s (%s) has no stored user", guid, dn)
+			}
+			var user scim.User
+			if err := json.Unmarshal(buf, &user); err != nil {
+				return fmt.Errorf("stored user %s (%s) is unreadable: %s", guid, dn, err)
+			}
+			if user.ID != string(guid) {
+				return fmt.Errorf("stored user %s (%s) has id %q", guid, dn, user.ID)
+			}
+			return nil
+		})
+	})
+}
@@ -0,0 +1,104 @@
+package users
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/boltdb/bolt"
+)
+
+// Compact rewrites the database into a new file without its free pages and
+// switches the store over to it, returning the file sizes before and after.
+// When backupPath is set, a copy of the database is written there first.
+//
+// It waits for the store's transactions in progress to finish, and the store
+// calls made while it runs wait for it.
+func (u *Users) Compact(backupPath string) (before, after int64, err error) {
+	u.db.mu.Lock()
+	defer u.db.mu.Unlock()
+
+	old := u.db.db
+	path := u.db.path
+	tmpPath := path + ".compact"
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0, 0, err
+	}
+	before = fi.Size()
+
+	// a write transaction waits out any other writer and keeps new ones
+	// from committing to the old file while it's copied
+	tx, err := old.Begin(true)
+	if err != nil {
+		return before, 0, err
+	}
+	defer tx.Rollback()
+
+	if backupPath != "" {
+		if err := tx.CopyFile(backupPath, 0600); err != nil {
+			return before, 0, fmt.Errorf("backup to %s: %s", backupPath, err)
+		}
+	}
+
+	os.Remove(tmpPath)
+	compacted, err := bolt.Open(tmpPath, 0600, nil)
+	if err != nil {
+		return before, 0, err
+	}
+	compacted.MaxBatchSize = old.MaxBatchSize
+	compacted.MaxBatchDelay = old.MaxBatchDelay
+
+	if err := copyTx(compacted, tx); err != nil {
+		compacted.Close()
+		os.Remove(tmpPath)
+		return before, 0, fmt.Errorf("copy: %s", err)
+	}
+
+	// the compacted file is open, and so locked, before it replaces the
+	// old one
+	if err := os.Rename(tmpPath, path); err != nil {
+		compacted.Close()
+		os.Remove(tmpPath)
+		return before, 0, err
+	}
+	tx.Rollback()
+	old.Close()
+	u.db.db = compacted
+
+	if fi, err := os.Stat(path); err == nil {
+		after = fi.Size()
+	}
+	return before, after, nil
+}
+
+// copyTx copies every bucket read by src into dst.
+func copyTx(dst *bolt.DB, src *bolt.Tx) error {
+	return dst.Update(func(tx *bolt.Tx) error {
+		return src.ForEach(func(name []byte, b *bolt.Bucket) error {
+			copied, err := tx.CreateBucket(name)
+			if err != nil {
+				return err
+			}
+			return copyBucket(copied, b)
+		})
+	})
+}
+
+func copyBucket(dst, src *bolt.Bucket) error {
+	if err := dst.SetSequence(src.Sequence()); err != nil {
+		return err
+	}
+
+	return src.ForEach(func(k, v []byte) error {
+		// nested buckets have no value
+		if v == nil {
+			nested, err := dst.CreateBucket(k)
+			if err != nil {
+				return err
+			}
+			return copyBucket(nested, src.Bucket(k))
+		}
+		return dst.Put(k, v)
+	})
+}
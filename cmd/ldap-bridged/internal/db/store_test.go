@@ -0,0 +1,477 @@
+package users
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	scim "github.com/mtodd/scimtool"
+)
+
+// newBoltUsers returns a prepared Users backed by a new database file.
+func newBoltUsers(t *testing.T) *Users {
+	t.Helper()
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "bridge.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	u := New(db)
+	if err := u.Prepare(); err != nil {
+		t.Fatal(err)
+	}
+	return &u
+}
+
+// assertNoZeroUsers fails t if list holds zero-value users, as a list built
+// by appending to a slice preallocated with a length rather than a capacity
+// does.
+func assertNoZeroUsers(t *testing.T, list []scim.User) {
+	t.Helper()
+
+	for i, user := range list {
+		if reflect.DeepEqual(user, scim.User{}) {
+			t.Errorf("user %d of %d is the zero value", i, len(list))
+		}
+	}
+}
+
+// assertNoEmptyStrings is assertNoZeroUsers for lists of DNs.
+func assertNoEmptyStrings(t *testing.T, list []string) {
+	t.Helper()
+
+	for i, s := range list {
+		if s == "" {
+			t.Errorf("entry %d of %d is empty", i, len(list))
+		}
+	}
+}
+
+// StoreTestSuite runs the behavior every Store must have against stores
+// returned by newStore, which must be new and empty for each call.
+func StoreTestSuite(t *testing.T, newStore func(t *testing.T) Store) {
+	const (
+		alice = "uid=alice,ou=people"
+		bob   = "uid=bob,ou=people"
+	)
+
+	t.Run("Prepare", func(t *testing.T) {
+		s := newStore(t)
+
+		// preparing a prepared store changes nothing
+		if err := s.Add(alice, scim.User{ID: "1", UserName: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 2; i++ {
+			if err := s.Prepare(); err != nil {
+				t.Fatalf("Prepare #%d: %s", i+1, err)
+			}
+		}
+		assertMapped(t, s, alice, "1")
+	})
+
+	t.Run("AddGetDel", func(t *testing.T) {
+		s := newStore(t)
+
+		if err := s.Add(alice, scim.User{ID: "1", UserName: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		assertMapped(t, s, alice, "1")
+
+		if err := s.Del("1", alice); err != nil {
+			t.Fatal(err)
+		}
+		assertUnmapped(t, s, alice, "1")
+	})
+
+	t.Run("NotFound", func(t *testing.T) {
+		s := newStore(t)
+
+		assertUnmapped(t, s, alice, "1")
+		if err := s.Del("1", alice); err != nil {
+			t.Errorf("Del of an unknown user: %s", err)
+		}
+	})
+
+	t.Run("GetUser", func(t *testing.T) {
+		s := newStore(t)
+
+		want := scim.User{ID: "1", UserName: "alice", Emails: []scim.Email{{Value: "alice@example.com", Type: "work"}}}
+		if err := s.Add(alice, want); err != nil {
+			t.Fatal(err)
+		}
+		if got, found, err := s.GetUser("1"); err != nil || !found || got.UserName != want.UserName || !reflect.DeepEqual(got.Emails, want.Emails) {
+			t.Errorf("GetUser(1) = %+v, %t, %v; want %+v", got, found, err, want)
+		}
+
+		if err := s.Del("1", alice); err != nil {
+			t.Fatal(err)
+		}
+		if _, found, err := s.GetUser("1"); err != nil || found {
+			t.Errorf("GetUser(1) after Del = found %t, %v; want not found", found, err)
+		}
+	})
+
+	t.Run("ReAddWithNewGUID", func(t *testing.T) {
+		s := newStore(t)
+
+		if err := s.Add(alice, scim.User{ID: "1", UserName: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Del("1", alice); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Add(alice, scim.User{ID: "2", UserName: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+
+		assertMapped(t, s, alice, "2")
+		if _, found, err := s.GetDN("1"); err != nil || found {
+			t.Errorf("GetDN(old GUID) = found %t, %v; want not found", found, err)
+		}
+	})
+
+	t.Run("List", func(t *testing.T) {
+		s := newStore(t)
+
+		list, err := s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(list) != 0 {
+			t.Errorf("List of an empty store = %+v", list)
+		}
+
+		if err := s.Add(alice, scim.User{ID: "1", UserName: "alice"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.Add(bob, scim.User{ID: "2", UserName: "bob"}); err != nil {
+			t.Fatal(err)
+		}
+
+		list, err = s.List()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertNoZeroUsers(t, list)
+		names := []string{}
+		for _, user := range list {
+			names = append(names, user.UserName)
+		}
+		sort.Strings(names)
+		if want := []string{"alice", "bob"}; !reflect.DeepEqual(names, want) {
+			t.Errorf("List returned %v, want %v", names, want)
+		}
+
+		dns, err := s.GetMemberDNs()
+		if err != nil {
+			t.Fatal(err)
+		}
+		assertNoEmptyStrings(t, dns)
+		sort.Strings(dns)
+		if want := []string{alice, bob}; !reflect.DeepEqual(dns, want) {
+			t.Errorf("GetMemberDNs returned %v, want %v", dns, want)
+		}
+	})
+
+	t.Run("Paused", func(t *testing.T) {
+		s := newStore(t)
+
+		if paused, err := s.GetPaused(); err != nil || paused {
+			t.Errorf("GetPaused() of a new store = %t, %v", paused, err)
+		}
+		for _, want := range []bool{true, true, false} {
+			if err := s.SetPaused(want); err != nil {
+				t.Fatal(err)
+			}
+			if got, err := s.GetPaused(); err != nil || got != want {
+				t.Errorf("GetPaused() = %t, %v; want %t", got, err, want)
+			}
+		}
+	})
+
+	t.Run("Tombstones", func(t *testing.T) {
+		s := newStore(t)
+
+		at, err := s.GetTombstone(alice)
+		if err != nil || !at.IsZero() {
+			t.Errorf("GetTombstone before any = %s, %v; want the zero time", at, err)
+		}
+
+		removed := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+		if err := s.SetTombstone(alice, removed); err != nil {
+			t.Fatal(err)
+		}
+		if at, err := s.GetTombstone(alice); err != nil || !at.Equal(removed) {
+			t.Errorf("GetTombstone = %s, %v; want %s", at, err, removed)
+		}
+
+		if err := s.DelTombstone(alice); err != nil {
+			t.Fatal(err)
+		}
+		if at, err := s.GetTombstone(alice); err != nil || !at.IsZero() {
+			t.Errorf("GetTombstone after DelTombstone = %s, %v; want the zero time", at, err)
+		}
+	})
+}
+
+// assertMapped fails t unless dn and guid map to each other.
+func assertMapped(t *testing.T, s Store, dn, guid string) {
+	t.Helper()
+
+	if got, found, err := s.GetGUID(dn); err != nil || !found || got != guid {
+		t.Errorf("GetGUID(%s) = %q, %t, %v; want %q", dn, got, found, err, guid)
+	}
+	if got, found, err := s.GetDN(guid); err != nil || !found || got != dn {
+		t.Errorf("GetDN(%s) = %q, %t, %v; want %q", guid, got, found, err, dn)
+	}
+}
+
+// assertUnmapped fails t if dn or guid are mapped.
+func assertUnmapped(t *testing.T, s Store, dn, guid string) {
+	t.Helper()
+
+	if got, found, err := s.GetGUID(dn); err != nil || found || got != "" {
+		t.Errorf("GetGUID(%s) = %q, %t, %v; want not found", dn, got, found, err)
+	}
+	if got, found, err := s.GetDN(guid); err != nil || found || got != "" {
+		t.Errorf("GetDN(%s) = %q, %t, %v; want not found", guid, got, found, err)
+	}
+}
+
+func TestBoltStore(t *testing.T) {
+	StoreTestSuite(t, func(t *testing.T) Store { return newBoltUsers(t) })
+}
+
+// TestPrepareConcurrently prepares a new store from several goroutines at
+// once. Run it with -race; bolt 1.3.1 trips the race detector's pointer
+// checks on its own, so that needs -gcflags=all=-d=checkptr=0 too.
+func TestPrepareConcurrently(t *testing.T) {
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "bridge.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	u := New(db)
+
+	errs := make(chan error, 8)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(errs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- u.Prepare()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			t.Errorf("Prepare() = %s", err)
+		}
+	}
+	if prepared, err := u.prepared(); err != nil || !prepared {
+		t.Errorf("prepared() after concurrent Prepare calls = %t, %v", prepared, err)
+	}
+	if err := u.Check(-1); err != nil {
+		t.Errorf("Check() = %s", err)
+	}
+}
+
+// TestReadOlderStore reads a store written before most of the buckets
+// existed, as a read-only bridge does without being able to add them.
+func TestReadOlderStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bridge.db")
+	db, err := bolt.Open(path, 0600, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u := New(db)
+	if err := db.Update(func(tx *bolt.Tx) error {
+		root, err := tx.CreateBucket(u.rootBucketName)
+		if err != nil {
+			return err
+		}
+		for _, name := range []string{membersBucketName, guidIdxBucketName, dnIdxBucketName} {
+			if _, err := root.CreateBucket([]byte(name)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	db.Close()
+
+	db, err = bolt.Open(path, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	u = New(db)
+
+	if err := u.Check(-1); err != nil {
+		t.Errorf("Check() = %s", err)
+	}
+
+	const dn = "uid=alice,ou=people"
+	assertUnmapped(t, &u, dn, "1")
+	if at, err := u.GetTombstone(dn); err != nil || !at.IsZero() {
+		t.Errorf("GetTombstone() = %s, %v", at, err)
+	}
+	if at, err := u.GetPendingDeprovision(dn); err != nil || !at.IsZero() {
+		t.Errorf("GetPendingDeprovision() = %s, %v", at, err)
+	}
+	if pending, err := u.PendingDeprovisions(); err != nil || len(pending) != 0 {
+		t.Errorf("PendingDeprovisions() = %v, %v", pending, err)
+	}
+	if records, err := u.AuditRange(time.Time{}, time.Time{}); err != nil || len(records) != 0 {
+		t.Errorf("AuditRange() = %v, %v", records, err)
+	}
+	if ts, err := u.GetWatermark(); err != nil || ts != "" {
+		t.Errorf("GetWatermark() = %q, %v", ts, err)
+	}
+	if dns, err := u.GetPendingRemovals(); err != nil || dns != nil {
+		t.Errorf("GetPendingRemovals() = %v, %v", dns, err)
+	}
+	if paused, err := u.GetPaused(); err != nil || paused {
+		t.Errorf("GetPaused() = %t, %v", paused, err)
+	}
+	if queued, err := u.Queued(); err != nil || len(queued) != 0 {
+		t.Errorf("Queued() = %v, %v", queued, err)
+	}
+	if teams, err := u.GetTeams(dn); err != nil || len(teams) != 0 {
+		t.Errorf("GetTeams() = %v, %v", teams, err)
+	}
+	if name, err := u.GetUserName(dn); err != nil || name != "" {
+		t.Errorf("GetUserName() = %q, %v", name, err)
+	}
+	if list, err := u.List(); err != nil || len(list) != 0 {
+		t.Errorf("List() = %v, %v", list, err)
+	}
+}
+
+func TestCompactWaitsForTransactions(t *testing.T) {
+	u := newBoltUsers(t)
+	t.Cleanup(func() { u.db.db.Close() })
+
+	// reads and writes on the old file while it's replaced would fail, as
+	// it's closed under them, or be lost
+	done := make(chan struct{})
+	errs := make(chan error, 1)
+	added := make([]int, 4)
+	var wg sync.WaitGroup
+	for w := range added {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-done:
+					return
+				default:
+				}
+
+				dn, guid := fmt.Sprintf("uid=%d-%d", w, i), fmt.Sprintf("%d-%d", w, i)
+				err := u.Add(dn, scim.User{ID: guid, UserName: dn})
+				if err == nil {
+					_, _, err = u.GetGUID(dn)
+				}
+				if err != nil {
+					select {
+					case errs <- err:
+					default:
+					}
+					return
+				}
+				added[w] = i + 1
+			}
+		}(w)
+	}
+
+	for i := 0; i < 5; i++ {
+		if _, _, err := u.Compact(""); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(done)
+	wg.Wait()
+
+	select {
+	case err := <-errs:
+		t.Fatalf("store call during a compaction: %s", err)
+	default:
+	}
+
+	for w, n := range added {
+		for i := 0; i < n; i++ {
+			assertMapped(t, u, fmt.Sprintf("uid=%d-%d", w, i), fmt.Sprintf("%d-%d", w, i))
+		}
+	}
+}
+
+// benchmarkCommits measures an initial sync of 5k users, written by
+// concurrent workers as the bridge's sync does, into a new database whose
+// transactions commit at most batchSize writes.
+func benchmarkCommits(b *testing.B, batchSize int) {
+	const users, workers = 5000, 64
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		db, err := bolt.Open(filepath.Join(b.TempDir(), "bridge.db"), 0600, &bolt.Options{Timeout: time.Second})
+		if err != nil {
+			b.Fatal(err)
+		}
+		db.MaxBatchSize = batchSize
+		u := New(db)
+		if err := u.Prepare(); err != nil {
+			b.Fatal(err)
+		}
+
+		dns := make(chan int)
+		errs := make(chan error, workers)
+		var wg sync.WaitGroup
+		b.StartTimer()
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for n := range dns {
+					dn := fmt.Sprintf("uid=user%d,ou=people,dc=planetexpress,dc=com", n)
+					if err := u.Add(dn, scim.User{ID: fmt.Sprint(n), UserName: fmt.Sprintf("user%d", n)}); err != nil {
+						errs <- err
+						return
+					}
+				}
+			}()
+		}
+		for n := 0; n < users; n++ {
+			dns <- n
+		}
+		close(dns)
+		wg.Wait()
+		b.StopTimer()
+
+		close(errs)
+		for err := range errs {
+			b.Fatal(err)
+		}
+		db.Close()
+	}
+}
+
+// BenchmarkCommitPerUser commits every user separately, as
+// SYNC_COMMIT_BATCH_SIZE=1 does.
+func BenchmarkCommitPerUser(b *testing.B) { benchmarkCommits(b, 1) }
+
+// BenchmarkCommitBatched commits users in batches of the default
+// SYNC_COMMIT_BATCH_SIZE.
+func BenchmarkCommitBatched(b *testing.B) { benchmarkCommits(b, 1000) }
@@ -1,8 +1,13 @@
 package users
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"fmt"
+	"strconv"
+	"sync"
+	"time"
 
 	"github.com/boltdb/bolt"
 	scim "github.com/mtodd/scimtool"
@@ -26,14 +31,110 @@ import (
 * dn-to-guid
 * guid-to-dn
 
+## Meta
+
+* schemaVersion: the version of this structure the store was written with
+* watermark: highest group modifyTimestamp seen by a completed sync
+* pendingRemovals: removals held back by the last sync, awaiting confirmation
+
+## Queue
+
+* sequence (key, big-endian)
+* change (action, dn) detected while paused
+
+## Audit
+
+* time/sequence (key)
+* provisioning record (action, dn, guid, trigger, result)
+
+## Team members
+
+* dn and team slug, NUL-separated (key)
+* GitHub login added to the team
+
+## Tombstones
+
+* dn (key)
+* removal time (RFC 3339)
+
+## User names
+
+* dn (key)
+* userName chosen for the dn after a collision
+
+## Pending deprovisions
+
+* dn (key)
+* deadline after which it's deprovisioned (RFC 3339)
+
 */
 
 const (
 	membersBucketName = "members"
 	guidIdxBucketName = "guids"
 	dnIdxBucketName   = "dns"
+	metaBucketName    = "meta"
+	tombBucketName    = "tombstones"
+	queueBucketName   = "queue"
+	auditBucketName   = "audit"
+	teamBucketName    = "teams"
+	nameBucketName    = "userNames"
+	deprovBucketName  = "pendingDeprovisions"
+
+	// auditKeyFormat is fixed-width so keys sort chronologically.
+	auditKeyFormat = "2006-01-02T15:04:05.000000000Z"
+
+	watermarkKey       = "watermark"
+	pendingRemovalsKey = "pendingRemovals"
+	schemaVersionKey   = "schemaVersion"
+	pausedKey          = "paused"
 )
 
+// SchemaVersion is the version of the database structure this package
+// writes. Stores written before it was recorded are version 1.
+const SchemaVersion = 1
+
+// Store is the bridge's persistent record of provisioned users and their
+// DN-to-GUID mappings. Users is the BoltDB-backed implementation.
+type Store interface {
+	Prepare() error
+	GetGUID(dn string) (guid string, found bool, err error)
+	GetDN(guid string) (dn string, found bool, err error)
+	GetUser(guid string) (user scim.User, found bool, err error)
+	GetMemberDNs() ([]string, error)
+	GetMappings() (map[string]string, error)
+	GetWatermark() (string, error)
+	SetWatermark(ts string) error
+	GetPendingRemovals() ([]string, error)
+	SetPendingRemovals(dns []string) error
+	GetPaused() (bool, error)
+	SetPaused(paused bool) error
+	GetTombstone(dn string) (time.Time, error)
+	SetTombstone(dn string, at time.Time) error
+	DelTombstone(dn string) error
+	Enqueue(action, dn string) error
+	Queued() ([]Change, error)
+	Dequeue(seq uint64) error
+	ClearQueue() error
+	Audit(rec AuditRecord) error
+	AuditRange(since, until time.Time) ([]AuditRecord, error)
+	PruneAudit(before time.Time) (int, error)
+	GetTeams(dn string) (map[string]string, error)
+	SetTeamMember(team, dn, login string) error
+	DelTeamMember(team, dn string) error
+	GetUserName(dn string) (string, error)
+	SetUserName(dn, userName string) error
+	GetPendingDeprovision(dn string) (time.Time, error)
+	SetPendingDeprovision(dn string, deadline time.Time) error
+	DelPendingDeprovision(dn string) error
+	PendingDeprovisions() (map[string]time.Time, error)
+	Add(dn string, user scim.User) error
+	Del(guid, dn string) error
+	List() ([]scim.User, error)
+}
+
+var _ Store = (*Users)(nil)
+
 // User ...
 type User struct {
 	DN        string
@@ -44,216 +145,822 @@ type User struct {
 	Email     string
 }
 
+// Change is a membership change held in the queue while provisioning is
+// paused.
+type Change struct {
+	Seq    uint64 `json:"-"`
+	Action string `json:"action"`
+	DN     string `json:"dn"`
+}
+
+// AuditRecord is the persisted record of a single provisioning action.
+// Updates record the attributes they changed.
+type AuditRecord struct {
+	Time    time.Time              `json:"time"`
+	Action  string                 `json:"action"`
+	DN      string                 `json:"dn"`
+	GUID    string                 `json:"guid,omitempty"`
+	Trigger string                 `json:"trigger"`
+	Result  string                 `json:"result"`
+	Changes []scim.AttributeChange `json:"changes,omitempty"`
+	Error   string                 `json:"error,omitempty"`
+}
+
 // Users ...
 type Users struct {
 	rootBucketName []byte
-	db             *bolt.DB
+	db             *dbConn
+}
+
+// dbConn holds the open database, which Compact replaces. path is the
+// database's file, which the replacement is opened under another name
+// before it's renamed to.
+type dbConn struct {
+	mu   sync.RWMutex
+	db   *bolt.DB
+	path string
 }
 
 // New ...
 func New(db *bolt.DB) Users {
 	return Users{
 		rootBucketName: []byte("ldap-scim"),
-		db:             db,
+		db:             &dbConn{db: db, path: db.Path()},
 	}
 }
 
-// Prepare ...
+// view runs fn in a read-only transaction on the open database. A
+// compaction waits for the transaction to finish, and the transaction for a
+// compaction already running.
+func (u *Users) view(fn func(*bolt.Tx) error) error {
+	u.db.mu.RLock()
+	defer u.db.mu.RUnlock()
+	return u.db.db.View(fn)
+}
+
+// update runs fn in a read-write transaction, like view.
+func (u *Users) update(fn func(*bolt.Tx) error) error {
+	u.db.mu.RLock()
+	defer u.db.mu.RUnlock()
+	return u.db.db.Update(fn)
+}
+
+// batch runs fn as part of a batch of read-write transactions, like view.
+func (u *Users) batch(fn func(*bolt.Tx) error) error {
+	u.db.mu.RLock()
+	defer u.db.mu.RUnlock()
+	return u.db.db.Batch(fn)
+}
+
+// bucket returns the named bucket under the root bucket, or nil when the
+// store doesn't have it: one written by an older version has only some of
+// the buckets, and a read-only bridge can't create the rest.
+func (u *Users) bucket(tx *bolt.Tx, name string) *bolt.Bucket {
+	root := tx.Bucket(u.rootBucketName)
+	if root == nil {
+		return nil
+	}
+	return root.Bucket([]byte(name))
+}
+
+// Prepare creates the store's buckets and records its schema version. It's
+// idempotent and safe to call concurrently: bolt runs one write transaction
+// at a time and each caller checks the store again inside its own, so only
+// the first changes anything, and a prepared store isn't written to at all.
+// A store written by a newer version of this package is refused.
 func (u *Users) Prepare() error {
-	// Start the transaction.
-	tx, err := u.db.Begin(true)
-	if err != nil {
+	if prepared, err := u.prepared(); err != nil || prepared {
 		return err
 	}
-	defer tx.Rollback()
 
-	// create the root IdP bucket.
-	root, err := tx.CreateBucketIfNotExists([]byte(u.rootBucketName))
+	return u.update(func(tx *bolt.Tx) error {
+		// create the root IdP bucket.
+		root, err := tx.CreateBucketIfNotExists([]byte(u.rootBucketName))
+		if err != nil {
+			return fmt.Errorf("create %s bucket: %s", u.rootBucketName, err)
+		}
+
+		for _, name := range bucketNames {
+			if _, err := root.CreateBucketIfNotExists([]byte(name)); err != nil {
+				return fmt.Errorf("create %s bucket: %s", name, err)
+			}
+		}
+
+		meta := root.Bucket([]byte(metaBucketName))
+		v := meta.Get([]byte(schemaVersionKey))
+		if v != nil {
+			return checkSchemaVersion(v)
+		}
+		if err := meta.Put([]byte(schemaVersionKey), []byte(strconv.Itoa(SchemaVersion))); err != nil {
+			return fmt.Errorf("persist schema version: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// prepared reports whether every bucket and the schema version are already
+// in place, so Prepare has nothing to write.
+func (u *Users) prepared() (prepared bool, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		if root == nil {
+			return nil
+		}
+		for _, name := range bucketNames {
+			if root.Bucket([]byte(name)) == nil {
+				return nil
+			}
+		}
+
+		v := root.Bucket([]byte(metaBucketName)).Get([]byte(schemaVersionKey))
+		if v == nil {
+			return nil
+		}
+		prepared = true
+		return checkSchemaVersion(v)
+	})
+	return prepared, err
+}
+
+// Prepared reports whether Prepare has created the store's buckets, for
+// callers that can't create them, such as a read-only bridge.
+func (u *Users) Prepared() (prepared bool, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		prepared = tx.Bucket(u.rootBucketName) != nil
+		return nil
+	})
+	return prepared, err
+}
+
+// GetGUID returns the GUID dn is provisioned as. found is false when dn
+// isn't mapped to one.
+func (u *Users) GetGUID(dn string) (guid string, found bool, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		dnIdx := u.bucket(tx, dnIdxBucketName)
+		if dnIdx == nil {
+			return nil
+		}
+
+		v := dnIdx.Get([]byte(dn))
+		guid, found = string(v), v != nil
+		return nil
+	})
+	return guid, found, err
+}
+
+// GetDN returns the DN provisioned as guid. found is false when guid isn't
+// mapped to one.
+func (u *Users) GetDN(guid string) (dn string, found bool, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		guidIdx := u.bucket(tx, guidIdxBucketName)
+		if guidIdx == nil {
+			return nil
+		}
+
+		v := guidIdx.Get([]byte(guid))
+		dn, found = string(v), v != nil
+		return nil
+	})
+	return dn, found, err
+}
+
+// GetUser returns the user as last provisioned as guid. found is false when
+// guid isn't provisioned.
+func (u *Users) GetUser(guid string) (user scim.User, found bool, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		members := u.bucket(tx, membersBucketName)
+		if members == nil {
+			return nil
+		}
+
+		v := members.Get([]byte(guid))
+		if v == nil {
+			return nil
+		}
+		found = true
+		return json.Unmarshal(v, &user)
+	})
+	return user, found, err
+}
+
+// GetMemberDNs ...
+func (u *Users) GetMemberDNs() ([]string, error) {
+	dns := []string{}
+
+	err := u.view(func(tx *bolt.Tx) error {
+		guidIdx := u.bucket(tx, guidIdxBucketName)
+		if guidIdx == nil {
+			return nil
+		}
+
+		return guidIdx.ForEach(func(k []byte, v []byte) error {
+			dns = append(dns, string(v))
+			return nil
+		})
+	})
 	if err != nil {
-		return fmt.Errorf("create %s bucket: %s", u.rootBucketName, err)
+		return nil, err
 	}
 
-	// create membership bucket
-	_, err = root.CreateBucketIfNotExists([]byte(membersBucketName))
+	return dns, nil
+}
+
+// GetMappings returns every GUID-to-DN mapping, keyed by GUID.
+func (u *Users) GetMappings() (map[string]string, error) {
+	mappings := make(map[string]string)
+
+	err := u.view(func(tx *bolt.Tx) error {
+		guidIdx := u.bucket(tx, guidIdxBucketName)
+		if guidIdx == nil {
+			return nil
+		}
+
+		return guidIdx.ForEach(func(k []byte, v []byte) error {
+			mappings[string(k)] = string(v)
+			return nil
+		})
+	})
 	if err != nil {
-		return fmt.Errorf("create members bucket: %s", err)
+		return nil, err
 	}
 
-	// create DN-to-GUID index
-	_, err = root.CreateBucketIfNotExists([]byte(guidIdxBucketName))
+	return mappings, nil
+}
+
+// GetWatermark returns the modifyTimestamp recorded by the last incremental
+// sync, or "" if none has been recorded.
+func (u *Users) GetWatermark() (ts string, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		if meta := u.bucket(tx, metaBucketName); meta != nil {
+			ts = string(meta.Get([]byte(watermarkKey)))
+		}
+		return nil
+	})
+	return ts, err
+}
+
+// SetWatermark records the modifyTimestamp for the next incremental sync.
+func (u *Users) SetWatermark(ts string) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		meta := root.Bucket([]byte(metaBucketName))
+
+		if err := meta.Put([]byte(watermarkKey), []byte(ts)); err != nil {
+			return fmt.Errorf("persist watermark(%s): %s", ts, err)
+		}
+
+		return nil
+	})
+}
+
+// GetPendingRemovals returns the DNs whose removal the last sync held back,
+// or nil if none are pending.
+func (u *Users) GetPendingRemovals() ([]string, error) {
+	var dns []string
+
+	err := u.view(func(tx *bolt.Tx) error {
+		meta := u.bucket(tx, metaBucketName)
+		if meta == nil {
+			return nil
+		}
+
+		v := meta.Get([]byte(pendingRemovalsKey))
+		if len(v) == 0 {
+			return nil
+		}
+
+		if err := json.Unmarshal(v, &dns); err != nil {
+			return fmt.Errorf("json unmarshal pending removals: %s", err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("create guids index bucket: %s", err)
+		return nil, err
 	}
 
-	// create GUID-to-DN index
-	_, err = root.CreateBucketIfNotExists([]byte(dnIdxBucketName))
+	return dns, nil
+}
+
+// SetPendingRemovals records the DNs whose removal is awaiting confirmation.
+// An empty list clears them.
+func (u *Users) SetPendingRemovals(dns []string) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		meta := root.Bucket([]byte(metaBucketName))
+
+		if len(dns) == 0 {
+			return meta.Delete([]byte(pendingRemovalsKey))
+		}
+
+		buf, err := json.Marshal(dns)
+		if err != nil {
+			return fmt.Errorf("json marshal pending removals: %s", err)
+		}
+
+		if err := meta.Put([]byte(pendingRemovalsKey), buf); err != nil {
+			return fmt.Errorf("persist pending removals: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// GetPaused reports whether provisioning was paused when SetPaused was last
+// called, so a pause outlasts a restart.
+func (u *Users) GetPaused() (paused bool, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		if meta := u.bucket(tx, metaBucketName); meta != nil {
+			paused = meta.Get([]byte(pausedKey)) != nil
+		}
+		return nil
+	})
+	return paused, err
+}
+
+// SetPaused records whether provisioning is paused.
+func (u *Users) SetPaused(paused bool) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		meta := root.Bucket([]byte(metaBucketName))
+
+		if !paused {
+			return meta.Delete([]byte(pausedKey))
+		}
+		if err := meta.Put([]byte(pausedKey), []byte("true")); err != nil {
+			return fmt.Errorf("persist paused: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// GetTombstone returns when dn was last deprovisioned, or the zero time if it
+// has no tombstone.
+func (u *Users) GetTombstone(dn string) (at time.Time, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		tombs := u.bucket(tx, tombBucketName)
+		if tombs == nil {
+			return nil
+		}
+
+		v := tombs.Get([]byte(dn))
+		if len(v) == 0 {
+			return nil
+		}
+
+		if at, err = time.Parse(time.RFC3339, string(v)); err != nil {
+			return fmt.Errorf("parse tombstone(%s): %s", dn, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("create dns bucket: %s", err)
+		return time.Time{}, err
 	}
 
-	// Commit the transaction.
-	if err := tx.Commit(); err != nil {
-		return err
+	return at, nil
+}
+
+// SetTombstone records that dn was deprovisioned at the given time.
+func (u *Users) SetTombstone(dn string, at time.Time) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		tombs := root.Bucket([]byte(tombBucketName))
+
+		if err := tombs.Put([]byte(dn), []byte(at.UTC().Format(time.RFC3339))); err != nil {
+			return fmt.Errorf("persist tombstone(%s): %s", dn, err)
+		}
+
+		return nil
+	})
+}
+
+// DelTombstone clears the tombstone for dn, if any.
+func (u *Users) DelTombstone(dn string) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		tombs := root.Bucket([]byte(tombBucketName))
+
+		return tombs.Delete([]byte(dn))
+	})
+}
+
+// Enqueue appends a change to the queue.
+func (u *Users) Enqueue(action, dn string) error {
+	buf, err := json.Marshal(Change{Action: action, DN: dn})
+	if err != nil {
+		return fmt.Errorf("json marshal change(%s %s): %s", action, dn, err)
 	}
 
-	return nil
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		queue := root.Bucket([]byte(queueBucketName))
+
+		seq, err := queue.NextSequence()
+		if err != nil {
+			return err
+		}
+
+		if err := queue.Put(seqKey(seq), buf); err != nil {
+			return fmt.Errorf("persist change(%s %s): %s", action, dn, err)
+		}
+
+		return nil
+	})
 }
 
-// GetGUID ...
-func (u *Users) GetGUID(dn string) (string, error) {
-	tx, err := u.db.Begin(false)
+// Queued returns the queued changes in the order they were enqueued.
+func (u *Users) Queued() ([]Change, error) {
+	changes := []Change{}
+
+	err := u.view(func(tx *bolt.Tx) error {
+		queue := u.bucket(tx, queueBucketName)
+		if queue == nil {
+			return nil
+		}
+
+		return queue.ForEach(func(k []byte, v []byte) error {
+			c := Change{Seq: binary.BigEndian.Uint64(k)}
+			if err := json.Unmarshal(v, &c); err != nil {
+				return err
+			}
+
+			changes = append(changes, c)
+			return nil
+		})
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	defer tx.Rollback()
 
-	root := tx.Bucket(u.rootBucketName)
-	dnIdx := root.Bucket([]byte(dnIdxBucketName))
+	return changes, nil
+}
+
+// Dequeue removes the change with the given sequence number.
+func (u *Users) Dequeue(seq uint64) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		queue := root.Bucket([]byte(queueBucketName))
 
-	guid := dnIdx.Get([]byte(dn))
-	// if len(guid) == 0 {
-	// 	return "", fmt.Errorf("GetGUID(%s) failed: not found", dn)
-	// }
-	return string(guid), nil
+		return queue.Delete(seqKey(seq))
+	})
 }
 
-// GetDN ...
-func (u *Users) GetDN(guid string) (string, error) {
-	tx, err := u.db.Begin(false)
+// ClearQueue drops every queued change.
+func (u *Users) ClearQueue() error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+
+		if err := root.DeleteBucket([]byte(queueBucketName)); err != nil {
+			return fmt.Errorf("clear queue: %s", err)
+		}
+		if _, err := root.CreateBucket([]byte(queueBucketName)); err != nil {
+			return fmt.Errorf("create queue bucket: %s", err)
+		}
+
+		return nil
+	})
+}
+
+// seqKey encodes seq so keys sort in enqueue order.
+func seqKey(seq uint64) []byte {
+	k := make([]byte, 8)
+	binary.BigEndian.PutUint64(k, seq)
+	return k
+}
+
+// Audit appends rec to the audit log. Records are never modified once
+// written; PruneAudit is the only way they are removed.
+func (u *Users) Audit(rec AuditRecord) error {
+	buf, err := json.Marshal(rec)
 	if err != nil {
-		return "", err
+		return fmt.Errorf("json marshal audit(%s %s): %s", rec.Action, rec.DN, err)
 	}
-	defer tx.Rollback()
 
-	root := tx.Bucket(u.rootBucketName)
-	guidIdx := root.Bucket([]byte(guidIdxBucketName))
+	return u.batch(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		audit := root.Bucket([]byte(auditBucketName))
+
+		// the sequence keeps records written in the same instant distinct
+		seq, err := audit.NextSequence()
+		if err != nil {
+			return err
+		}
+		key := fmt.Sprintf("%s/%020d", rec.Time.UTC().Format(auditKeyFormat), seq)
+
+		if err := audit.Put([]byte(key), buf); err != nil {
+			return fmt.Errorf("persist audit(%s %s): %s", rec.Action, rec.DN, err)
+		}
 
-	dn := guidIdx.Get([]byte(guid))
-	// if len(dn) == 0 {
-	// 	return "", fmt.Errorf("GetDN(%s) failed: not found", guid)
-	// }
-	return string(dn), nil
+		return nil
+	})
 }
 
-// GetMemberDNs ...
-func (u *Users) GetMemberDNs() ([]string, error) {
-	dns := []string{}
+// AuditRange returns the audit records written in [since, until), oldest
+// first. A zero until means no upper bound.
+func (u *Users) AuditRange(since, until time.Time) ([]AuditRecord, error) {
+	records := []AuditRecord{}
+
+	err := u.view(func(tx *bolt.Tx) error {
+		audit := u.bucket(tx, auditBucketName)
+		if audit == nil {
+			return nil
+		}
 
-	tx, err := u.db.Begin(false)
+		var max []byte
+		if !until.IsZero() {
+			max = []byte(until.UTC().Format(auditKeyFormat))
+		}
+
+		c := audit.Cursor()
+		for k, v := c.Seek([]byte(since.UTC().Format(auditKeyFormat))); k != nil; k, v = c.Next() {
+			if max != nil && bytes.Compare(k, max) >= 0 {
+				break
+			}
+
+			var rec AuditRecord
+			if err := json.Unmarshal(v, &rec); err != nil {
+				return fmt.Errorf("json unmarshal audit(%s): %s", k, err)
+			}
+			records = append(records, rec)
+		}
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
-	defer tx.Rollback()
 
-	root := tx.Bucket(u.rootBucketName)
-	guidIdx := root.Bucket([]byte(guidIdxBucketName))
+	return records, nil
+}
+
+// PruneAudit removes audit records written before the given time and returns
+// how many were removed.
+func (u *Users) PruneAudit(before time.Time) (int, error) {
+	pruned := 0
+	max := []byte(before.UTC().Format(auditKeyFormat))
+
+	err := u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		audit := root.Bucket([]byte(auditBucketName))
+
+		c := audit.Cursor()
+		for k, _ := c.First(); k != nil && bytes.Compare(k, max) < 0; k, _ = c.First() {
+			if err := c.Delete(); err != nil {
+				return fmt.Errorf("prune audit(%s): %s", k, err)
+			}
+			pruned++
+		}
 
-	if err := guidIdx.ForEach(func(k []byte, v []byte) error {
-		dns = append(dns, string(k))
 		return nil
-	}); err != nil {
+	})
+
+	return pruned, err
+}
+
+// GetTeams returns the teams dn was added to, mapped to the GitHub login it
+// was added as.
+func (u *Users) GetTeams(dn string) (map[string]string, error) {
+	teams := make(map[string]string)
+
+	err := u.view(func(tx *bolt.Tx) error {
+		teamIdx := u.bucket(tx, teamBucketName)
+		if teamIdx == nil {
+			return nil
+		}
+
+		prefix := teamKey(dn, "")
+		c := teamIdx.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			teams[string(k[len(prefix):])] = string(v)
+		}
+		return nil
+	})
+	if err != nil {
 		return nil, err
 	}
 
-	return nil, nil
+	return teams, nil
 }
 
-// Add ...
-func (u *Users) Add(dn string, user scim.User) error {
-	// Start the transaction.
-	tx, err := u.db.Begin(true)
+// SetTeamMember records that dn was added to team as login.
+func (u *Users) SetTeamMember(team, dn, login string) error {
+	return u.batch(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		teamIdx := root.Bucket([]byte(teamBucketName))
+
+		if err := teamIdx.Put(teamKey(dn, team), []byte(login)); err != nil {
+			return fmt.Errorf("persist team member(%s, %s, %s): %s", team, dn, login, err)
+		}
+
+		return nil
+	})
+}
+
+// DelTeamMember records that dn was removed from team.
+func (u *Users) DelTeamMember(team, dn string) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		teamIdx := root.Bucket([]byte(teamBucketName))
+
+		return teamIdx.Delete(teamKey(dn, team))
+	})
+}
+
+// GetUserName returns the userName chosen for dn when its mapped userName
+// collided with another user's, or "" if there is none.
+func (u *Users) GetUserName(dn string) (name string, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		if names := u.bucket(tx, nameBucketName); names != nil {
+			name = string(names.Get([]byte(dn)))
+		}
+		return nil
+	})
+	return name, err
+}
+
+// SetUserName records the userName chosen for dn after a collision, so it's
+// used for dn from then on.
+func (u *Users) SetUserName(dn, userName string) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		names := root.Bucket([]byte(nameBucketName))
+
+		if err := names.Put([]byte(dn), []byte(userName)); err != nil {
+			return fmt.Errorf("persist user name(%s, %s): %s", dn, userName, err)
+		}
+
+		return nil
+	})
+}
+
+// GetPendingDeprovision returns the deadline after which dn is deprovisioned,
+// or the zero time if it isn't pending deprovision.
+func (u *Users) GetPendingDeprovision(dn string) (deadline time.Time, err error) {
+	err = u.view(func(tx *bolt.Tx) error {
+		pending := u.bucket(tx, deprovBucketName)
+		if pending == nil {
+			return nil
+		}
+
+		v := pending.Get([]byte(dn))
+		if len(v) == 0 {
+			return nil
+		}
+
+		if deadline, err = time.Parse(time.RFC3339, string(v)); err != nil {
+			return fmt.Errorf("parse pending deprovision(%s): %s", dn, err)
+		}
+		return nil
+	})
 	if err != nil {
-		return fmt.Errorf("begin: %s", err)
+		return time.Time{}, err
 	}
-	defer tx.Rollback()
 
-	dnb := []byte(dn)
-	guid := []byte(user.ID)
+	return deadline, nil
+}
 
-	// Retrieve the root->members bucket.
-	root := tx.Bucket(u.rootBucketName)
-	members := root.Bucket([]byte(membersBucketName))
-	guidIdx := root.Bucket([]byte(guidIdxBucketName))
-	dnIdx := root.Bucket([]byte(dnIdxBucketName))
+// SetPendingDeprovision records that dn is deprovisioned after deadline.
+func (u *Users) SetPendingDeprovision(dn string, deadline time.Time) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		pending := root.Bucket([]byte(deprovBucketName))
 
-	// Marshal and save the encoded user.
-	if buf, err := json.Marshal(user); err != nil {
-		return fmt.Errorf("json marshal user(%s): %s", guid, err)
-	} else if err := members.Put(guid, buf); err != nil {
-		return fmt.Errorf("persist member(%s): %s", guid, err)
-	}
+		if err := pending.Put([]byte(dn), []byte(deadline.UTC().Format(time.RFC3339))); err != nil {
+			return fmt.Errorf("persist pending deprovision(%s): %s", dn, err)
+		}
 
-	// write GUID-to-DN index
-	if err := guidIdx.Put(guid, dnb); err != nil {
-		return fmt.Errorf("index guid(%s, %s): %s", guid, dn, err)
-	}
+		return nil
+	})
+}
 
-	// write DN-to-GUID index
-	if err := dnIdx.Put(dnb, guid); err != nil {
-		return fmt.Errorf("index dn(%s, %s): %s", dn, guid, err)
-	}
+// DelPendingDeprovision clears the pending deprovision for dn, if any.
+func (u *Users) DelPendingDeprovision(dn string) error {
+	return u.update(func(tx *bolt.Tx) error {
+		root := tx.Bucket(u.rootBucketName)
+		pending := root.Bucket([]byte(deprovBucketName))
+
+		return pending.Delete([]byte(dn))
+	})
+}
+
+// PendingDeprovisions returns every DN pending deprovision, mapped to its
+// deadline.
+func (u *Users) PendingDeprovisions() (map[string]time.Time, error) {
+	deadlines := make(map[string]time.Time)
+
+	err := u.view(func(tx *bolt.Tx) error {
+		pending := u.bucket(tx, deprovBucketName)
+		if pending == nil {
+			return nil
+		}
 
-	// Commit the transaction.
-	if err := tx.Commit(); err != nil {
-		return fmt.Errorf("commit: %s", err)
+		return pending.ForEach(func(k, v []byte) error {
+			deadline, err := time.Parse(time.RFC3339, string(v))
+			if err != nil {
+				return fmt.Errorf("parse pending deprovision(%s): %s", k, err)
+			}
+			deadlines[string(k)] = deadline
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
 	}
 
-	return nil
+	return deadlines, nil
 }
 
-// Del ...
-func (u *Users) Del(guid, dn string) error {
-	// Start the transaction.
-	tx, err := u.db.Begin(true)
+// teamKey groups a DN's team memberships together so they can be scanned by
+// prefix.
+func teamKey(dn, team string) []byte {
+	return []byte(dn + "\x00" + team)
+}
+
+// Add ...
+//
+// Writes go through bolt's Batch so concurrent callers (e.g. Sync workers)
+// are coalesced into fewer transactions.
+func (u *Users) Add(dn string, user scim.User) error {
+	dnb := []byte(dn)
+	guid := []byte(user.ID)
+
+	// Marshal the encoded user.
+	buf, err := json.Marshal(user)
 	if err != nil {
-		return err
+		return fmt.Errorf("json marshal user(%s): %s", guid, err)
 	}
-	defer tx.Rollback()
 
-	// Retrieve the root->members bucket.
-	root := tx.Bucket(u.rootBucketName)
-	members := root.Bucket([]byte(membersBucketName))
-	guidIdx := root.Bucket([]byte(guidIdxBucketName))
-	dnIdx := root.Bucket([]byte(dnIdxBucketName))
+	return u.batch(func(tx *bolt.Tx) error {
+		// Retrieve the root->members bucket.
+		root := tx.Bucket(u.rootBucketName)
+		members := root.Bucket([]byte(membersBucketName))
+		guidIdx := root.Bucket([]byte(guidIdxBucketName))
+		dnIdx := root.Bucket([]byte(dnIdxBucketName))
+
+		// Save the encoded user.
+		if err := members.Put(guid, buf); err != nil {
+			return fmt.Errorf("persist member(%s): %s", guid, err)
+		}
 
-	// remove membership
-	members.Delete([]byte(guid))
+		// write GUID-to-DN index
+		if err := guidIdx.Put(guid, dnb); err != nil {
+			return fmt.Errorf("index guid(%s, %s): %s", guid, dn, err)
+		}
 
-	// clear indexes
-	dnIdx.Delete([]byte(dn))
-	guidIdx.Delete([]byte(guid))
+		// write DN-to-GUID index
+		if err := dnIdx.Put(dnb, guid); err != nil {
+			return fmt.Errorf("index dn(%s, %s): %s", dn, guid, err)
+		}
 
-	// Commit the transaction.
-	if err := tx.Commit(); err != nil {
-		return err
-	}
+		return nil
+	})
+}
+
+// Del ...
+func (u *Users) Del(guid, dn string) error {
+	return u.update(func(tx *bolt.Tx) error {
+		// Retrieve the root->members bucket.
+		root := tx.Bucket(u.rootBucketName)
+		members := root.Bucket([]byte(membersBucketName))
+		guidIdx := root.Bucket([]byte(guidIdxBucketName))
+		dnIdx := root.Bucket([]byte(dnIdxBucketName))
+		names := root.Bucket([]byte(nameBucketName))
+
+		// remove membership
+		members.Delete([]byte(guid))
+		names.Delete([]byte(dn))
+
+		// clear indexes
+		dnIdx.Delete([]byte(dn))
+		guidIdx.Delete([]byte(guid))
 
-	return nil
+		return nil
+	})
 }
 
 // List ...
 func (u *Users) List() ([]scim.User, error) {
 	list := make([]scim.User, 0)
 
-	tx, err := u.db.Begin(false)
-	if err != nil {
-		return nil, err
-	}
-	defer tx.Rollback()
-
-	root := tx.Bucket([]byte(u.rootBucketName))
-	members := root.Bucket([]byte(membersBucketName))
-	if err := members.ForEach(func(k []byte, v []byte) error {
-		u := scim.User{}
-		// log.Printf("%+v %+v", string(k), string(v))
-		if err := json.Unmarshal(v, &u); err != nil {
-			return err
+	err := u.view(func(tx *bolt.Tx) error {
+		members := u.bucket(tx, membersBucketName)
+		if members == nil {
+			return nil
 		}
 
-		list = append(list, u)
+		return members.ForEach(func(k []byte, v []byte) error {
+			u := scim.User{}
+			// log.Printf("%+v %+v", string(k), string(v))
+			if err := json.Unmarshal(v, &u); err != nil {
+				return err
+			}
 
-		return nil
-	}); err != nil {
+			list = append(list, u)
+
+			return nil
+		})
+	})
+	if err != nil {
 		return nil, err
 	}
 
@@ -0,0 +1,114 @@
+//go:build integration
+
+package idp
+
+import (
+	"testing"
+	"time"
+
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/ldaptest"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// watchBaseline is long enough for the watcher's first search, which sets
+// the baseline later changes are compared with.
+const watchBaseline = 3 * time.Second
+
+// expectDN fails t unless c receives dn before the watcher's next few polls.
+func expectDN(t *testing.T, name string, c <-chan string, dn string) {
+	t.Helper()
+
+	select {
+	case got := <-c:
+		if got != dn {
+			t.Errorf("%s received %s, want %s", name, got, dn)
+		}
+	case <-time.After(10 * time.Second):
+		t.Errorf("%s didn't receive %s", name, dn)
+	}
+}
+
+func TestLDAPProviderWatchesGroup(t *testing.T) {
+	s := ldaptest.Start(t)
+	ou := s.NewOU(t)
+	conn := s.Dial(t)
+
+	fry := ldaptest.AddUser(t, conn, ou, "fry", nil)
+	leela := ldaptest.AddUser(t, conn, ou, "leela", nil)
+	group := ldaptest.AddGroup(t, conn, ou, "crew", fry)
+
+	sr := ldap.NewSearchRequest(
+		ou,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(cn=crew)",
+		[]string{"*", "modifyTimestamp"},
+		nil,
+	)
+	p := NewLDAPProvider(s.Dial(t), sr)
+	go p.Start()
+	t.Cleanup(p.Stop)
+
+	res, err := p.Search(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Entries) != 1 || res.Entries[0].DN != group {
+		t.Fatalf("Search(nil) = %d entries, want %s", len(res.Entries), group)
+	}
+
+	entry, err := p.Fetch(fry)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if uid := entry.GetAttributeValue("uid"); uid != "fry" {
+		t.Errorf("Fetch(%s) uid = %q, want fry", fry, uid)
+	}
+
+	entries, err := p.FetchUID("leela")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].DN != leela {
+		t.Errorf("FetchUID(leela) = %d entries, want %s", len(entries), leela)
+	}
+
+	time.Sleep(watchBaseline)
+	added, removed := p.Changes()
+
+	ldaptest.AddMember(t, conn, group, leela)
+	expectDN(t, "Added", added, leela)
+
+	ldaptest.RemoveMember(t, conn, group, fry)
+	expectDN(t, "Removed", removed, fry)
+}
+
+func TestLDAPProviderWatchesDisabled(t *testing.T) {
+	s := ldaptest.Start(t)
+	ou := s.NewOU(t)
+	conn := s.Dial(t)
+
+	fry := ldaptest.AddUser(t, conn, ou, "fry", map[string][]string{"description": {"active"}})
+	ldaptest.AddGroup(t, conn, ou, "crew", fry)
+
+	sr := ldap.NewSearchRequest(
+		ou,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		"(cn=crew)",
+		[]string{"*", "modifyTimestamp"},
+		nil,
+	)
+	p := NewLDAPProvider(s.Dial(t), sr)
+	p.DisabledFilter = "(description=disabled)"
+	go p.Start()
+	t.Cleanup(p.Stop)
+
+	time.Sleep(watchBaseline)
+	disabled, enabled := p.StatusChanges()
+
+	ldaptest.Replace(t, conn, fry, "description", "disabled")
+	expectDN(t, "Disabled", disabled, fry)
+
+	ldaptest.Replace(t, conn, fry, "description", "active")
+	expectDN(t, "Enabled", enabled, fry)
+}
@@ -1,8 +1,13 @@
 package idp
 
 import (
+	"crypto/sha256"
 	"fmt"
 	"log"
+	"net"
+	"net/url"
+	"sort"
+	"strings"
 	"time"
 
 	"github.com/mtodd/ldapwatch"
@@ -10,6 +15,24 @@ import (
 	ldap "gopkg.in/ldap.v2"
 )
 
+// Provider is the directory the bridge provisions from: it searches the
+// watched groups, fetches users, and reports membership changes once
+// started. LDAPProvider is the LDAP implementation.
+type Provider interface {
+	Start() error
+	Stop()
+	Changes() (added, removed <-chan string)
+	StatusChanges() (disabled, enabled <-chan string)
+	Search(req *ldap.SearchRequest) (*ldap.SearchResult, error)
+	SearchSince(ts string) (*ldap.SearchResult, error)
+	UsersSince(ts string) ([]*ldap.Entry, error)
+	Fetch(dn string) (*ldap.Entry, error)
+	FetchUID(uids ...string) ([]*ldap.Entry, error)
+	Users() ([]*ldap.Entry, error)
+}
+
+var _ Provider = (*LDAPProvider)(nil)
+
 // LDAPProvider ...
 type LDAPProvider struct {
 	conn    *ldap.Conn
@@ -17,6 +40,73 @@ type LDAPProvider struct {
 	Added   chan string
 	Removed chan string
 	done    chan struct{}
+	watcher *ldapwatch.Watcher
+
+	// Disabled and Enabled receive the DNs of accounts that start or stop
+	// matching DisabledFilter; no accounts are watched when it's empty.
+	DisabledFilter string
+	Disabled       chan string
+	Enabled        chan string
+
+	// Compare decides whether a watched group entry changed between two
+	// searches; defaults to DefaultCompare when nil.
+	Compare CompareFunc
+
+	// SizeLimit and TimeLimit (in seconds) bound the provider's own
+	// searches; 0 means no limit.
+	SizeLimit int
+	TimeLimit int
+
+	// Attributes are fetched for each user in addition to the defaults
+	// (uid, cn, sn, givenName, mail, modifyTimestamp).
+	Attributes []string
+
+	// ReferralConn connects and binds to the host:port named by an ldap://
+	// search result reference, so the provider's searches follow referrals
+	// one hop; when nil, referrals are only logged.
+	ReferralConn func(addr string) (*ldap.Conn, error)
+
+	// UserSearch makes the watched search match the users to provision
+	// rather than groups. Its results are presented as a single group, named
+	// by the search's base DN, whose members are the matched DNs, so they're
+	// diffed like a group's member list.
+	UserSearch bool
+}
+
+// CompareFunc reports whether the group entry changed between the previous
+// and next search results.
+type CompareFunc func(prev, next *ldap.Entry) bool
+
+// DefaultCompare reports a change when modifyTimestamp differs, falling back
+// to comparing the member list for directories that don't expose
+// modifyTimestamp or don't update it on membership edits.
+func DefaultCompare(prev, next *ldap.Entry) bool {
+	return ModifyTimestampChanged(prev, next) || MembersChanged(prev, next)
+}
+
+// ModifyTimestampChanged reports a change when the entry's modifyTimestamp
+// differs.
+func ModifyTimestampChanged(prev, next *ldap.Entry) bool {
+	return prev.GetAttributeValue("modifyTimestamp") != next.GetAttributeValue("modifyTimestamp")
+}
+
+// MembersChanged reports a change when a hash of the entry's sorted member
+// list differs.
+func MembersChanged(prev, next *ldap.Entry) bool {
+	return membersHash(prev) != membersHash(next)
+}
+
+func membersHash(entry *ldap.Entry) string {
+	members := append([]string(nil), entry.GetAttributeValues("member")...)
+	sort.Strings(members)
+
+	h := sha256.New()
+	for _, dn := range members {
+		h.Write([]byte(dn))
+		h.Write([]byte{0})
+	}
+
+	return string(h.Sum(nil))
 }
 
 // NewLDAPProvider ...
@@ -27,34 +117,80 @@ func NewLDAPProvider(conn *ldap.Conn, sr *ldap.SearchRequest) LDAPProvider {
 		Added:   make(chan string),
 		Removed: make(chan string),
 		done:    make(chan struct{}),
+
+		Disabled: make(chan string),
+		Enabled:  make(chan string),
 	}
 }
 
 // Start ...
 func (p *LDAPProvider) Start() error {
 	updates := make(chan event)
-	done := make(chan struct{})
-	// defer func() { close(done) }()
-	go handleUpdates(p, updates, done)
+	go handleUpdates(p, updates, p.done)
 
 	w, err := ldapwatch.NewWatcher(p.conn, 1*time.Second, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
-	// defer w.Stop()
+	p.watcher = w
+
+	compare := p.Compare
+	if compare == nil {
+		compare = DefaultCompare
+	}
 
 	c := groupMembershipChecker{
-		c: updates,
+		c:       updates,
+		compare: compare,
 	}
 
 	// register the search
-	w.Add(p.sr, &c)
+	if p.UserSearch {
+		w.Add(p.sr, &userSearchChecker{sr: p.sr, next: &c})
+	} else {
+		w.Add(p.sr, &c)
+	}
+
+	if p.DisabledFilter != "" {
+		req := ldap.NewSearchRequest(
+			p.sr.BaseDN,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, p.SizeLimit, p.TimeLimit, false,
+			p.DisabledFilter,
+			[]string{"dn"},
+			nil,
+		)
+		w.Add(req, &disabledChecker{
+			disabled: p.Disabled,
+			enabled:  p.Enabled,
+			done:     p.done,
+		})
+	}
 
 	w.Start()
 
 	return nil
 }
 
+// Stop stops watching for membership changes.
+func (p *LDAPProvider) Stop() {
+	if p.watcher != nil {
+		p.watcher.Stop()
+	}
+	close(p.done)
+}
+
+// Changes returns the channels that receive the DNs added to and removed
+// from the watched groups.
+func (p *LDAPProvider) Changes() (added, removed <-chan string) {
+	return p.Added, p.Removed
+}
+
+// StatusChanges returns the channels that receive the DNs of accounts
+// disabled and re-enabled in the directory.
+func (p *LDAPProvider) StatusChanges() (disabled, enabled <-chan string) {
+	return p.Disabled, p.Enabled
+}
+
 type event struct {
 	before *ldap.Entry
 	after  *ldap.Entry
@@ -64,17 +200,18 @@ type event struct {
 // the search results change over time.
 //
 // In this case, our Checker keeps track of previous results as well as
-// holding a channel that we notify whenever changes are detected.
+// holding a channel that we notify whenever compare detects a change.
 type groupMembershipChecker struct {
-	prev *ldap.SearchResult
-	c    chan event
+	prev    *ldap.SearchResult
+	c       chan event
+	compare CompareFunc
 }
 
 // Check receives the result of the search; the Checker needs to take action
 // if the result does not match what it expects.
 func (c *groupMembershipChecker) Check(r *ldap.SearchResult, err error) {
 	if err != nil {
-		log.Printf("%s", err)
+		log.Printf("%s", limitError(err))
 		return
 	}
 
@@ -85,23 +222,133 @@ func (c *groupMembershipChecker) Check(r *ldap.SearchResult, err error) {
 		return
 	}
 
-	if len(c.prev.Entries) != len(r.Entries) {
-		// entries returned does not match
-		c.prev = r
+	// nothing matching at all is more likely a missing group or a directory
+	// problem than everyone leaving, so the baseline stands
+	if len(r.Entries) == 0 && len(c.prev.Entries) > 0 {
+		log.Printf("watch: the search matched no groups; keeping the previous result")
 		return
 	}
 
-	prevEntry := c.prev.Entries[0]
-	nextEntry := r.Entries[0]
+	// the search may match several groups; compare each with its previous
+	// result by DN
+	prev := make(map[string]*ldap.Entry, len(c.prev.Entries))
+	for _, entry := range c.prev.Entries {
+		prev[entry.DN] = entry
+	}
+
+	changed := false
+	matched := make(map[string]bool, len(r.Entries))
+	for _, nextEntry := range r.Entries {
+		matched[nextEntry.DN] = true
+
+		prevEntry, ok := prev[nextEntry.DN]
+		if !ok {
+			// a group that newly matches adds all of its members
+			changed = true
+			c.c <- event{ldap.NewEntry(nextEntry.DN, nil), nextEntry}
+			continue
+		}
+
+		if c.compare(prevEntry, nextEntry) {
+			changed = true
+			c.c <- event{prevEntry, nextEntry}
+		}
+	}
 
-	if prevEntry.GetAttributeValue("modifyTimestamp") != nextEntry.GetAttributeValue("modifyTimestamp") {
-		// modifyTimestamp changed
+	// and one that no longer matches removes them
+	for _, prevEntry := range c.prev.Entries {
+		if !matched[prevEntry.DN] {
+			changed = true
+			c.c <- event{prevEntry, ldap.NewEntry(prevEntry.DN, nil)}
+		}
+	}
+
+	if changed {
 		c.prev = r
-		c.c <- event{prevEntry, nextEntry}
+	}
+}
+
+// userSearchChecker implements ldapwatch.Checker for a UserSearch, passing
+// its results on as a single group.
+type userSearchChecker struct {
+	sr   *ldap.SearchRequest
+	next *groupMembershipChecker
+}
+
+func (c *userSearchChecker) Check(r *ldap.SearchResult, err error) {
+	if err != nil {
+		c.next.Check(nil, err)
+		return
+	}
+	c.next.Check(asGroup(c.sr, r), nil)
+}
+
+// asGroup presents the users matched by sr as a group whose members are
+// their DNs. A search matching no users yields no group, which the bridge
+// treats like a missing group rather than removing every user.
+func asGroup(sr *ldap.SearchRequest, r *ldap.SearchResult) *ldap.SearchResult {
+	if len(r.Entries) == 0 {
+		return &ldap.SearchResult{Referrals: r.Referrals}
+	}
+
+	members := make([]string, len(r.Entries))
+	for i, entry := range r.Entries {
+		members[i] = entry.DN
+	}
+	group := ldap.NewEntry(sr.BaseDN, map[string][]string{"member": members})
+
+	return &ldap.SearchResult{Entries: []*ldap.Entry{group}, Referrals: r.Referrals}
+}
+
+// disabledChecker implements ldapwatch.Checker for the search matching
+// disabled accounts, reporting DNs that join or leave the result.
+type disabledChecker struct {
+	prev     map[string]bool
+	disabled chan string
+	enabled  chan string
+	done     chan struct{}
+}
+
+// Check compares the disabled accounts with the previous result; the first
+// result sets the baseline, since the startup sync reconciles existing
+// accounts.
+func (c *disabledChecker) Check(r *ldap.SearchResult, err error) {
+	if err != nil {
+		log.Printf("disabled accounts: %s", limitError(err))
 		return
 	}
 
-	// no change
+	next := make(map[string]bool, len(r.Entries))
+	for _, entry := range r.Entries {
+		next[entry.DN] = true
+	}
+
+	prev := c.prev
+	c.prev = next
+	if prev == nil {
+		return
+	}
+
+	for dn := range next {
+		if !prev[dn] && !c.send(c.disabled, dn) {
+			return
+		}
+	}
+	for dn := range prev {
+		if !next[dn] && !c.send(c.enabled, dn) {
+			return
+		}
+	}
+}
+
+// send delivers dn unless the provider is stopped first.
+func (c *disabledChecker) send(ch chan string, dn string) bool {
+	select {
+	case ch <- dn:
+		return true
+	case <-c.done:
+		return false
+	}
 }
 
 type changes struct {
@@ -179,13 +426,13 @@ func handleUpdates(p *LDAPProvider, c chan event, done chan struct{}) {
 func (p *LDAPProvider) Fetch(dn string) (*ldap.Entry, error) {
 	req := ldap.NewSearchRequest(
 		dn,
-		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, p.SizeLimit, p.TimeLimit, false,
 		"(objectClass=*)",
-		[]string{"dn", "uid", "cn", "sn", "givenName", "mail", "modifyTimestamp"},
+		p.userAttributes(),
 		nil,
 	)
 
-	res, err := p.conn.Search(req)
+	res, err := p.search(req)
 	if err != nil {
 		return nil, fmt.Errorf("fetch failed: %s", err)
 	}
@@ -195,16 +442,15 @@ func (p *LDAPProvider) Fetch(dn string) (*ldap.Entry, error) {
 
 // FetchUid ...
 func (p *LDAPProvider) FetchUID(uids ...string) ([]*ldap.Entry, error) {
-	filter := fmt.Sprintf("(uid=%s)", uids[0])
 	req := ldap.NewSearchRequest(
 		p.sr.BaseDN,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(&(objectClass=*)(%s))", filter),
-		[]string{"dn", "uid", "cn", "sn", "givenName", "mail", "modifyTimestamp"},
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, p.SizeLimit, p.TimeLimit, false,
+		uidFilter(uids[0]),
+		p.userAttributes(),
 		nil,
 	)
 
-	res, err := p.conn.Search(req)
+	res, err := p.search(req)
 	if err != nil {
 		return nil, fmt.Errorf("fetch by UID (%s) failed: %s", uids, err)
 	}
@@ -212,10 +458,166 @@ func (p *LDAPProvider) FetchUID(uids ...string) ([]*ldap.Entry, error) {
 	return res.Entries, nil
 }
 
+// uidFilter matches the entry with uid. uids come from the SP, so they're
+// escaped rather than trusted to be free of filter syntax.
+func uidFilter(uid string) string {
+	return fmt.Sprintf("(&(objectClass=*)(uid=%s))", ldap.EscapeFilter(uid))
+}
+
+// Users returns the entries of the users a UserSearch matches, with the
+// attributes Fetch returns, in a single search. Group members can't be read
+// that way, so it returns nil without a UserSearch.
+func (p *LDAPProvider) Users() ([]*ldap.Entry, error) {
+	if !p.UserSearch {
+		return nil, nil
+	}
+
+	req := *p.sr
+	req.Attributes = p.userAttributes()
+	res, err := p.search(&req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch users failed: %s", err)
+	}
+
+	return res.Entries, nil
+}
+
+func (p *LDAPProvider) userAttributes() []string {
+	attrs := []string{"dn", "uid", "cn", "sn", "givenName", "mail", "modifyTimestamp"}
+	return append(attrs, p.Attributes...)
+}
+
 // Search ...
 func (p *LDAPProvider) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
 	if req == nil {
+		if p.UserSearch {
+			res, err := p.search(p.sr)
+			if err != nil {
+				return nil, err
+			}
+			return asGroup(p.sr, res), nil
+		}
 		req = p.sr
 	}
-	return p.conn.Search(req)
+	return p.search(req)
+}
+
+// SearchSince runs the watched search restricted to entries modified after
+// the given modifyTimestamp. A UserSearch can't tell whether users stopped
+// matching since then, so it always runs in full.
+func (p *LDAPProvider) SearchSince(ts string) (*ldap.SearchResult, error) {
+	if p.UserSearch {
+		return p.Search(nil)
+	}
+
+	req := *p.sr
+	req.Filter = sinceFilter(p.sr.Filter, ts)
+	return p.search(&req)
+}
+
+// UsersSince returns the entries of the users under the search's base DN
+// modified after the given modifyTimestamp, with the attributes Fetch
+// returns. With a UserSearch, only the users it matches are returned.
+func (p *LDAPProvider) UsersSince(ts string) ([]*ldap.Entry, error) {
+	filter := "(uid=*)"
+	if p.UserSearch {
+		filter = p.sr.Filter
+	}
+
+	req := ldap.NewSearchRequest(
+		p.sr.BaseDN,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, p.SizeLimit, p.TimeLimit, false,
+		sinceFilter(filter, ts),
+		p.userAttributes(),
+		nil,
+	)
+
+	res, err := p.search(req)
+	if err != nil {
+		return nil, fmt.Errorf("fetch users modified since %s failed: %s", ts, err)
+	}
+
+	return res.Entries, nil
+}
+
+// sinceFilter restricts filter to entries modified after the modifyTimestamp
+// ts, which is escaped like the other values the bridge puts in filters.
+func sinceFilter(filter, ts string) string {
+	ts = ldap.EscapeFilter(ts)
+	return fmt.Sprintf("(&%s(modifyTimestamp>=%s)(!(modifyTimestamp=%s)))", filter, ts, ts)
+}
+
+// search runs req, refusing the partial results returned alongside a size or
+// time limit error.
+func (p *LDAPProvider) search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	res, err := p.conn.Search(req)
+	if err != nil {
+		return nil, limitError(err)
+	}
+
+	for _, ref := range res.Referrals {
+		if p.ReferralConn == nil {
+			log.Printf("ldap: search %s: referral to %s not followed", req.BaseDN, ref)
+			continue
+		}
+
+		entries, err := p.followReferral(req, ref)
+		if err != nil {
+			return nil, fmt.Errorf("follow referral to %s: %s", ref, err)
+		}
+		log.Printf("ldap: search %s: followed referral to %s (%d entries)", req.BaseDN, ref, len(entries))
+		res.Entries = append(res.Entries, entries...)
+	}
+
+	return res, nil
+}
+
+// followReferral repeats req against the server and base DN named by the
+// ldap:// URL ref. Referrals returned by that server aren't followed.
+func (p *LDAPProvider) followReferral(req *ldap.SearchRequest, ref string) ([]*ldap.Entry, error) {
+	u, err := url.Parse(ref)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "ldap" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "389")
+	}
+
+	conn, err := p.ReferralConn(addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	referred := *req
+	if base := strings.TrimPrefix(u.Path, "/"); base != "" {
+		referred.BaseDN = base
+	}
+
+	res, err := conn.Search(&referred)
+	if err != nil {
+		return nil, limitError(err)
+	}
+	for _, next := range res.Referrals {
+		log.Printf("ldap: search %s: referral to %s not followed (one hop only)", referred.BaseDN, next)
+	}
+
+	return res.Entries, nil
+}
+
+// limitError explains size and time limit errors, which otherwise look like
+// an ordinary (and partial) result.
+func limitError(err error) error {
+	switch {
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultSizeLimitExceeded):
+		return fmt.Errorf("search exceeded the size limit; partial results discarded: %s", err)
+	case ldap.IsErrorWithCode(err, ldap.LDAPResultTimeLimitExceeded):
+		return fmt.Errorf("search exceeded the time limit; partial results discarded: %s", err)
+	}
+	return err
 }
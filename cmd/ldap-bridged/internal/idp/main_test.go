@@ -0,0 +1,113 @@
+package idp
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+func TestUIDFilterEscapes(t *testing.T) {
+	tests := []struct {
+		uid  string
+		want string
+	}{
+		{"alice", `(&(objectClass=*)(uid=alice))`},
+		{"*)(uid=*", `(&(objectClass=*)(uid=\2a\29\28uid=\2a))`},
+		{`a\b`, `(&(objectClass=*)(uid=a\5cb))`},
+		{"a\x00b", `(&(objectClass=*)(uid=a\00b))`},
+	}
+
+	for _, tt := range tests {
+		got := uidFilter(tt.uid)
+		if got != tt.want {
+			t.Errorf("uidFilter(%q) = %s, want %s", tt.uid, got, tt.want)
+		}
+
+		// the uid is matched literally by a single equality assertion, never
+		// as a wildcard or further filter terms
+		f, err := ldap.CompileFilter(got)
+		if err != nil {
+			t.Errorf("uidFilter(%q) = %s doesn't compile: %s", tt.uid, got, err)
+			continue
+		}
+		if n := len(f.Children); n != 2 {
+			t.Errorf("uidFilter(%q) = %s has %d terms, want 2", tt.uid, got, n)
+			continue
+		}
+		uid := f.Children[1]
+		if uid.Tag != ldap.FilterEqualityMatch || uid.Children[1].Data.String() != tt.uid {
+			t.Errorf("uidFilter(%q) = %s doesn't match the uid literally", tt.uid, got)
+		}
+	}
+}
+
+func TestSinceFilter(t *testing.T) {
+	tests := []struct {
+		filter, ts string
+		want       string
+	}{
+		{"(cn=crew)", "20261016141700Z", `(&(cn=crew)(modifyTimestamp>=20261016141700Z)(!(modifyTimestamp=20261016141700Z)))`},
+		{"(uid=*)", "2026*)(uid=*", `(&(uid=*)(modifyTimestamp>=2026\2a\29\28uid=\2a)(!(modifyTimestamp=2026\2a\29\28uid=\2a)))`},
+	}
+
+	for _, tt := range tests {
+		got := sinceFilter(tt.filter, tt.ts)
+		if got != tt.want {
+			t.Errorf("sinceFilter(%s, %q) = %s, want %s", tt.filter, tt.ts, got, tt.want)
+		}
+		if _, err := ldap.CompileFilter(got); err != nil {
+			t.Errorf("sinceFilter(%s, %q) = %s doesn't compile: %s", tt.filter, tt.ts, got, err)
+		}
+	}
+}
+
+func group(dn string, members ...string) *ldap.Entry {
+	return ldap.NewEntry(dn, map[string][]string{"member": members})
+}
+
+func TestGroupMembershipCheckerDiffsGroups(t *testing.T) {
+	c := groupMembershipChecker{c: make(chan event, 10), compare: DefaultCompare}
+
+	// check passes entries to c and returns the members its events add
+	// and remove
+	check := func(entries ...*ldap.Entry) (added, removed []string) {
+		t.Helper()
+
+		c.Check(&ldap.SearchResult{Entries: entries}, nil)
+		for {
+			select {
+			case e := <-c.c:
+				changes := computeChanges(e.before, e.after)
+				added = append(added, changes.added...)
+				removed = append(removed, changes.removed...)
+			default:
+				sort.Strings(added)
+				sort.Strings(removed)
+				return added, removed
+			}
+		}
+	}
+
+	tests := []struct {
+		name           string
+		entries        []*ldap.Entry
+		added, removed []string
+	}{
+		{"baseline", []*ldap.Entry{group("cn=crew", "fry")}, nil, nil},
+		{"member added", []*ldap.Entry{group("cn=crew", "fry", "leela")}, []string{"leela"}, nil},
+		{"group matched", []*ldap.Entry{group("cn=crew", "fry", "leela"), group("cn=staff", "hermes", "amy")}, []string{"amy", "hermes"}, nil},
+		{"group replaced", []*ldap.Entry{group("cn=crew", "fry", "leela"), group("cn=ship", "bender")}, []string{"bender"}, []string{"amy", "hermes"}},
+		{"group unmatched", []*ldap.Entry{group("cn=ship", "bender")}, nil, []string{"fry", "leela"}},
+		{"nothing matched", nil, nil, nil},
+		{"unchanged after nothing matched", []*ldap.Entry{group("cn=ship", "bender")}, nil, nil},
+	}
+
+	for _, tt := range tests {
+		added, removed := check(tt.entries...)
+		if !reflect.DeepEqual(added, tt.added) || !reflect.DeepEqual(removed, tt.removed) {
+			t.Errorf("%s: added %q and removed %q, want %q and %q", tt.name, added, removed, tt.added, tt.removed)
+		}
+	}
+}
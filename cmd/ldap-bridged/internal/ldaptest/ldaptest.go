@@ -0,0 +1,256 @@
+// Package ldaptest provides the directory the bridge's integration tests run
+// against: the server named by LDAP_URL or, failing that, a throwaway
+// OpenLDAP container. Tests skip when neither is available.
+package ldaptest
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"os"
+	"os/exec"
+	"regexp"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// image is the OpenLDAP image started when LDAP_URL isn't set; its
+// directory matches the bridge's default configuration.
+const (
+	image = "rroemhild/test-openldap"
+	port  = "10389/tcp"
+)
+
+// Server is a directory tests may write to.
+type Server struct {
+	Addr   string
+	BindDN string
+	BindPW string
+	BaseDN string
+}
+
+// Start returns the directory named by LDAP_URL, bound with LDAP_BIND and
+// LDAP_PASS and written under LDAP_BASE, or starts a container removed when
+// t finishes. It skips t when there's no directory to use.
+func Start(t *testing.T) *Server {
+	t.Helper()
+
+	s := &Server{
+		BindDN: getenv("LDAP_BIND", "cn=admin,dc=planetexpress,dc=com"),
+		BindPW: getenv("LDAP_PASS", "GoodNewsEveryone"),
+		BaseDN: getenv("LDAP_BASE", "dc=planetexpress,dc=com"),
+	}
+
+	if raw := os.Getenv("LDAP_URL"); raw != "" {
+		u, err := url.Parse(raw)
+		if err != nil || u.Scheme != "ldap" {
+			t.Fatalf("LDAP_URL %q: expected ldap://host:port", raw)
+		}
+		s.Addr = u.Host
+		if u.Port() == "" {
+			s.Addr = net.JoinHostPort(u.Hostname(), "389")
+		}
+	} else {
+		s.Addr = startContainer(t)
+	}
+
+	// a new container takes a few seconds to accept binds
+	deadline := time.Now().Add(time.Minute)
+	for {
+		conn, err := s.dial()
+		if err == nil {
+			conn.Close()
+			return s
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("ldap %s: %s", s.Addr, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func getenv(key, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// startContainer runs image, returning the address of its LDAP port.
+func startContainer(t *testing.T) string {
+	t.Helper()
+
+	if _, err := exec.LookPath("docker"); err != nil {
+		t.Skip("LDAP_URL isn't set and docker isn't installed")
+	}
+	if err := exec.Command("docker", "info").Run(); err != nil {
+		t.Skip("LDAP_URL isn't set and docker isn't running")
+	}
+
+	out, err := exec.Command("docker", "run", "-d", "--rm", "-p", "127.0.0.1::"+strings.TrimSuffix(port, "/tcp"), image).Output()
+	if err != nil {
+		t.Fatalf("docker run %s: %s", image, err)
+	}
+	id := strings.TrimSpace(string(out))
+	t.Cleanup(func() { exec.Command("docker", "rm", "-f", id).Run() })
+
+	out, err = exec.Command("docker", "port", id, port).Output()
+	if err != nil {
+		t.Fatalf("docker port %s: %s", port, err)
+	}
+	// one line per address family; the first is enough
+	return strings.TrimSpace(strings.SplitN(string(out), "\n", 2)[0])
+}
+
+func (s *Server) dial() (*ldap.Conn, error) {
+	conn, err := ldap.Dial("tcp", s.Addr)
+	if err != nil {
+		return nil, err
+	}
+	if err := conn.Bind(s.BindDN, s.BindPW); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// Dial returns a bound connection closed when t finishes.
+func (s *Server) Dial(t *testing.T) *ldap.Conn {
+	t.Helper()
+
+	conn, err := s.dial()
+	if err != nil {
+		t.Fatalf("ldap %s: %s", s.Addr, err)
+	}
+	t.Cleanup(conn.Close)
+	return conn
+}
+
+var unsafeRDN = regexp.MustCompile(`[^A-Za-z0-9-]+`)
+
+// NewOU creates an organizational unit for t's entries under BaseDN, named
+// for t so that tests sharing a directory don't collide, and deletes it and
+// everything in it when t finishes.
+func (s *Server) NewOU(t *testing.T) string {
+	t.Helper()
+
+	conn := s.Dial(t)
+	name := fmt.Sprintf("%s-%d", unsafeRDN.ReplaceAllString(t.Name(), "-"), time.Now().UnixNano())
+	dn := fmt.Sprintf("ou=%s,%s", name, s.BaseDN)
+
+	req := ldap.NewAddRequest(dn)
+	req.Attribute("objectClass", []string{"organizationalUnit"})
+	req.Attribute("ou", []string{name})
+	if err := conn.Add(req); err != nil {
+		t.Fatalf("add %s: %s", dn, err)
+	}
+
+	t.Cleanup(func() {
+		res, err := conn.Search(ldap.NewSearchRequest(
+			dn,
+			ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+			"(objectClass=*)",
+			[]string{"dn"},
+			nil,
+		))
+		if err != nil {
+			t.Logf("clean up %s: %s", dn, err)
+			return
+		}
+
+		// children before their parents
+		dns := make([]string, 0, len(res.Entries))
+		for _, entry := range res.Entries {
+			dns = append(dns, entry.DN)
+		}
+		sort.Slice(dns, func(i, j int) bool { return len(dns[i]) > len(dns[j]) })
+		for _, dn := range dns {
+			if err := conn.Del(ldap.NewDelRequest(dn, nil)); err != nil {
+				t.Logf("clean up %s: %s", dn, err)
+			}
+		}
+	})
+
+	return dn
+}
+
+// AddUser adds an inetOrgPerson with uid under ou, returning its DN. attrs
+// add to or replace the defaults derived from uid.
+func AddUser(t *testing.T, conn *ldap.Conn, ou, uid string, attrs map[string][]string) string {
+	t.Helper()
+
+	values := map[string][]string{
+		"objectClass": {"inetOrgPerson"},
+		"uid":         {uid},
+		"cn":          {uid},
+		"sn":          {uid},
+		"givenName":   {uid},
+		"mail":        {uid + "@planetexpress.com"},
+	}
+	for k, v := range attrs {
+		values[k] = v
+	}
+
+	dn := fmt.Sprintf("uid=%s,%s", uid, ou)
+	req := ldap.NewAddRequest(dn)
+	for k, v := range values {
+		req.Attribute(k, v)
+	}
+	if err := conn.Add(req); err != nil {
+		t.Fatalf("add %s: %s", dn, err)
+	}
+	return dn
+}
+
+// AddGroup adds a groupOfNames with cn under ou, returning its DN. The schema
+// requires at least one member.
+func AddGroup(t *testing.T, conn *ldap.Conn, ou, cn string, members ...string) string {
+	t.Helper()
+
+	dn := fmt.Sprintf("cn=%s,%s", cn, ou)
+	req := ldap.NewAddRequest(dn)
+	req.Attribute("objectClass", []string{"groupOfNames"})
+	req.Attribute("cn", []string{cn})
+	req.Attribute("member", members)
+	if err := conn.Add(req); err != nil {
+		t.Fatalf("add %s: %s", dn, err)
+	}
+	return dn
+}
+
+// AddMember adds member to group.
+func AddMember(t *testing.T, conn *ldap.Conn, group, member string) {
+	t.Helper()
+
+	req := ldap.NewModifyRequest(group)
+	req.Add("member", []string{member})
+	if err := conn.Modify(req); err != nil {
+		t.Fatalf("add %s to %s: %s", member, group, err)
+	}
+}
+
+// RemoveMember removes member from group.
+func RemoveMember(t *testing.T, conn *ldap.Conn, group, member string) {
+	t.Helper()
+
+	req := ldap.NewModifyRequest(group)
+	req.Delete("member", []string{member})
+	if err := conn.Modify(req); err != nil {
+		t.Fatalf("remove %s from %s: %s", member, group, err)
+	}
+}
+
+// Replace sets dn's attr to values.
+func Replace(t *testing.T, conn *ldap.Conn, dn, attr string, values ...string) {
+	t.Helper()
+
+	req := ldap.NewModifyRequest(dn)
+	req.Replace(attr, values)
+	if err := conn.Modify(req); err != nil {
+		t.Fatalf("set %s of %s: %s", attr, dn, err)
+	}
+}
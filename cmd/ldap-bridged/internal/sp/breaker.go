@@ -0,0 +1,120 @@
+package sp
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+)
+
+// ErrCircuitOpen is returned instead of calling the SCIM API while the
+// circuit breaker is open.
+var ErrCircuitOpen = errors.New("scim: circuit breaker open")
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half-open"
+)
+
+// breaker stops calling a failing SCIM API. After threshold consecutive
+// failures it opens and rejects calls for cooldown, then half-opens to let a
+// single probe through: success closes it again, failure reopens it.
+type breaker struct {
+	mu        sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	state     string
+	failures  int
+	openedAt  time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		state:     breakerClosed,
+	}
+}
+
+// allow reports whether a call may proceed. A nil breaker always allows.
+func (b *breaker) allow() error {
+	if b == nil {
+		return nil
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch b.state {
+	case breakerOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return ErrCircuitOpen
+		}
+		// this call is the probe; others wait for its result
+		b.state = breakerHalfOpen
+		log.Printf("scim: circuit breaker half-open, probing")
+		return nil
+	case breakerHalfOpen:
+		return ErrCircuitOpen
+	default:
+		return nil
+	}
+}
+
+// record updates the breaker with the outcome of an allowed call.
+func (b *breaker) record(failed bool) {
+	if b == nil {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if !failed {
+		if b.state != breakerClosed {
+			log.Printf("scim: circuit breaker closed")
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= b.threshold {
+		if b.state != breakerOpen {
+			log.Printf("scim: circuit breaker open after %d consecutive failures; pausing calls for %s", b.failures, b.cooldown)
+		}
+		b.state = breakerOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// State returns "closed", "open", or "half-open".
+func (b *breaker) State() string {
+	if b == nil {
+		return breakerClosed
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.state
+}
+
+// alert describes an open breaker for the health endpoint, or returns "".
+func (b *breaker) alert() string {
+	if b == nil {
+		return ""
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.state == breakerClosed {
+		return ""
+	}
+	return fmt.Sprintf("SCIM API circuit breaker %s after %d consecutive failures (since %s)",
+		b.state, b.failures, b.openedAt.Format(time.RFC3339))
+}
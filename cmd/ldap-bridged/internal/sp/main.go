@@ -2,96 +2,351 @@ package sp
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	scim "github.com/mtodd/scimtool"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"golang.org/x/oauth2/clientcredentials"
 )
 
 const defaultBaseURL = "https://api.github.com"
 
+// tracer uses the global TracerProvider, which is a no-op unless the binary
+// installs one.
+var tracer = otel.Tracer("github.com/mtodd/scimtool/cmd/ldap-bridged/internal/sp")
+
+func startSpan(ctx context.Context, name, org string) (context.Context, trace.Span) {
+	return tracer.Start(ctx, name, trace.WithAttributes(
+		attribute.String("scim.operation", name),
+		attribute.String("scim.org", org),
+	))
+}
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// ErrConflict is returned by Add when another user already has the
+// userName.
+var ErrConflict = errors.New("userName is already taken")
+
+// ErrChanged is returned by Patch when the user no longer has the version
+// given, because it changed on the SP since it was read.
+var ErrChanged = errors.New("user changed on the SP since it was read")
+
 type fakeAPIClient struct {
+	mu    sync.Mutex
 	store map[string]scim.User
+	newID idGenerator
+	// versions counts the writes, each giving the user written a new
+	// meta.version
+	versions int
+}
+
+// nextVersion returns the meta.version of the next write; c.mu is held.
+func (c *fakeAPIClient) nextVersion() string {
+	c.versions++
+	return fmt.Sprintf(`W/"%d"`, c.versions)
 }
 
-func (c *fakeAPIClient) Add(u scim.User) (string, error) {
+// idGenerator assigns the ID of a user added to the fake client.
+type idGenerator func(scim.User) string
+
+// newIDGenerator returns the generator for strategy: "hash" (default) derives
+// a stable ID from the userName, "uuid" returns a random UUID like real
+// servers, and "sequential" counts up from 1.
+func newIDGenerator(strategy string) (idGenerator, error) {
+	switch strategy {
+	case "", "hash":
+		return hashID, nil
+	case "uuid":
+		return uuidID, nil
+	case "sequential":
+		var n int64
+		return func(scim.User) string {
+			return strconv.FormatInt(atomic.AddInt64(&n, 1), 10)
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown ID strategy %q: expected hash, uuid, or sequential", strategy)
+	}
+}
+
+func hashID(u scim.User) string {
 	h := sha256.New()
 	h.Write([]byte(u.UserName))
-	guid := base64.StdEncoding.EncodeToString(h.Sum(nil))
+	return base64.StdEncoding.EncodeToString(h.Sum(nil))
+}
+
+func uuidID(scim.User) string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = (b[6] & 0x0f) | 0x40 // version 4
+	b[8] = (b[8] & 0x3f) | 0x80 // RFC 4122 variant
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+func (c *fakeAPIClient) Add(ctx context.Context, u scim.User) (string, error) {
+	// checked and stored under one lock, so concurrent adds of the same
+	// userName can't both succeed
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for _, existing := range c.store {
+		if strings.EqualFold(existing.UserName, u.UserName) {
+			return "", ErrConflict
+		}
+	}
+
+	guid := c.newID(u)
 
 	log.Printf("scim: adding %s as %s", u.UserName, guid)
 
+	// the caller keeps u, so store a copy
+	u = u.Clone()
 	u.ID = guid
+	u.Metadata.Version = c.nextVersion()
 	c.store[guid] = u
 
 	return guid, nil
 }
 
-func (c *fakeAPIClient) Del(guid string) error {
+func (c *fakeAPIClient) Del(ctx context.Context, guid string) error {
 	log.Printf("scim: removing %s", guid)
 
+	c.mu.Lock()
 	delete(c.store, guid)
+	c.mu.Unlock()
 
 	return nil
 }
 
-func (c *fakeAPIClient) List() ([]scim.User, error) {
-	list := make([]scim.User, len(c.store))
+func (c *fakeAPIClient) Patch(ctx context.Context, guid, version string, op scim.PatchOp) error {
+	log.Printf("scim: patching %s: %+v", guid, op.Operations)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	u, ok := c.store[guid]
+	if !ok {
+		return fmt.Errorf("patch %s: not found", guid)
+	}
+	if version != "" && version != u.Metadata.Version {
+		return ErrChanged
+	}
+	u.Metadata.Version = c.nextVersion()
+
+	// only active is tracked by the fake store
+	for _, o := range op.Operations {
+		if active, ok := o.Value.(bool); ok && o.Op == "replace" && o.Path == "active" {
+			u.Active = active
+		}
+	}
+	c.store[guid] = u
+
+	return nil
+}
+
+func (c *fakeAPIClient) List(ctx context.Context, opts ListOptions) ([]scim.User, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	list := make([]scim.User, 0, len(c.store))
 
 	for _, user := range c.store {
-		list = append(list, user)
+		list = append(list, user.Clone())
+	}
+
+	if opts.SortBy != "" {
+		key := sortKey(opts.SortBy)
+		descending := opts.SortOrder == "descending"
+		sort.SliceStable(list, func(i, j int) bool {
+			if descending {
+				return key(list[i]) > key(list[j])
+			}
+			return key(list[i]) < key(list[j])
+		})
 	}
 
 	return list, nil
 }
 
+// sortKey returns the value of the attribute named by a SCIM sortBy path.
+func sortKey(sortBy string) func(scim.User) string {
+	switch sortBy {
+	case "userName":
+		return func(u scim.User) string { return u.UserName }
+	case "externalId":
+		return func(u scim.User) string { return u.ExternalID }
+	case "name.givenName":
+		return func(u scim.User) string { return u.Name.GivenName }
+	case "name.familyName":
+		return func(u scim.User) string { return u.Name.FamilyName }
+	default:
+		return func(u scim.User) string { return u.ID }
+	}
+}
+
+func (c *fakeAPIClient) CountUsers(ctx context.Context, filter string) (int, error) {
+	var f *scim.Filter
+	if filter != "" {
+		var err error
+		if f, err = scim.ParseFilter(filter); err != nil {
+			return 0, err
+		}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	count := 0
+	for _, user := range c.store {
+		if f == nil || f.Match(user) {
+			count++
+		}
+	}
+	return count, nil
+}
+
 type apiClient struct {
-	client  *http.Client
-	baseURL string
-	token   string
-	org     string
-	debug   bool
+	client     *http.Client
+	baseURL    string
+	token      string
+	authMethod string
+	authHeader string
+	userAgent  string
+	org        string
+	breaker    *breaker
+	limiter    *limiter
+
+	// logBodies logs request and response bodies, scrubbed by bodyRedactor,
+	// along with their headers, without credentials.
+	logBodies    bool
+	bodyRedactor *scim.Redactor
+
+	// pageSize is the configured count of users to request per page, which
+	// pages limits to what the server returns.
+	pageSize int
+	pages    pageLimit
 }
 
-func (c *apiClient) buildRequest(method, endpoint string) (*http.Request, error) {
-	req, err := http.NewRequest(method, c.buildEndpointURL(endpoint), nil)
+func (c *apiClient) buildRequest(ctx context.Context, method, endpoint string) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.buildEndpointURL(endpoint), nil)
 
 	req.Header.Set("Accept", "application/vnd.github.cloud-9-preview+json+scim")
-	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("User-Agent", c.userAgent)
+	c.authorize(req)
 
-	if method == "POST" {
+	if method == "POST" || method == "PATCH" {
 		req.Header.Set("Content-Type", "application/json")
 	}
 
 	return req, err
 }
 
+// authorize applies the configured authentication to req.
+func (c *apiClient) authorize(req *http.Request) {
+	switch c.authMethod {
+	case "basic":
+		user, pass := c.token, ""
+		if i := strings.Index(c.token, ":"); i >= 0 {
+			user, pass = c.token[:i], c.token[i+1:]
+		}
+		req.SetBasicAuth(user, pass)
+	case "header":
+		req.Header.Set(c.authHeader, c.token)
+	case "oauth2":
+		// set by the client's OAuth2 transport
+	default:
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+}
+
 func (c *apiClient) buildEndpointURL(path string) string {
 	return fmt.Sprintf("%s%s", c.baseURL, path)
 }
 
 func (c *apiClient) do(req *http.Request) (*http.Response, error) {
-	if c.debug {
-		log.Printf("debug: %v", req)
+	trace.SpanFromContext(req.Context()).SetAttributes(attribute.String("scim.breaker", c.breaker.State()))
+	if err := c.breaker.allow(); err != nil {
+		return nil, err
+	}
+	if err := c.limiter.wait(req.Context()); err != nil {
+		return nil, err
+	}
+
+	// propagate the trace context to the SCIM server
+	otel.GetTextMapPropagator().Inject(req.Context(), propagation.HeaderCarrier(req.Header))
+
+	if c.logBodies {
+		log.Printf("debug: request: %s %s %v", req.Method, req.URL, c.redactHeaders(req.Header))
 	}
 
 	res, err := c.client.Do(req)
 
-	if c.debug && err == nil {
-		log.Printf("debug: %v", res)
+	// only outages count against the breaker, not rejected requests
+	c.breaker.record(err != nil || res.StatusCode >= 500 || res.StatusCode == http.StatusTooManyRequests)
+	if err == nil {
+		c.limiter.update(res)
+	}
+
+	if c.logBodies && err == nil {
+		log.Printf("debug: response: %s %v", res.Status, c.redactHeaders(res.Header))
 	}
 
 	return res, err
 }
 
-func (c *apiClient) Add(user scim.User) (string, error) {
-	req, err := c.buildRequest("POST", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
+// redactHeaders returns a copy of h for logging, without the values of the
+// headers that carry credentials.
+func (c *apiClient) redactHeaders(h http.Header) http.Header {
+	redacted := h.Clone()
+	for _, name := range []string{"Authorization", "Cookie", "Set-Cookie", c.authHeader} {
+		if name != "" && redacted.Get(name) != "" {
+			redacted.Set(name, "REDACTED")
+		}
+	}
+	return redacted
+}
+
+// logBody logs a request or response body, with personal data scrubbed, when
+// body logging is enabled.
+func (c *apiClient) logBody(kind string, body []byte) {
+	if c.logBodies {
+		log.Printf("debug: %s body: %s", kind, c.bodyRedactor.RedactJSON(body))
+	}
+}
+
+func (c *apiClient) Add(ctx context.Context, user scim.User) (guid string, err error) {
+	ctx, span := startSpan(ctx, "scim.Add", c.org)
+	defer func() { endSpan(span, err) }()
+
+	req, err := c.buildRequest(ctx, "POST", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
 	if err != nil {
 		return "", err
 	}
@@ -102,6 +357,7 @@ func (c *apiClient) Add(user scim.User) (string, error) {
 	}
 
 	req.Body = ioutil.NopCloser(bytes.NewBufferString(string(jsonBody)))
+	c.logBody("request", jsonBody)
 
 	res, err := c.do(req)
 	if err != nil {
@@ -114,13 +370,15 @@ func (c *apiClient) Add(user scim.User) (string, error) {
 	}
 	defer res.Body.Close()
 
+	if res.StatusCode == http.StatusConflict {
+		return "", ErrConflict
+	}
+
 	if res.StatusCode != http.StatusCreated {
 		return "", fmt.Errorf("remove failed: %v", res)
 	}
 
-	if c.debug {
-		log.Printf("debug: %v", string(body))
-	}
+	c.logBody("response", body)
 
 	if err := json.Unmarshal(body, &user); err != nil {
 		return "", err
@@ -131,8 +389,11 @@ func (c *apiClient) Add(user scim.User) (string, error) {
 	return user.ID, nil
 }
 
-func (c *apiClient) Del(guid string) error {
-	req, err := c.buildRequest("DELETE", fmt.Sprintf("/scim/v2/organizations/%s/Users/%s", c.org, guid))
+func (c *apiClient) Del(ctx context.Context, guid string) (err error) {
+	ctx, span := startSpan(ctx, "scim.Del", c.org)
+	defer func() { endSpan(span, err) }()
+
+	req, err := c.buildRequest(ctx, "DELETE", fmt.Sprintf("/scim/v2/organizations/%s/Users/%s", c.org, guid))
 	if err != nil {
 		return err
 	}
@@ -142,6 +403,14 @@ func (c *apiClient) Del(guid string) error {
 		return err
 	}
 
+	defer res.Body.Close()
+
+	// already deleted counts as success so retries are idempotent
+	if res.StatusCode == http.StatusNotFound {
+		log.Printf("%s already absent", guid)
+		return nil
+	}
+
 	if res.StatusCode != http.StatusNoContent {
 		return fmt.Errorf("remove failed: %v", res)
 	}
@@ -150,10 +419,117 @@ func (c *apiClient) Del(guid string) error {
 	return nil
 }
 
-func (c *apiClient) List() ([]scim.User, error) {
-	req, err := c.buildRequest("GET", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
+// Patch applies op to the user identified by guid. A version, the user's
+// meta.version when it was read, is sent as If-Match, and the patch is
+// refused with ErrChanged if the user changed since.
+func (c *apiClient) Patch(ctx context.Context, guid, version string, op scim.PatchOp) (err error) {
+	ctx, span := startSpan(ctx, "scim.Patch", c.org)
+	defer func() { endSpan(span, err) }()
+
+	req, err := c.buildRequest(ctx, "PATCH", fmt.Sprintf("/scim/v2/organizations/%s/Users/%s", c.org, guid))
 	if err != nil {
-		return nil, err
+		return err
+	}
+	if version != "" {
+		req.Header.Set("If-Match", version)
+	}
+
+	jsonBody, err := json.Marshal(op)
+	if err != nil {
+		return err
+	}
+
+	req.Body = ioutil.NopCloser(bytes.NewReader(jsonBody))
+	req.ContentLength = int64(len(jsonBody))
+	c.logBody("request", jsonBody)
+
+	res, err := c.do(req)
+	if err != nil {
+		return err
+	}
+
+	defer res.Body.Close()
+
+	if res.StatusCode == http.StatusPreconditionFailed {
+		return ErrChanged
+	}
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("patch failed: %v", res)
+	}
+
+	log.Printf("patched %s", guid)
+	return nil
+}
+
+// PartialListError is returned by List when a page after the first fails.
+// Users holds what was fetched before the failure, which callers must not
+// treat as the complete list.
+type PartialListError struct {
+	Users []scim.User
+	Total int
+	Err   error
+}
+
+func (e *PartialListError) Error() string {
+	return fmt.Sprintf("list: fetched %d of %d users: %s", len(e.Users), e.Total, e.Err)
+}
+
+func (e *PartialListError) Unwrap() error {
+	return e.Err
+}
+
+// List pages through every user. If a later page fails, the users fetched so
+// far are returned along with a *PartialListError.
+func (c *apiClient) List(ctx context.Context, opts ListOptions) (users []scim.User, err error) {
+	ctx, span := startSpan(ctx, "scim.List", c.org)
+	defer func() {
+		span.SetAttributes(attribute.Int("scim.user_count", len(users)))
+		endSpan(span, err)
+	}()
+
+	users = []scim.User{}
+	startIndex, total := 1, 0
+	count := c.pageCount(ctx)
+	size := count
+	for {
+		list, err := c.listPage(ctx, opts, startIndex, count)
+		if err != nil {
+			if startIndex == 1 {
+				return nil, err
+			}
+			return users, &PartialListError{Users: users, Total: total, Err: err}
+		}
+
+		users = append(users, list.Resources...)
+		total = list.TotalResults
+
+		// a server that silently caps pages keeps doing so
+		if capped := scim.CappedPageSize(count, startIndex, list); capped > 0 {
+			log.Printf("list: the server returned %d of the %d users requested per page; requesting %d from now on", capped, count, capped)
+			c.pages.lower(capped)
+			count, size = capped, capped
+		}
+
+		// some servers report a wrong totalResults, so pages are sized too
+		if size == 0 {
+			size = len(list.Resources)
+		}
+		more := scim.MorePages(startIndex, size, list)
+		startIndex += len(list.Resources)
+		if !more {
+			return users, nil
+		}
+	}
+}
+
+// listPage fetches the page of users beginning at startIndex, of count users
+// unless count is 0.
+func (c *apiClient) listPage(ctx context.Context, opts ListOptions, startIndex, count int) (scim.ListResponse, error) {
+	var list scim.ListResponse
+
+	req, err := c.buildRequest(ctx, "GET", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
+	if err != nil {
+		return list, err
 	}
 
 	// include filter query param if filter is given
@@ -163,89 +539,283 @@ func (c *apiClient) List() ([]scim.User, error) {
 	// 	req.URL.RawQuery = q.Encode()
 	// }
 
+	q := req.URL.Query()
+	if len(opts.Attributes) > 0 {
+		q.Add("attributes", strings.Join(opts.Attributes, ","))
+	}
+	if len(opts.ExcludedAttributes) > 0 {
+		q.Add("excludedAttributes", strings.Join(opts.ExcludedAttributes, ","))
+	}
+	if opts.SortBy != "" {
+		q.Add("sortBy", opts.SortBy)
+	}
+	if opts.SortOrder != "" {
+		q.Add("sortOrder", opts.SortOrder)
+	}
+	q.Add("startIndex", strconv.Itoa(startIndex))
+	if count > 0 {
+		q.Add("count", strconv.Itoa(count))
+	}
+	req.URL.RawQuery = q.Encode()
+
 	res, err := c.do(req)
 	if err != nil {
-		return nil, err
+		return list, err
 	}
 
 	body, err := ioutil.ReadAll(res.Body)
 	if err != nil {
-		return nil, err
+		return list, err
 	}
 	defer res.Body.Close()
 
 	if res.StatusCode == http.StatusBadRequest {
-		return nil, fmt.Errorf("list: bad request: %s", string(body))
+		return list, fmt.Errorf("list: bad request: %s", string(body))
 	}
 
 	if res.StatusCode == http.StatusNotFound {
-		return nil, fmt.Errorf("list: not found: %s", string(body))
+		return list, fmt.Errorf("list: not found: %s", string(body))
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return list, fmt.Errorf("list failed: %s: %s", res.Status, string(body))
+	}
+
+	c.logBody("response", body)
+
+	if err := json.Unmarshal(body, &list); err != nil {
+		return list, err
+	}
+
+	return list, nil
+}
+
+// ListOptions narrows what List returns.
+type ListOptions struct {
+	// Attributes limits the returned attributes (SCIM `attributes`).
+	Attributes []string
+	// ExcludedAttributes omits attributes (SCIM `excludedAttributes`).
+	ExcludedAttributes []string
+	// SortBy names the attribute to order results by (SCIM `sortBy`).
+	SortBy string
+	// SortOrder is "ascending" (default) or "descending" (SCIM `sortOrder`).
+	SortOrder string
+}
+
+// CountUsers returns the number of provisioned users matching filter, or of
+// all of them when filter is "". It requests count=0 so the server returns
+// only totalResults.
+func (c *apiClient) CountUsers(ctx context.Context, filter string) (count int, err error) {
+	ctx, span := startSpan(ctx, "scim.CountUsers", c.org)
+	defer func() {
+		span.SetAttributes(attribute.Int("scim.user_count", count))
+		endSpan(span, err)
+	}()
+
+	req, err := c.buildRequest(ctx, "GET", fmt.Sprintf("/scim/v2/organizations/%s/Users", c.org))
+	if err != nil {
+		return 0, err
 	}
 
-	if c.debug {
-		log.Printf("debug: %v", string(body))
+	q := req.URL.Query()
+	if filter != "" {
+		q.Add("filter", filter)
+	}
+	q.Add("count", "0")
+	req.URL.RawQuery = q.Encode()
+
+	res, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("count failed: %s: %s", res.Status, string(body))
 	}
 
 	var list scim.ListResponse
 	if err := json.Unmarshal(body, &list); err != nil {
-		return nil, err
+		return 0, err
 	}
 
-	return list.Resources, nil
+	return list.TotalResults, nil
 }
 
 type scimProvider interface {
-	Add(scim.User) (string, error)
-	Del(guid string) error
-	List() ([]scim.User, error)
+	Add(context.Context, scim.User) (string, error)
+	Del(ctx context.Context, guid string) error
+	Patch(ctx context.Context, guid, version string, op scim.PatchOp) error
+	List(context.Context, ListOptions) ([]scim.User, error)
+	CountUsers(ctx context.Context, filter string) (int, error)
+}
+
+// Provider is the service provider the bridge provisions users and team
+// memberships into. SCIMProvider is the SCIM implementation.
+type Provider interface {
+	Add(ctx context.Context, u scim.User) (string, error)
+	Del(ctx context.Context, guid string) error
+	Patch(ctx context.Context, guid, version string, op scim.PatchOp) error
+	List(ctx context.Context, opts ListOptions) ([]scim.User, error)
+	CountUsers(ctx context.Context, filter string) (int, error)
+	Team() string
+	AddTeamMember(ctx context.Context, team, login string) error
+	DelTeamMember(ctx context.Context, team, login string) error
+	BreakerAlert() string
 }
 
+var _ Provider = (*SCIMProvider)(nil)
+
 // SCIMProvider ...
 type SCIMProvider struct {
 	client *scimProvider
-	cfg    scimProviderConfig
+	team   *teamClient
+	cfg    Config
 }
 
-type scimProviderConfig struct {
-	token   string
-	baseURL string
-	org     string
-	dryRun  bool
+// Config configures a SCIMProvider.
+type Config struct {
+	Org    string
+	Token  string
+	DryRun bool
+
+	// AuthMethod selects how requests are authenticated: "bearer" (default)
+	// sends Token as a bearer token, "basic" sends Token as "user:password"
+	// via HTTP Basic auth, "header" sends Token in the AuthHeader header, and
+	// "oauth2" fetches and refreshes tokens with the OAuth2 client-credentials
+	// flow described by OAuth2.
+	AuthMethod string
+	AuthHeader string
+	OAuth2     clientcredentials.Config
+
+	// UserAgent overrides the default "scimtool/<version>" User-Agent.
+	UserAgent string
+
+	// DryRunIDs selects how the dry-run client assigns IDs; see
+	// newIDGenerator.
+	DryRunIDs string
+
+	// BreakerThreshold is the number of consecutive failed SCIM API calls
+	// (network errors, 5xx, and 429 responses) that opens the circuit
+	// breaker, after which calls fail with ErrCircuitOpen for
+	// BreakerCooldown before a single probe is let through. 0 disables the
+	// breaker.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// RateLimit is the most calls a second made to GitHub, shared by the
+	// SCIM and team membership APIs and however many workers call them. 0
+	// leaves them unpaced; either way, calls wait out the resets the server
+	// reports.
+	RateLimit float64
+
+	// PageSize is the count of users to request per page when listing,
+	// lowered to the server's limit. 0 leaves it to the server.
+	PageSize int
+
+	// LogBodies logs SCIM request and response bodies, with the fields
+	// BodyRedactor names scrubbed. Bodies are never logged otherwise.
+	LogBodies    bool
+	BodyRedactor *scim.Redactor
+
+	// Team is the slug of a GitHub team every provisioned user is also added
+	// to, using their userName as their GitHub login. TeamToken authenticates
+	// the team membership API and needs the admin:org scope; it defaults to
+	// Token.
+	Team      string
+	TeamToken string
 }
 
 // NewSCIMProvider ...
-func NewSCIMProvider(org, token string, dryRun bool) SCIMProvider {
+func NewSCIMProvider(cfg Config) (SCIMProvider, error) {
 	baseURL := os.Getenv("SCIM_BASEURL")
 	if baseURL == "" {
 		baseURL = defaultBaseURL
 	}
 
+	userAgent := cfg.UserAgent
+	if userAgent == "" {
+		userAgent = scim.UserAgent()
+	}
+
 	var client scimProvider
+	var limit *limiter
+
+	if cfg.DryRun {
+		newID, err := newIDGenerator(cfg.DryRunIDs)
+		if err != nil {
+			return SCIMProvider{}, err
+		}
 
-	if dryRun {
 		client = &fakeAPIClient{
 			store: make(map[string]scim.User),
+			newID: newID,
 		}
 	} else {
+		httpClient := &http.Client{}
+		if cfg.AuthMethod == "oauth2" {
+			// the OAuth2 transport applies and refreshes the bearer token
+			httpClient = cfg.OAuth2.Client(context.Background())
+		}
+
+		limit = newLimiter(cfg.RateLimit)
+
+		var b *breaker
+		if cfg.BreakerThreshold > 0 {
+			b = newBreaker(cfg.BreakerThreshold, cfg.BreakerCooldown)
+		}
+
 		// HTTP client
 		client = &apiClient{
-			client:  &http.Client{},
-			baseURL: baseURL,
-			token:   token,
-			org:     org,
-			debug:   true,
+			client:     httpClient,
+			baseURL:    baseURL,
+			token:      cfg.Token,
+			authMethod: cfg.AuthMethod,
+			authHeader: cfg.AuthHeader,
+			userAgent:  userAgent,
+			org:        cfg.Org,
+			breaker:    b,
+			limiter:    limit,
+			pageSize:   cfg.PageSize,
+
+			logBodies:    cfg.LogBodies,
+			bodyRedactor: cfg.BodyRedactor,
+		}
+	}
+
+	var team *teamClient
+	if !cfg.DryRun {
+		teamToken := cfg.TeamToken
+		if teamToken == "" {
+			teamToken = cfg.Token
+		}
+
+		team = &teamClient{
+			client:    &http.Client{},
+			baseURL:   baseURL,
+			token:     teamToken,
+			userAgent: userAgent,
+			org:       cfg.Org,
+			limiter:   limit,
 		}
 	}
 
 	return SCIMProvider{
 		client: &client,
-	}
+		team:   team,
+		cfg:    cfg,
+	}, nil
 }
 
 // Add ...
-func (sp *SCIMProvider) Add(u scim.User) (string, error) {
+func (sp *SCIMProvider) Add(ctx context.Context, u scim.User) (string, error) {
 	client := *sp.client
-	guid, err := client.Add(u)
+	guid, err := client.Add(ctx, u)
 	if err != nil {
 		return "", err
 	}
@@ -254,22 +824,66 @@ func (sp *SCIMProvider) Add(u scim.User) (string, error) {
 }
 
 // Del ...
-func (sp *SCIMProvider) Del(guid string) error {
+func (sp *SCIMProvider) Del(ctx context.Context, guid string) error {
 	client := *sp.client
-	if err := client.Del(guid); err != nil {
+	if err := client.Del(ctx, guid); err != nil {
 		return err
 	}
 
 	return nil
 }
 
-// List ...
-func (sp *SCIMProvider) List() ([]scim.User, error) {
+// Patch applies op to the user identified by guid.
+func (sp *SCIMProvider) Patch(ctx context.Context, guid, version string, op scim.PatchOp) error {
 	client := *sp.client
-	list, err := client.List()
-	if err != nil {
-		return nil, err
+	return client.Patch(ctx, guid, version, op)
+}
+
+// List returns every provisioned user. On a *PartialListError the users
+// fetched before the failure are returned too.
+func (sp *SCIMProvider) List(ctx context.Context, opts ListOptions) ([]scim.User, error) {
+	client := *sp.client
+	return client.List(ctx, opts)
+}
+
+// CountUsers returns the number of provisioned users matching filter, or of
+// all of them when filter is "", without listing them.
+func (sp *SCIMProvider) CountUsers(ctx context.Context, filter string) (int, error) {
+	client := *sp.client
+	return client.CountUsers(ctx, filter)
+}
+
+// BreakerAlert describes the SCIM API circuit breaker when it isn't closed,
+// or returns "".
+func (sp *SCIMProvider) BreakerAlert() string {
+	if c, ok := (*sp.client).(*apiClient); ok {
+		return c.breaker.alert()
 	}
+	return ""
+}
 
-	return list, nil
+// Team returns the slug of the GitHub team every provisioned user is added
+// to, or "" if none is configured.
+func (sp *SCIMProvider) Team() string {
+	return sp.cfg.Team
+}
+
+// AddTeamMember adds the GitHub user login to team.
+func (sp *SCIMProvider) AddTeamMember(ctx context.Context, team, login string) error {
+	if sp.team == nil {
+		log.Printf("team: adding %s to %s (dry run)", login, team)
+		return nil
+	}
+
+	return sp.team.Add(ctx, team, login)
+}
+
+// DelTeamMember removes the GitHub user login from team.
+func (sp *SCIMProvider) DelTeamMember(ctx context.Context, team, login string) error {
+	if sp.team == nil {
+		log.Printf("team: removing %s from %s (dry run)", login, team)
+		return nil
+	}
+
+	return sp.team.Del(ctx, team, login)
 }
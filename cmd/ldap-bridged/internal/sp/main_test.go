@@ -0,0 +1,484 @@
+package sp
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	scim "github.com/mtodd/scimtool"
+)
+
+func newFakeClient(t *testing.T, strategy string) *fakeAPIClient {
+	t.Helper()
+
+	newID, err := newIDGenerator(strategy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &fakeAPIClient{store: make(map[string]scim.User), newID: newID}
+}
+
+func TestFakeListReturnsStoredUsers(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient(t, "sequential")
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := c.Add(ctx, scim.User{UserName: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := c.List(ctx, ListOptions{SortBy: "userName"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 3 {
+		t.Fatalf("List returned %d users, want 3: %+v", len(list), list)
+	}
+	for i, name := range []string{"alice", "bob", "carol"} {
+		if list[i].UserName != name || list[i].ID == "" {
+			t.Errorf("List()[%d] = %+v, want %s with an ID", i, list[i], name)
+		}
+	}
+	assertNoZeroUsers(t, list)
+}
+
+func TestFakeAddConflictsConcurrently(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient(t, "sequential")
+
+	var (
+		wg        sync.WaitGroup
+		mu        sync.Mutex
+		added     int
+		conflicts int
+	)
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := c.Add(ctx, scim.User{UserName: "alice"})
+
+			mu.Lock()
+			defer mu.Unlock()
+			switch err {
+			case nil:
+				added++
+			case ErrConflict:
+				conflicts++
+			default:
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if added != 1 || conflicts != 19 {
+		t.Errorf("concurrent adds of one userName: %d added, %d conflicts; want 1 and 19", added, conflicts)
+	}
+}
+
+// assertNoZeroUsers fails t if list holds zero-value users, as a list built
+// by appending to a slice preallocated with a length rather than a capacity
+// does.
+func assertNoZeroUsers(t *testing.T, list []scim.User) {
+	t.Helper()
+
+	for i, user := range list {
+		if reflect.DeepEqual(user, scim.User{}) {
+			t.Errorf("user %d of %d is the zero value", i, len(list))
+		}
+	}
+}
+
+// scimServer serves a SCIM Users list of users for an apiClient to page
+// through, recording the query of each request.
+type scimServer struct {
+	users []scim.User
+
+	// totalResults, when set, replaces the totalResults reported for n users,
+	// like a server that gets it wrong.
+	totalResults func(n int) int
+
+	// failAt, when set, is the startIndex whose page fails with a 500.
+	failAt int
+
+	mu      sync.Mutex
+	queries []url.Values
+}
+
+func (s *scimServer) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path != "/scim/v2/organizations/org/Users" {
+		http.NotFound(w, req)
+		return
+	}
+
+	q := req.URL.Query()
+	s.mu.Lock()
+	s.queries = append(s.queries, q)
+	s.mu.Unlock()
+
+	start, _ := strconv.Atoi(q.Get("startIndex"))
+	if start < 1 {
+		start = 1
+	}
+	if start == s.failAt {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	count := len(s.users)
+	if c := q.Get("count"); c != "" {
+		count, _ = strconv.Atoi(c)
+	}
+
+	page := []scim.User{}
+	for i := start - 1; i < len(s.users) && len(page) < count; i++ {
+		page = append(page, s.users[i])
+	}
+
+	total := len(s.users)
+	if s.totalResults != nil {
+		total = s.totalResults(total)
+	}
+	json.NewEncoder(w).Encode(scim.ListResponse{
+		Schemas:      []string{"urn:ietf:params:scim:api:messages:2.0:ListResponse"},
+		TotalResults: total,
+		ItemsPerPage: len(page),
+		StartIndex:   start,
+		Resources:    page,
+	})
+}
+
+// newTestClient returns an apiClient for s that requests pageSize users per
+// page.
+func newTestClient(t *testing.T, s *scimServer, pageSize int) *apiClient {
+	t.Helper()
+
+	srv := httptest.NewServer(s)
+	t.Cleanup(srv.Close)
+
+	return &apiClient{
+		client:    srv.Client(),
+		baseURL:   srv.URL,
+		token:     "token",
+		userAgent: "scimtool-test",
+		org:       "org",
+		pageSize:  pageSize,
+	}
+}
+
+func testUsers(n int) []scim.User {
+	users := make([]scim.User, 0, n)
+	for i := 1; i <= n; i++ {
+		users = append(users, scim.User{ID: strconv.Itoa(i), UserName: "user" + strconv.Itoa(i)})
+	}
+	return users
+}
+
+func TestListReturnsEveryPage(t *testing.T) {
+	s := &scimServer{users: testUsers(5)}
+	c := newTestClient(t, s, 2)
+
+	list, err := c.List(context.Background(), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(list), ids(s.users); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() returned IDs %v, want %v", got, want)
+	}
+	assertNoZeroUsers(t, list)
+}
+
+func TestCountUsersRequestsOnlyTotalResults(t *testing.T) {
+	s := &scimServer{users: testUsers(5)}
+	c := newTestClient(t, s, 2)
+
+	count, err := c.CountUsers(context.Background(), `userName sw "user"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count != 5 {
+		t.Errorf("CountUsers() = %d, want 5", count)
+	}
+	if len(s.queries) != 1 {
+		t.Fatalf("CountUsers() made %d requests, want 1", len(s.queries))
+	}
+	if q := s.queries[0]; q.Get("count") != "0" || q.Get("filter") != `userName sw "user"` {
+		t.Errorf("CountUsers() requested %s, want count=0 and the filter", q.Encode())
+	}
+}
+
+func TestFakeCountUsersFilters(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient(t, "sequential")
+
+	for _, name := range []string{"alice", "bob", "carol"} {
+		if _, err := c.Add(ctx, scim.User{UserName: name, Active: name != "bob"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for filter, want := range map[string]int{"": 3, "active eq true": 2, `userName eq "bob"`: 1} {
+		if got, err := c.CountUsers(ctx, filter); err != nil || got != want {
+			t.Errorf("CountUsers(%q) = %d, %v; want %d", filter, got, err, want)
+		}
+	}
+	if _, err := c.CountUsers(ctx, "active eq"); err == nil {
+		t.Errorf("CountUsers(invalid filter) succeeded")
+	}
+}
+
+func TestPatchSendsVersion(t *testing.T) {
+	var ifMatch []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		ifMatch = append(ifMatch, req.Header.Get("If-Match"))
+		if v := req.Header.Get("If-Match"); v != "" && v != `W/"2"` {
+			w.WriteHeader(http.StatusPreconditionFailed)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	t.Cleanup(srv.Close)
+	c := &apiClient{client: srv.Client(), baseURL: srv.URL, token: "token", userAgent: "scimtool-test", org: "org"}
+
+	ctx := context.Background()
+	op := scim.PatchOp{Schemas: []string{scim.PatchOpSchema}, Operations: []scim.Operation{{Op: "replace", Path: "active", Value: false}}}
+	if err := c.Patch(ctx, "1", `W/"1"`, op); err != ErrChanged {
+		t.Errorf("Patch(stale version) = %v, want ErrChanged", err)
+	}
+	if err := c.Patch(ctx, "1", `W/"2"`, op); err != nil {
+		t.Errorf("Patch(current version) = %v", err)
+	}
+	if err := c.Patch(ctx, "1", "", op); err != nil {
+		t.Errorf("Patch(no version) = %v", err)
+	}
+	if want := []string{`W/"1"`, `W/"2"`, ""}; !reflect.DeepEqual(ifMatch, want) {
+		t.Errorf("Patch sent If-Match %q, want %q", ifMatch, want)
+	}
+}
+
+func TestFakePatchChecksVersion(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient(t, "sequential")
+
+	guid, err := c.Add(ctx, scim.User{UserName: "alice", Active: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	list, err := c.List(ctx, ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	read := list[0].Metadata.Version
+
+	op := scim.PatchOp{Schemas: []string{scim.PatchOpSchema}, Operations: []scim.Operation{{Op: "replace", Path: "active", Value: false}}}
+	if err := c.Patch(ctx, guid, read, op); err != nil {
+		t.Fatalf("Patch(version as read) = %v", err)
+	}
+	// the patch changed the user, so the version read before is stale
+	if err := c.Patch(ctx, guid, read, op); err != ErrChanged {
+		t.Errorf("Patch(stale version) = %v, want ErrChanged", err)
+	}
+	if err := c.Patch(ctx, guid, "", op); err != nil {
+		t.Errorf("Patch(no version) = %v", err)
+	}
+}
+
+func TestListIgnoresZeroTotalResults(t *testing.T) {
+	s := &scimServer{users: testUsers(5), totalResults: func(int) int { return 0 }}
+	c := newTestClient(t, s, 2)
+
+	list, err := c.List(context.Background(), ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := ids(list), ids(s.users); !reflect.DeepEqual(got, want) {
+		t.Errorf("List() with totalResults 0 returned IDs %v, want %v", got, want)
+	}
+}
+
+func ids(list []scim.User) []string {
+	ids := []string{}
+	for _, user := range list {
+		ids = append(ids, user.ID)
+	}
+	return ids
+}
+
+func TestListSendsSortOptions(t *testing.T) {
+	s := &scimServer{users: testUsers(3)}
+	c := newTestClient(t, s, 0)
+
+	_, err := c.List(context.Background(), ListOptions{SortBy: "name.familyName", SortOrder: "descending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.queries) == 0 {
+		t.Fatal("no list requests were made")
+	}
+	for _, q := range s.queries {
+		if got := q.Get("sortBy"); got != "name.familyName" {
+			t.Errorf("sortBy = %q, want name.familyName", got)
+		}
+		if got := q.Get("sortOrder"); got != "descending" {
+			t.Errorf("sortOrder = %q, want descending", got)
+		}
+	}
+}
+
+func TestFakeListSortsDescending(t *testing.T) {
+	ctx := context.Background()
+	c := newFakeClient(t, "hash")
+
+	for _, name := range []string{"bob", "carol", "alice"} {
+		if _, err := c.Add(ctx, scim.User{UserName: name}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	list, err := c.List(ctx, ListOptions{SortBy: "userName", SortOrder: "descending"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := []string{}
+	for _, user := range list {
+		names = append(names, user.UserName)
+	}
+	if want := []string{"carol", "bob", "alice"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("List() = %v, want %v", names, want)
+	}
+}
+
+func TestFakeIDStrategies(t *testing.T) {
+	ctx := context.Background()
+	uuidPattern := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+	// addTwice adds alice, removes her, and adds her again, returning both IDs
+	addTwice := func(t *testing.T, c *fakeAPIClient) (string, string) {
+		first, err := c.Add(ctx, scim.User{UserName: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := c.Del(ctx, first); err != nil {
+			t.Fatal(err)
+		}
+		second, err := c.Add(ctx, scim.User{UserName: "alice"})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return first, second
+	}
+
+	t.Run("hash", func(t *testing.T) {
+		first, second := addTwice(t, newFakeClient(t, "hash"))
+		if first != second {
+			t.Errorf("re-adding alice changed her ID from %s to %s", first, second)
+		}
+		if _, defaultID := addTwice(t, newFakeClient(t, "")); defaultID != first {
+			t.Errorf("the default strategy assigned %s, want the hash %s", defaultID, first)
+		}
+	})
+
+	t.Run("uuid", func(t *testing.T) {
+		first, second := addTwice(t, newFakeClient(t, "uuid"))
+		for _, id := range []string{first, second} {
+			if !uuidPattern.MatchString(id) {
+				t.Errorf("ID %q isn't a version 4 UUID", id)
+			}
+		}
+		if first == second {
+			t.Errorf("re-adding alice kept her ID %s", first)
+		}
+	})
+
+	t.Run("sequential", func(t *testing.T) {
+		first, second := addTwice(t, newFakeClient(t, "sequential"))
+		if first != "1" || second != "2" {
+			t.Errorf("IDs = %s, %s; want 1, 2", first, second)
+		}
+	})
+
+	t.Run("unknown", func(t *testing.T) {
+		if _, err := newIDGenerator("random"); err == nil {
+			t.Error("newIDGenerator(random) succeeded, want an error")
+		}
+	})
+}
+
+func TestListPartialOnMidPageFailure(t *testing.T) {
+	s := &scimServer{users: testUsers(5), failAt: 3}
+	c := newTestClient(t, s, 2)
+
+	list, err := c.List(context.Background(), ListOptions{})
+
+	var partial *PartialListError
+	if !errors.As(err, &partial) {
+		t.Fatalf("List() error = %v, want a *PartialListError", err)
+	}
+	if got, want := ids(partial.Users), []string{"1", "2"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("PartialListError.Users = %v, want %v", got, want)
+	}
+	if partial.Total != 5 {
+		t.Errorf("PartialListError.Total = %d, want 5", partial.Total)
+	}
+	if got := ids(list); !reflect.DeepEqual(got, ids(partial.Users)) {
+		t.Errorf("List() returned %v alongside the error, want %v", got, ids(partial.Users))
+	}
+}
+
+func TestListFailsOnFirstPage(t *testing.T) {
+	s := &scimServer{users: testUsers(5), failAt: 1}
+	c := newTestClient(t, s, 2)
+
+	list, err := c.List(context.Background(), ListOptions{})
+
+	var partial *PartialListError
+	if err == nil || errors.As(err, &partial) {
+		t.Errorf("List() error = %v, want a plain error", err)
+	}
+	if list != nil {
+		t.Errorf("List() = %v, want nil", list)
+	}
+}
+
+func TestLogBodiesRedactsCredentials(t *testing.T) {
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(os.Stderr) })
+
+	for _, logBodies := range []bool{false, true} {
+		buf.Reset()
+		c := newTestClient(t, &scimServer{users: testUsers(1)}, 0)
+		c.authMethod, c.authHeader, c.token = "header", "X-Api-Key", "s3cret"
+		c.logBodies = logBodies
+
+		if _, err := c.List(context.Background(), ListOptions{}); err != nil {
+			t.Fatal(err)
+		}
+
+		out := buf.String()
+		if strings.Contains(out, "s3cret") {
+			t.Errorf("logBodies %t: the token was logged: %s", logBodies, out)
+		}
+		if logged := strings.Contains(out, "debug: request: GET "); logged != logBodies {
+			t.Errorf("logBodies %t: logged the request %t: %s", logBodies, logged, out)
+		}
+		if logBodies && !strings.Contains(out, "X-Api-Key:[REDACTED]") {
+			t.Errorf("logBodies %t: the auth header isn't shown redacted: %s", logBodies, out)
+		}
+	}
+}
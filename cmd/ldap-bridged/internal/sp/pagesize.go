@@ -0,0 +1,87 @@
+package sp
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"sync"
+
+	scim "github.com/mtodd/scimtool"
+)
+
+// pageLimit is the largest page the server returns: its ServiceProviderConfig
+// filter.maxResults, read once, lowered when a page comes back capped. 0 is
+// no known limit.
+type pageLimit struct {
+	once sync.Once
+
+	mu  sync.Mutex
+	max int
+}
+
+func (p *pageLimit) get() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.max
+}
+
+// lower limits pages to n users.
+func (p *pageLimit) lower(n int) {
+	p.mu.Lock()
+	if p.max == 0 || n < p.max {
+		p.max = n
+	}
+	p.mu.Unlock()
+}
+
+// pageCount returns the count to request per page: the configured page size
+// clamped to the server's limit. The first call reads the limit from the
+// ServiceProviderConfig; servers without one are only limited once a page
+// comes back capped.
+func (c *apiClient) pageCount(ctx context.Context) int {
+	c.pages.once.Do(func() {
+		max, err := c.maxResults(ctx)
+		if err != nil {
+			log.Printf("scim: ServiceProviderConfig: %s; detecting the page size from responses", err)
+			return
+		}
+		if max > 0 {
+			c.pages.lower(max)
+		}
+	})
+
+	return scim.PageSize(c.pageSize, c.pages.get())
+}
+
+// maxResults fetches the server's filter.maxResults.
+func (c *apiClient) maxResults(ctx context.Context) (int, error) {
+	req, err := c.buildRequest(ctx, "GET", "/scim/v2/ServiceProviderConfig")
+	if err != nil {
+		return 0, err
+	}
+
+	res, err := c.do(req)
+	if err != nil {
+		return 0, err
+	}
+
+	body, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("%s", res.Status)
+	}
+
+	var config scim.ServiceProviderConfig
+	if err := json.Unmarshal(body, &config); err != nil {
+		return 0, err
+	}
+
+	return config.Filter.MaxResults, nil
+}
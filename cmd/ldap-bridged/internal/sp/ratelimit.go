@@ -0,0 +1,87 @@
+package sp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// limiter paces the calls the bridge's workers make to GitHub, which share a
+// rate limit: at most one every interval, and none before a reset the server
+// reported, with Retry-After on a 429 or once X-RateLimit-Remaining reaches
+// 0. A nil limiter never waits.
+type limiter struct {
+	mu       sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+// newLimiter returns a limiter allowing perSecond calls a second; with
+// perSecond 0 it only waits out the resets the server reports.
+func newLimiter(perSecond float64) *limiter {
+	l := &limiter{}
+	if perSecond > 0 {
+		l.interval = time.Duration(float64(time.Second) / perSecond)
+	}
+	return l
+}
+
+// wait blocks until a call may be made, or ctx is done.
+func (l *limiter) wait(ctx context.Context) error {
+	if l == nil {
+		return nil
+	}
+
+	l.mu.Lock()
+	at := l.next
+	if now := time.Now(); at.Before(now) {
+		at = now
+	}
+	l.next = at.Add(l.interval)
+	l.mu.Unlock()
+
+	d := time.Until(at)
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// update holds calls back until the reset reported by res, if any.
+func (l *limiter) update(res *http.Response) {
+	if l == nil {
+		return
+	}
+
+	var until time.Time
+	if res.StatusCode == http.StatusTooManyRequests {
+		secs, err := strconv.Atoi(res.Header.Get("Retry-After"))
+		if err != nil {
+			secs = 1
+		}
+		until = time.Now().Add(time.Duration(secs) * time.Second)
+	} else if res.Header.Get("X-RateLimit-Remaining") == "0" {
+		reset, err := strconv.ParseInt(res.Header.Get("X-RateLimit-Reset"), 10, 64)
+		if err != nil {
+			return
+		}
+		until = time.Unix(reset, 0)
+	} else {
+		return
+	}
+
+	l.mu.Lock()
+	if until.After(l.next) {
+		l.next = until
+	}
+	l.mu.Unlock()
+}
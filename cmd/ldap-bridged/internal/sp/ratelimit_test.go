@@ -0,0 +1,68 @@
+package sp
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLimiterPacesConcurrentCalls(t *testing.T) {
+	l := newLimiter(100)
+
+	start := time.Now()
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := l.wait(context.Background()); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	// the first call goes straight away, and each of the others 10ms later
+	if d := time.Since(start); d < 90*time.Millisecond {
+		t.Errorf("10 calls at 100 a second took %s, want at least 90ms", d)
+	}
+}
+
+func TestLimiterWaitsOutReportedResets(t *testing.T) {
+	reset := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	tests := []struct {
+		status int
+		header http.Header
+		want   time.Duration
+	}{
+		{http.StatusTooManyRequests, http.Header{"Retry-After": {"30"}}, 30 * time.Second},
+		{http.StatusTooManyRequests, nil, time.Second},
+		{http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"0"}, "X-Ratelimit-Reset": {reset}}, time.Minute},
+		{http.StatusOK, http.Header{"X-Ratelimit-Remaining": {"10"}}, 0},
+	}
+
+	for _, tt := range tests {
+		l := newLimiter(0)
+		l.update(&http.Response{StatusCode: tt.status, Header: tt.header})
+
+		got := time.Until(l.next)
+		if got < 0 {
+			got = 0
+		}
+		if got < tt.want-time.Second || got > tt.want {
+			t.Errorf("after %d %v, the next call waits %s, want %s", tt.status, tt.header, got, tt.want)
+		}
+	}
+
+	// a caller that gives up stops waiting
+	l := newLimiter(0)
+	l.update(&http.Response{StatusCode: http.StatusTooManyRequests, Header: http.Header{"Retry-After": {"30"}}})
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := l.wait(ctx); err != context.Canceled {
+		t.Errorf("wait() with a canceled context = %v", err)
+	}
+}
@@ -0,0 +1,92 @@
+package sp
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+)
+
+// teamClient manages membership of the org's GitHub teams through the REST
+// API, which SCIM provisioning doesn't cover.
+type teamClient struct {
+	client    *http.Client
+	baseURL   string
+	token     string
+	userAgent string
+	org       string
+	limiter   *limiter
+}
+
+func (c *teamClient) do(ctx context.Context, method, team, login string) (*http.Response, error) {
+	endpoint := fmt.Sprintf("%s/orgs/%s/teams/%s/memberships/%s", c.baseURL, c.org, team, login)
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Accept", "application/vnd.github+json")
+	req.Header.Set("User-Agent", c.userAgent)
+	req.Header.Set("Authorization", "Bearer "+c.token)
+
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	if err := c.limiter.wait(ctx); err != nil {
+		return nil, err
+	}
+	res, err := c.client.Do(req)
+	if err == nil {
+		c.limiter.update(res)
+	}
+	return res, err
+}
+
+// PUT /orgs/:org/teams/:team_slug/memberships/:username
+func (c *teamClient) Add(ctx context.Context, team, login string) (err error) {
+	ctx, span := startSpan(ctx, "team.Add", c.org)
+	defer func() { endSpan(span, err) }()
+
+	res, err := c.do(ctx, "PUT", team, login)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("team add failed: %s: %s", res.Status, string(body))
+	}
+
+	log.Printf("team: added %s to %s", login, team)
+	return nil
+}
+
+// DELETE /orgs/:org/teams/:team_slug/memberships/:username
+func (c *teamClient) Del(ctx context.Context, team, login string) (err error) {
+	ctx, span := startSpan(ctx, "team.Del", c.org)
+	defer func() { endSpan(span, err) }()
+
+	res, err := c.do(ctx, "DELETE", team, login)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	// already removed counts as success so retries are idempotent
+	if res.StatusCode == http.StatusNotFound {
+		log.Printf("team: %s already absent from %s", login, team)
+		return nil
+	}
+
+	if res.StatusCode != http.StatusNoContent {
+		body, _ := ioutil.ReadAll(res.Body)
+		return fmt.Errorf("team remove failed: %s: %s", res.Status, string(body))
+	}
+
+	log.Printf("team: removed %s from %s", login, team)
+	return nil
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// entryCache holds the LDAP entries read during a sync, keyed by DN, so a
+// member looked up more than once is only fetched once. It lives on the
+// sync's context and is dropped when the sync returns, so it never serves
+// entries older than the sync.
+type entryCache struct {
+	mu      sync.Mutex
+	entries map[string]*ldap.Entry
+	hits    int
+	fetches int
+}
+
+func newEntryCache(entries []*ldap.Entry) *entryCache {
+	c := &entryCache{entries: make(map[string]*ldap.Entry, len(entries))}
+	for _, entry := range entries {
+		c.entries[entry.DN] = entry
+	}
+	return c
+}
+
+func (c *entryCache) get(dn string) (*ldap.Entry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	entry, ok := c.entries[dn]
+	if ok {
+		c.hits++
+	}
+	return entry, ok
+}
+
+// put caches entry under dn, as well as its own DN, which the directory may
+// have spelled differently.
+func (c *entryCache) put(dn string, entry *ldap.Entry) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.fetches++
+	c.entries[dn] = entry
+	c.entries[entry.DN] = entry
+}
+
+type entryCacheKey struct{}
+
+func withEntryCache(ctx context.Context, c *entryCache) context.Context {
+	return context.WithValue(ctx, entryCacheKey{}, c)
+}
+
+// entryCacheFrom returns the entry cache of the sync running under ctx, or
+// nil.
+func entryCacheFrom(ctx context.Context) *entryCache {
+	c, _ := ctx.Value(entryCacheKey{}).(*entryCache)
+	return c
+}
+
+// fetch returns the directory entry for dn, from the sync's entry cache when
+// running under one.
+func (b *bridge) fetch(ctx context.Context, dn string) (*ldap.Entry, error) {
+	c := entryCacheFrom(ctx)
+	if c == nil {
+		return b.idp.Fetch(dn)
+	}
+
+	if entry, ok := c.get(dn); ok {
+		return entry, nil
+	}
+	entry, err := b.idp.Fetch(dn)
+	if err != nil {
+		return nil, err
+	}
+	c.put(dn, entry)
+	return entry, nil
+}
+
+// fetchUID returns the directory entries with uid, caching them for later
+// lookups by DN when running under a sync's entry cache.
+func (b *bridge) fetchUID(ctx context.Context, uid string) ([]*ldap.Entry, error) {
+	entries, err := b.idp.FetchUID(uid)
+	if err != nil {
+		return nil, err
+	}
+
+	if c := entryCacheFrom(ctx); c != nil {
+		for _, entry := range entries {
+			c.put(entry.DN, entry)
+		}
+	}
+	return entries, nil
+}
@@ -1,13 +1,23 @@
 package main
 
 import (
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
 	"os/signal"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/boltdb/bolt"
 
@@ -16,41 +26,220 @@ import (
 	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/idp"
 	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/sp"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"golang.org/x/oauth2/clientcredentials"
+
 	ldap "gopkg.in/ldap.v2"
 )
 
+// tracer uses the global TracerProvider, which stays a no-op unless
+// OTEL_EXPORTER_OTLP_ENDPOINT is set (see setupTracing).
+var tracer = otel.Tracer("github.com/mtodd/scimtool/cmd/ldap-bridged")
+
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
 type bridge struct {
-	idp   idp.LDAPProvider
-	sp    sp.SCIMProvider
-	db    *bolt.DB
-	users users.Users
+	idp    idp.Provider
+	sp     sp.Provider
+	db     *bolt.DB
+	users  users.Store
+	cfg    bridgeConfig
+	events *eventBroker
+	health *health
+	logs   *sampler
+	syncs  *reportRing
+
+	// pause toggles provisioning from the admin endpoints; paused mirrors the
+	// state owned by run for readers on other goroutines. A pause is
+	// recorded in the store, and syncOnResume is set when the bridge starts
+	// paused, so the startup sync it skipped runs on resume.
+	pause        chan bool
+	paused       int32
+	syncOnResume bool
+
+	// plan records the mutations a read-only bridge would have made; nil
+	// unless read-only.
+	plan *plan
+
+	// warm holds the store's GUID-to-DN mappings loaded by Init for the
+	// first sync, when warmup is enabled.
+	warm map[string]string
+
+	// store is the database behind users, for compaction; nil when
+	// read-only. lastActivity is when run last applied a change.
+	store        *users.Users
+	lastActivity time.Time
+	compactions  compactions
 }
 
-func newBridge(idp idp.LDAPProvider, sp sp.SCIMProvider, db *bolt.DB) bridge {
+func newBridge(idp idp.Provider, sp sp.Provider, db *bolt.DB, cfg bridgeConfig) bridge {
+	h := newHealth()
+	h.check("scim", sp.BreakerAlert)
+
+	var p *plan
+	if cfg.readOnly {
+		p = &plan{}
+		sp = readOnlyProvider{Provider: sp, plan: p}
+	}
+
 	return bridge{
-		idp: idp,
-		sp:  sp,
-		db:  db,
+		plan:   p,
+		idp:    idp,
+		sp:     sp,
+		db:     db,
+		cfg:    cfg,
+		events: newEventBroker(),
+		health: h,
+		logs:   newSampler(cfg.logSample),
+		syncs:  newReportRing(syncReports),
+		pause:  make(chan bool, pauseRequests),
+	}
+}
+
+// dbCheckSample is how many DN/GUID mappings DB_CHECK=sample checks.
+const dbCheckSample = 100
+
+// checkStore runs the integrity check chosen by DB_CHECK, so a corrupted
+// store stops the bridge before it mutates the SP based on it.
+func (b *bridge) checkStore(store *users.Users) error {
+	var sample int
+	switch b.cfg.dbCheck {
+	case "off":
+		return nil
+	case "structure":
+		sample = 0
+	case "full":
+		sample = -1
+	default:
+		sample = dbCheckSample
+	}
+
+	start := time.Now()
+	if err := store.Check(sample); err != nil {
+		return fmt.Errorf("init: the database failed its integrity check: %s; restore it from a backup, or move it aside to rebuild it from the directory and the SP", err)
 	}
+	log.Printf("init: database integrity check (%s) passed in %s", b.cfg.dbCheck, time.Since(start))
+	return nil
 }
 
 func (b *bridge) Init() error {
-	b.users = users.New(b.db)
+	store := users.New(b.db)
+	b.users = &store
+	b.store = &store
+	if b.cfg.readOnly {
+		// the active bridge owns the database; only read what it recorded
+		prepared, err := store.Prepared()
+		if err != nil {
+			return err
+		}
+		if !prepared {
+			return fmt.Errorf("read-only: the database hasn't been initialized by an active bridge")
+		}
+		b.users = readOnlyStore{&store}
+		b.store = nil
+	}
 	if err := b.users.Prepare(); err != nil {
 		return err
 	}
+	if err := b.checkStore(&store); err != nil {
+		return err
+	}
+
+	// a pause outlasts a restart, holding its queue and the startup sync;
+	// otherwise the startup sync reconciles anything queued before it
+	paused, err := b.users.GetPaused()
+	if err != nil {
+		return err
+	}
+	queued, err := b.users.Queued()
+	if err != nil {
+		return err
+	}
+	if paused {
+		atomic.StoreInt32(&b.paused, 1)
+		b.syncOnResume = true
+		log.Printf("init: paused before the restart; holding %d queued changes and the startup sync until resumed", len(queued))
+	} else if len(queued) > 0 {
+		log.Printf("init: discarding %d changes queued while paused", len(queued))
+		if err := b.users.ClearQueue(); err != nil {
+			return err
+		}
+	}
+
+	if b.cfg.warmup {
+		start := time.Now()
+		if b.warm, err = b.users.GetMappings(); err != nil {
+			return err
+		}
+		log.Printf("init: warmed %d mappings in %s", len(b.warm), time.Since(start))
+	}
 
 	return nil
 }
 
 // Sync ensures the bridge and SP are up-to-date based on the IdP.
-func (b *bridge) Sync() error {
-	// fetch current SP list
-	spList, err := b.sp.List()
-	if err != nil {
+func (b *bridge) Sync() (err error) {
+	ctx, span := tracer.Start(context.Background(), "bridge.Sync")
+	defer func() { endSpan(span, err) }()
+	ctx = withTrigger(ctx, "sync")
+
+	report := &syncReport{Started: time.Now()}
+	ctx = withReport(ctx, report)
+	defer func() {
+		report.finish(err)
+		b.syncs.add(report)
+	}()
+
+	// the warmed mappings only serve the first sync
+	warm := b.warm
+	b.warm = nil
+
+	// after the first sync, an incremental sync reconciles only what changed
+	if b.cfg.incremental {
+		watermark, err := b.users.GetWatermark()
+		if err != nil {
+			return err
+		}
+		if watermark != "" {
+			return b.syncSince(ctx, watermark)
+		}
+	}
+
+	// fetch current SP list, limited to the attributes reconciliation needs
+	// a partial list is reconciled as far as it goes, but users missing from
+	// it can't be told apart from users that were never provisioned
+	spList, err := b.sp.List(ctx, sp.ListOptions{
+		Attributes: []string{"id", "userName", "externalId", "active"},
+	})
+	var partial *sp.PartialListError
+	if errors.As(err, &partial) {
+		log.Printf("sync: %s; skipping removals and re-adds", partial)
+	} else if err != nil {
 		return err
 	}
-	spDns := make([]string, len(spList))
+	spDns := make(dnSet, len(spList))
+	cache := newSPCache(spList)
+
+	if warm != nil && partial == nil {
+		checkWarmup(warm, cache)
+	}
+	getDN := b.users.GetDN
+	if warm != nil {
+		getDN = func(guid string) (string, bool, error) {
+			dn, ok := warm[guid]
+			return dn, ok, nil
+		}
+	}
 	log.Printf("Init: sp list: %+v", spList)
 
 	// fetch LDAP list
@@ -58,61 +247,324 @@ func (b *bridge) Sync() error {
 	if err != nil {
 		return err
 	}
-	group := idpRes.Entries[0]
-	if group == nil {
-		return fmt.Errorf("LDAP search failed to find group")
+	if len(idpRes.Entries) == 0 {
+		return fmt.Errorf("LDAP search failed to find group (or, with LDAP_USER_FILTER, any users)")
 	}
-	memberDns := group.GetAttributeValues("member")
+	groups := idpRes.Entries
+	memberDns := groupMembers(groups)
+	members := newDNSet(memberDns)
+	report.LDAPMembers = len(memberDns)
+	report.SPBefore = len(spList)
+	span.SetAttributes(
+		attribute.Int("sync.sp_user_count", len(spList)),
+		attribute.Int("sync.member_count", len(memberDns)),
+	)
 	log.Printf("Init: idp res: %+v", idpRes)
 	idpRes.PrettyPrint(2)
 
+	// members' entries are read at most once per sync; a user search reads
+	// them all up front
+	prefetched, err := b.idp.Users()
+	if err != nil {
+		return err
+	}
+	entries := newEntryCache(prefetched)
+	ctx = withEntryCache(ctx, entries)
+	defer func() {
+		log.Printf("sync: ldap entries: %d prefetched, %d fetched, %d lookups cached", len(prefetched), entries.fetches, entries.hits)
+	}()
+
+	// on the first sync every member is missing from the SP; adding them is
+	// provisioning, not drift
+	known, err := b.users.GetMemberDNs()
+	if err != nil {
+		return err
+	}
+	detectDrift := len(known) > 0
+
 	// update bridge store to reflect what's in the SP
+	var removals []string
 	for _, spUser := range spList {
-		dn, err := b.users.GetDN(spUser.ID)
+		dn, known, err := getDN(spUser.ID)
 		if err != nil {
 			return err
-		} else if dn == "" {
+		} else if !known {
 			// we don't know about this GUID yet
-			idpRes, err := b.idp.FetchUID(spUser.UserName)
+			idpRes, err := b.fetchUID(ctx, spUser.UserName)
 			if err != nil {
 				return err
 			}
+			if len(idpRes) == 0 {
+				// not the bridge's to remove: it may have been provisioned
+				// some other way
+				log.Printf("sync: %s (%s) is on the SP but has no directory entry; leaving it", spUser.UserName, spUser.ID)
+				continue
+			}
 			idpUser := idpRes[0]
-			if idpUser == nil {
-				// probably should clear this entry from the SP
+			// the SP list is partial, so store the IdP's view of the user
+			user, err := b.mapEntry(idpUser)
+			if err != nil {
+				return err
 			}
-			b.users.Add(idpUser.DN, spUser)
-		} else if !isMember(memberDns, dn) {
-			b.Del(dn)
+			user.ID = spUser.ID
+			b.users.Add(idpUser.DN, user)
+		} else if !members.has(dn) {
+			removals = append(removals, dn)
 		} else {
-			spDns = append(spDns, dn)
+			spDns[dn] = struct{}{}
+			if err := b.cancelDeprovision(dn); err != nil {
+				log.Printf("sync: %s", err)
+			}
+			if err := b.syncTeams(ctx, dn, spUser.UserName, b.teamsFor(groups, dn)); err != nil {
+				log.Printf("sync: %s", err)
+			}
+			if err := b.syncActive(ctx, dn, spUser.Active); err != nil {
+				log.Printf("sync: %s", err)
+			}
 		}
 	}
 
-	// update the SP with what's in the IdP
-	for _, memberDn := range memberDns {
-		guid, err := b.users.GetGUID(memberDn)
-		if err != nil {
+	if !b.cfg.prune {
+		for _, dn := range removals {
+			log.Printf("sync: would remove %s (pruning disabled)", dn)
+		}
+		report.skip(len(removals))
+		removals = nil
+	}
+
+	// a partial list understates the provisioned users, so it mustn't count
+	// towards the removal limits or the removals awaiting confirmation
+	proceed := partial == nil
+	if proceed {
+		if proceed, err = b.confirmRemovals(removals, len(spList)); err != nil {
 			return err
-		} else if guid == "" {
-			// if we don't know about this DN already, it's not on the SP
-			b.Add(memberDn)
-		} else if !isMember(spDns, memberDn) {
-			entry, err := b.idp.Fetch(memberDn)
-			if err != nil {
+		}
+	}
+	removeFailed := 0
+	if proceed {
+		for _, dn := range removals {
+			if err := b.deprovision(ctx, dn); err != nil {
+				log.Printf("sync: remove %s: %s", dn, err)
+				removeFailed++
+			}
+		}
+	} else {
+		report.skip(len(removals))
+	}
+
+	// update the SP with what's in the IdP, provisioning members concurrently
+	work := make(chan string)
+	errs := make(chan error, len(memberDns))
+
+	var wg sync.WaitGroup
+	for i := 0; i < b.cfg.concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for memberDn := range work {
+				if err := b.syncMember(ctx, memberDn, spDns, cache, partial == nil, detectDrift); err != nil {
+					errs <- err
+				}
+			}
+		}()
+	}
+
+	for _, memberDn := range memberDns {
+		work <- memberDn
+	}
+	close(work)
+	wg.Wait()
+	close(errs)
+
+	failed := 0
+	for err := range errs {
+		log.Printf("sync: %s", err)
+		failed++
+	}
+	if failed > 0 {
+		return fmt.Errorf("sync: %d of %d members failed", failed, len(memberDns))
+	}
+	if removeFailed > 0 {
+		return fmt.Errorf("sync: %d of %d removals failed", removeFailed, len(removals))
+	}
+
+	if partial != nil {
+		return fmt.Errorf("sync: incomplete: %s", partial)
+	}
+
+	if b.cfg.incremental {
+		// the watermark is the most recent change to any watched group;
+		// the members were read since
+		if ts := latest("", groups); ts != "" {
+			if err := b.users.SetWatermark(ts); err != nil {
 				return err
 			}
-			user, err := b.mapEntry(entry)
-			if err != nil {
+		}
+	}
+
+	return nil
+}
+
+// warmupSample is how many warmed mappings are checked against the SP.
+const warmupSample = 100
+
+// checkWarmup logs drift between a sample of the warmed mappings and the SP,
+// i.e. mapped GUIDs the SP no longer has. Map iteration order is random, so
+// each check samples different mappings.
+func checkWarmup(warm map[string]string, cache *spCache) {
+	sampled, missing := 0, 0
+	for guid := range warm {
+		if sampled == warmupSample {
+			break
+		}
+		sampled++
+		if _, ok := cache.byID[guid]; !ok {
+			missing++
+		}
+	}
+
+	if missing > 0 {
+		log.Printf("sync: warmup: %d of %d sampled mappings are missing from the SP; they'll be re-added or removed", missing, sampled)
+	}
+}
+
+// syncReports is how many sync reports /_debug keeps.
+const syncReports = 10
+
+// confirmRemovals reports whether a sync may remove the given DNs out of the
+// provisioned users. An empty or truncated directory read would otherwise
+// deprovision everyone, so removals exceeding the configured limits are held
+// back until forced or computed identically by a second sync.
+func (b *bridge) confirmRemovals(removals []string, provisioned int) (bool, error) {
+	n := len(removals)
+	exceeded := (b.cfg.maxRemovals > 0 && n > b.cfg.maxRemovals) ||
+		(b.cfg.maxRemovalPercent > 0 && n*100 > b.cfg.maxRemovalPercent*provisioned)
+	if !exceeded {
+		return true, nil
+	}
+
+	sort.Strings(removals)
+	pending, err := b.users.GetPendingRemovals()
+	if err != nil {
+		return false, err
+	}
+
+	if b.cfg.force || equalStrings(pending, removals) {
+		log.Printf("sync: removing %d of %d provisioned users (confirmed)", n, provisioned)
+		b.health.set("sync", "")
+		return true, b.users.SetPendingRemovals(nil)
+	}
+
+	if err := b.users.SetPendingRemovals(removals); err != nil {
+		return false, err
+	}
+
+	alert := fmt.Sprintf("refusing to remove %d of %d provisioned users; sync again or restart with -force to proceed", n, provisioned)
+	log.Printf("CRITICAL: sync: %s", alert)
+	b.health.set("sync", alert)
+	return false, nil
+}
+
+func equalStrings(a, b []string) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// syncMember ensures a single IdP member is provisioned on the SP. Known
+// members missing from spDns are only re-added when spComplete, and are
+// re-linked instead when the cache shows they're provisioned under another
+// ID. Re-adds, and adds when detectDrift, are reported as drift.
+func (b *bridge) syncMember(ctx context.Context, memberDn string, spDns dnSet, cache *spCache, spComplete, detectDrift bool) error {
+	guid, found, err := b.users.GetGUID(memberDn)
+	if err != nil {
+		return err
+	} else if !found {
+		// if we don't know about this DN already, it's not on the SP
+		if err := b.Add(ctx, memberDn); err != nil || !detectDrift {
+			return err
+		}
+		// Add skips some members, e.g. disabled ones
+		if guid, found, err = b.users.GetGUID(memberDn); err != nil {
+			return err
+		} else if found {
+			b.driftCorrected(ctx, memberDn, guid, "added a member who wasn't provisioned")
+		}
+	} else if spComplete && !spDns.has(memberDn) {
+		entry, err := b.fetch(ctx, memberDn)
+		if err != nil {
+			return err
+		}
+		if b.skipDisabled(entry) {
+			return nil
+		}
+		user, err := b.mapEntry(entry)
+		if err != nil {
+			return err
+		}
+		if found, ok := cache.lookup(user); ok {
+			log.Printf("sync: %s is provisioned as %s, not %s; updating the bridge store", memberDn, found.ID, guid)
+			if err := b.users.Del(guid, memberDn); err != nil {
 				return err
 			}
-			b.sp.Add(user)
+			user.ID = found.ID
+			return b.users.Add(memberDn, user)
+		}
+		id, err := b.sp.Add(ctx, user)
+		if err != nil {
+			return fmt.Errorf("add %s: %s", memberDn, err)
+		}
+		b.driftCorrected(ctx, memberDn, id, "re-added a provisioned member missing from the SP")
+
+		// the SP assigned the re-added user a new ID
+		if err := b.users.Del(guid, memberDn); err != nil {
+			return err
 		}
+		user.ID = id
+		return b.users.Add(memberDn, user)
 	}
 
 	return nil
 }
 
+// groupMembers returns the union of the members of groups.
+func groupMembers(groups []*ldap.Entry) []string {
+	members := []string{}
+	seen := make(map[string]bool)
+	for _, group := range groups {
+		for _, dn := range group.GetAttributeValues("member") {
+			if !seen[dn] {
+				seen[dn] = true
+				members = append(members, dn)
+			}
+		}
+	}
+	return members
+}
+
+// dnSet is a set of DNs for constant-time membership checks while
+// reconciling large groups.
+type dnSet map[string]struct{}
+
+func newDNSet(dns []string) dnSet {
+	s := make(dnSet, len(dns))
+	for _, dn := range dns {
+		s[dn] = struct{}{}
+	}
+	return s
+}
+
+func (s dnSet) has(dn string) bool {
+	_, ok := s[dn]
+	return ok
+}
+
 func isMember(list []string, candidate string) bool {
 	for _, v := range list {
 		if v == candidate {
@@ -129,173 +581,1248 @@ func (b *bridge) Start() {
 }
 
 func (b *bridge) run() {
+	added, removed := b.idp.Changes()
+	disabled, enabled := b.idp.StatusChanges()
+
+	// scheduled compaction runs here, between changes
+	var compact <-chan time.Time
+	var compactTimer *time.Timer
+	if b.cfg.compactInterval > 0 && b.store != nil {
+		compactTimer = time.NewTimer(b.cfg.compactInterval)
+		compact = compactTimer.C
+	}
+
+	// pending deprovisions are only removed once their deadline passes
+	var expire <-chan time.Time
+	if b.cfg.deprovisionGrace > 0 {
+		expireTicker := time.NewTicker(deprovisionCheck)
+		defer expireTicker.Stop()
+		expire = expireTicker.C
+	}
+
+	// the audit log is pruned here too, so a prune never overlaps a
+	// compaction
+	var prune <-chan time.Time
+	if b.cfg.auditTTL > 0 {
+		b.pruneAudit()
+		pruneTicker := time.NewTicker(auditPrune)
+		defer pruneTicker.Stop()
+		prune = pruneTicker.C
+	}
+
 	for {
 		select {
-		case dn := <-b.idp.Added:
-			b.Add(dn)
-		case dn := <-b.idp.Removed:
-			b.Del(dn)
+		case dn := <-added:
+			b.apply(withTrigger(context.Background(), "watch"), "add", dn)
+		case dn := <-removed:
+			b.apply(withTrigger(context.Background(), "watch"), "remove", dn)
+		case dn := <-disabled:
+			b.apply(withTrigger(context.Background(), "watch"), "disable", dn)
+		case dn := <-enabled:
+			b.apply(withTrigger(context.Background(), "watch"), "enable", dn)
+		case paused := <-b.pause:
+			b.setPaused(paused)
+		case <-compact:
+			compactTimer.Reset(b.compact())
+		case <-expire:
+			if !b.isPaused() {
+				b.expireDeprovisions(withTrigger(context.Background(), "grace"))
+			}
+		case <-prune:
+			b.pruneAudit()
 		}
 	}
 }
 
-func (b *bridge) Add(dn string) {
-	log.Printf("add: %s", dn)
+// apply provisions a detected change, or queues it while paused.
+func (b *bridge) apply(ctx context.Context, action, dn string) {
+	b.lastActivity = time.Now()
 
-	// fetch LDAP User
-	entry, err := b.idp.Fetch(dn)
-	if err != nil {
-		log.Printf("add: IdP fetch(%s): %s", dn, err)
+	if b.isPaused() {
+		log.Printf("paused: queueing %s %s", action, dn)
+		if err := b.users.Enqueue(action, dn); err != nil {
+			log.Printf("paused: queue %s %s: %s", action, dn, err)
+		}
 		return
 	}
-	entry.PrettyPrint(2)
-	// log.Printf("%+v", entry)
 
-	// build SCIM User representation (map LDAP to SCIM attributes)
-	user, _ := b.mapEntry(entry)
-	log.Printf("%+v", user)
+	var err error
+	switch action {
+	case "add":
+		err = b.added(ctx, dn)
+	case "remove":
+		err = b.removed(ctx, dn)
+	case "disable":
+		err = b.statusChanged(ctx, dn, false)
+	case "enable":
+		err = b.statusChanged(ctx, dn, true)
+	}
+	if err != nil {
+		log.Printf("%s: %s", action, err)
+	}
+}
 
-	// write to SCIM
-	guid, err := b.sp.Add(user)
+// added handles dn joining a watched group. A DN that's already provisioned
+// through another group only has its team memberships updated.
+func (b *bridge) added(ctx context.Context, dn string) error {
+	_, found, err := b.users.GetGUID(dn)
 	if err != nil {
-		log.Printf("add: scim failed: %s", err)
-		return
+		return err
+	}
+	if !found {
+		return b.Add(ctx, dn)
+	}
+	if err := b.cancelDeprovision(dn); err != nil {
+		return err
 	}
 
-	// receive GUID
-	user.ID = guid
+	return b.reconcileTeams(ctx, dn)
+}
 
-	// persist membership
-	// persist DN-to-GUID mapping
-	// persist GUID-to-DN mapping
-	if err = b.users.Add(dn, user); err != nil {
-		log.Printf("add: bridge store failed: %s", err)
-		return
+// removed handles dn leaving a watched group. The user keeps their org
+// membership while they remain in any other watched group.
+func (b *bridge) removed(ctx context.Context, dn string) error {
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		return err
+	}
+	if !isMember(groupMembers(res.Entries), dn) {
+		return b.deprovision(ctx, dn)
 	}
 
-	log.Printf("add: %s added", dn)
+	log.Printf("remove: %s is still in a watched group; keeping it", dn)
+	return b.reconcileTeams(ctx, dn)
 }
 
-func (b *bridge) Del(dn string) {
-	log.Printf("remove: %s", dn)
+func (b *bridge) isPaused() bool {
+	return atomic.LoadInt32(&b.paused) == 1
+}
 
-	guid, err := b.users.GetGUID(dn)
-	if err != nil {
-		log.Printf("remove: get guid(%s): %s", dn, err)
+// setPaused holds or resumes provisioning. Resuming applies the changes
+// queued in the meantime, in the order they were detected.
+func (b *bridge) setPaused(paused bool) {
+	if paused == b.isPaused() {
 		return
 	}
 
-	if err := b.sp.Del(guid); err != nil {
-		log.Printf("remove: %s failed: %s", guid, err)
-		return
+	if err := b.users.SetPaused(paused); err != nil {
+		log.Printf("paused: %s", err)
 	}
 
-	if err = b.users.Del(guid, dn); err != nil {
-		log.Printf("remove: bridge store failed: %s", err)
+	if paused {
+		atomic.StoreInt32(&b.paused, 1)
+		log.Printf("paused: holding provisioning")
 		return
 	}
-}
-
-// mapEntry takes an LDAP entry, maps to a SCIM user representation
-func (b *bridge) mapEntry(entry *ldap.Entry) (scim.User, error) {
-	user := scim.User{
-		Schemas:  []string{scim.UserSchema},
-		UserName: entry.GetAttributeValue("uid"),
-		Name: scim.Name{
-			GivenName:  entry.GetAttributeValue("givenName"),
-			FamilyName: entry.GetAttributeValue("sn"),
-		},
-		Emails: []scim.Email{{
-			Type:    "work",
-			Value:   entry.GetAttributeValue("mail"),
-			Primary: true,
-		}},
-		Active: true,
-	}
 
-	return user, nil
-}
+	atomic.StoreInt32(&b.paused, 0)
 
-func (b *bridge) startHTTP() {
-	mux := http.NewServeMux()
-	mux.Handle("/_debug", b)
-	l, _ := net.Listen("tcp", ":4444")
-	defer l.Close()
-	srv := http.Server{
-		Handler: mux,
+	// the startup sync skipped while paused covers the queue too
+	if b.syncOnResume {
+		b.syncOnResume = false
+		if err := b.users.ClearQueue(); err != nil {
+			log.Printf("resume: %s", err)
+		}
+		log.Printf("resume: running the startup sync")
+		if err := b.Sync(); err != nil {
+			log.Printf("resume: sync: %s", err)
+		}
+		return
 	}
-	log.Println("listening for web on :4444")
-	srv.Serve(l)
-}
-
-func (b *bridge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
-	log.Println("HTTP debug request")
 
-	list, err := b.users.List()
+	queued, err := b.users.Queued()
 	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "oops: %s", err)
+		log.Printf("resume: %s", err)
+		return
 	}
 
-	buf, err := json.Marshal(list)
-	if err != nil {
-		w.WriteHeader(500)
-		fmt.Fprintf(w, "oops: %s", err)
+	log.Printf("resume: applying %d queued changes", len(queued))
+	ctx := withTrigger(context.Background(), "resume")
+	for _, c := range queued {
+		b.apply(ctx, c.Action, c.DN)
+		if err := b.users.Dequeue(c.Seq); err != nil {
+			log.Printf("resume: dequeue %s %s: %s", c.Action, c.DN, err)
+		}
 	}
-	fmt.Fprintf(w, "%s", buf)
 }
 
-type ldapConfig struct {
-	addr   string
-	bindDn string
-	bindPw string
-	baseDn string
-	group  string
-}
+// pauseRequests is how many pause and resume requests may wait for the run
+// loop to finish the change or sync it's applying.
+const pauseRequests = 8
 
-type scimConfig struct {
-	org    string
-	token  string
-	dryRun bool
-}
+// pauseHandler pauses (POST /pause) or resumes (POST /resume) provisioning.
+// The request is handed to the run loop without waiting for it, so it takes
+// effect once the change in progress is applied.
+func (b *bridge) pauseHandler(paused bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
 
-type config struct {
-	ldap   ldapConfig
-	scim   scimConfig
-	dbPath string
+		select {
+		case b.pause <- paused:
+			w.WriteHeader(http.StatusAccepted)
+		default:
+			httpError(w, http.StatusServiceUnavailable, fmt.Errorf("%d pause and resume requests are already waiting", pauseRequests))
+		}
+	}
 }
 
-func loadConfig() config {
-	c := config{
-		ldap: ldapConfig{
-			addr:   "localhost:389",
-			bindDn: "cn=admin,dc=planetexpress,dc=com",
-			bindPw: "GoodNewsEveryone",
-			baseDn: "ou=people,dc=planetexpress,dc=com",
-			group:  "idptool",
-		},
-		scim: scimConfig{
-			org:    "idptool",
-			dryRun: true,
-		},
-		dbPath: "bridge.db",
+func (b *bridge) Add(ctx context.Context, dn string) (err error) {
+	ctx, span := tracer.Start(ctx, "bridge.Add", trace.WithAttributes(attribute.String("ldap.dn", dn)))
+	defer func() { endSpan(span, err) }()
+
+	var guid string
+	defer func() { b.publish(ctx, "add", dn, guid, nil, err) }()
+
+	verbose := b.logs.sample()
+	if verbose {
+		log.Printf("add: %s", dn)
 	}
 
-	if addr := os.Getenv("LDAP_ADDR"); addr != "" {
-		c.ldap.addr = addr
+	if suppress, err := b.tombstoned(dn); err != nil {
+		log.Printf("add: tombstone(%s): %s", dn, err)
+		return err
+	} else if suppress {
+		log.Printf("add: %s was removed recently and isn't confirmed as a member; skipping", dn)
+		return nil
 	}
-	if bindDn := os.Getenv("LDAP_BIND"); bindDn != "" {
-		c.ldap.bindDn = bindDn
+
+	// fetch LDAP User
+	entry, err := b.fetch(ctx, dn)
+	if err != nil {
+		log.Printf("add: IdP fetch(%s): %s", dn, err)
+		return err
+	}
+	if verbose {
+		entry.PrettyPrint(2)
+	}
+	if b.skipDisabled(entry) {
+		log.Printf("add: %s is disabled; skipping", dn)
+		return nil
+	}
+	// log.Printf("%+v", entry)
+
+	// build SCIM User representation (map LDAP to SCIM attributes)
+	user, err := b.mapEntry(entry)
+	if err != nil {
+		log.Printf("add: map(%s): %s", dn, err)
+		return err
+	}
+	if verbose {
+		log.Printf("%+v", user)
+	}
+
+	// write to SCIM
+	guid, err = b.sp.Add(ctx, user)
+	if err == sp.ErrConflict {
+		user, guid, err = b.resolveCollision(ctx, dn, user)
+	}
+	if err != nil {
+		log.Printf("add: %s: scim failed: %s", dn, err)
+		return err
+	}
+
+	// receive GUID, on a copy so the user sent to the SP isn't modified
+	user = user.Clone()
+	user.ID = guid
+
+	// persist membership
+	// persist DN-to-GUID mapping
+	// persist GUID-to-DN mapping
+	if err = b.users.Add(dn, user); err != nil {
+		log.Printf("add: bridge store failed: %s", err)
+		return err
+	}
+	if err = b.users.DelTombstone(dn); err != nil {
+		log.Printf("add: clear tombstone(%s): %s", dn, err)
+		return err
+	}
+
+	// the user is provisioned whether or not its teams are; failing to add
+	// them is reported on its own, so the add isn't retried
+	if b.teamsEnabled() {
+		if err := b.addTeams(ctx, dn, user.UserName); err != nil {
+			log.Printf("add: %s is provisioned, but its teams aren't: %s", dn, err)
+			b.publish(ctx, "team", dn, guid, nil, err)
+		}
+	}
+
+	if verbose {
+		log.Printf("add: %s added", dn)
+	}
+	return nil
+}
+
+func (b *bridge) Del(ctx context.Context, dn string) (err error) {
+	ctx, span := tracer.Start(ctx, "bridge.Del", trace.WithAttributes(attribute.String("ldap.dn", dn)))
+	defer func() { endSpan(span, err) }()
+
+	var guid string
+	defer func() { b.publish(ctx, "remove", dn, guid, nil, err) }()
+
+	if b.logs.sample() {
+		log.Printf("remove: %s", dn)
+	}
+
+	var found bool
+	guid, found, err = b.users.GetGUID(dn)
+	if err != nil {
+		log.Printf("remove: get guid(%s): %s", dn, err)
+		return err
+	}
+	if !found {
+		log.Printf("remove: %s isn't provisioned; nothing to remove", dn)
+		return nil
+	}
+
+	if err := b.sp.Del(ctx, guid); err != nil {
+		log.Printf("remove: %s failed: %s", guid, err)
+		return err
+	}
+
+	// team memberships go with the org membership, so failing to remove
+	// them mustn't hold up the deprovisioning; they're forgotten either way
+	if err := b.syncTeams(ctx, dn, "", nil); err != nil {
+		log.Printf("remove: %s is deprovisioned, but its teams weren't removed: %s", dn, err)
+		b.publish(ctx, "team", dn, guid, nil, err)
+		b.forgetTeams(dn)
+	}
+
+	if err = b.users.Del(guid, dn); err != nil {
+		log.Printf("remove: bridge store failed: %s", err)
+		return err
+	}
+	if err = b.users.DelPendingDeprovision(dn); err != nil {
+		log.Printf("remove: clear pending deprovision(%s): %s", dn, err)
+		return err
+	}
+
+	if b.cfg.tombstoneGrace > 0 {
+		if err = b.users.SetTombstone(dn, time.Now()); err != nil {
+			log.Printf("remove: tombstone(%s): %s", dn, err)
+			return err
+		}
+	}
+
+	return nil
+}
+
+// SetActive activates or deactivates the provisioned user for dn. DNs that
+// aren't provisioned are ignored.
+func (b *bridge) SetActive(ctx context.Context, dn string, active bool) (err error) {
+	ctx, span := tracer.Start(ctx, "bridge.SetActive", trace.WithAttributes(attribute.String("ldap.dn", dn)))
+	defer func() { endSpan(span, err) }()
+
+	guid, found, err := b.users.GetGUID(dn)
+	if err != nil || !found {
+		return err
+	}
+
+	action := "enable"
+	if !active {
+		action = "disable"
+	}
+	changes := []scim.AttributeChange{{Path: "active", Old: !active, New: active}}
+	defer func() { b.publish(ctx, action, dn, guid, changes, err) }()
+
+	log.Printf("%s: %s", action, dn)
+
+	err = b.sp.Patch(ctx, guid, "", scim.PatchOp{
+		Schemas:    []string{scim.PatchOpSchema},
+		Operations: []scim.Operation{{Op: "replace", Path: "active", Value: active}},
+	})
+	if err != nil {
+		log.Printf("%s: %s: scim failed: %s", action, dn, err)
+	}
+	return err
+}
+
+// syncActive applies the disabled action to the provisioned dn when its
+// account status in the directory differs from the SP's.
+func (b *bridge) syncActive(ctx context.Context, dn string, spActive bool) error {
+	if b.cfg.mapping.disabledAttr == "" || b.cfg.disabledAction == "ignore" {
+		return nil
+	}
+
+	entry, err := b.fetch(ctx, dn)
+	if err != nil {
+		return err
+	}
+	if active := b.mapActive(entry); active != spActive {
+		return b.statusChanged(ctx, dn, active)
+	}
+	return nil
+}
+
+// statusChanged applies the configured disabled action to dn's account being
+// disabled or re-enabled in the directory. Deprovisioned accounts are added
+// back on re-enable while they're still in a watched group.
+func (b *bridge) statusChanged(ctx context.Context, dn string, active bool) error {
+	switch b.cfg.disabledAction {
+	case "ignore":
+		return nil
+	case "delete":
+		_, found, err := b.users.GetGUID(dn)
+		if err != nil {
+			return err
+		}
+		if !active {
+			if !found {
+				return nil
+			}
+			return b.Del(ctx, dn)
+		}
+		if found {
+			return nil
+		}
+
+		res, err := b.idp.Search(nil)
+		if err != nil {
+			return err
+		}
+		if !isMember(groupMembers(res.Entries), dn) {
+			return nil
+		}
+		return b.Add(ctx, dn)
+	default:
+		return b.SetActive(ctx, dn, active)
+	}
+}
+
+// skipDisabled reports whether entry is disabled and mustn't be provisioned
+// because disabled accounts are deprovisioned.
+func (b *bridge) skipDisabled(entry *ldap.Entry) bool {
+	return b.cfg.disabledAction == "delete" && !b.mapActive(entry)
+}
+
+func (b *bridge) teamsEnabled() bool {
+	return b.sp.Team() != "" || len(b.cfg.mapping.groupTeams) > 0
+}
+
+// teamsFor returns the teams dn belongs in given the watched groups: the
+// team every user joins, if any, plus the team mapped from each group dn is a
+// member of.
+func (b *bridge) teamsFor(groups []*ldap.Entry, dn string) []string {
+	teams := []string{}
+	if team := b.sp.Team(); team != "" {
+		teams = append(teams, team)
+	}
+
+	for _, group := range groups {
+		team, ok := b.cfg.mapping.groupTeams[group.GetAttributeValue("cn")]
+		if ok && !isMember(teams, team) && isMember(group.GetAttributeValues("member"), dn) {
+			teams = append(teams, team)
+		}
+	}
+
+	return teams
+}
+
+// reconcileTeams re-reads the watched groups and updates the team
+// memberships of the provisioned dn to match.
+func (b *bridge) reconcileTeams(ctx context.Context, dn string) error {
+	if !b.teamsEnabled() {
+		return nil
+	}
+
+	entry, err := b.fetch(ctx, dn)
+	if err != nil {
+		return err
+	}
+	user, err := b.mapEntry(entry)
+	if err != nil {
+		return err
+	}
+
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		return err
+	}
+
+	return b.syncTeams(ctx, dn, user.UserName, b.teamsFor(res.Entries, dn))
+}
+
+// addTeams adds dn, provisioned as login, to the teams its watched groups
+// map to.
+func (b *bridge) addTeams(ctx context.Context, dn, login string) error {
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		return err
+	}
+	return b.syncTeams(ctx, dn, login, b.teamsFor(res.Entries, dn))
+}
+
+// forgetTeams drops the record of dn's team memberships, for a user whose
+// memberships ended with its org membership.
+func (b *bridge) forgetTeams(dn string) {
+	teams, err := b.users.GetTeams(dn)
+	if err != nil {
+		log.Printf("remove: teams(%s): %s", dn, err)
+		return
+	}
+	for team := range teams {
+		if err := b.users.DelTeamMember(team, dn); err != nil {
+			log.Printf("remove: team member(%s, %s): %s", team, dn, err)
+		}
+	}
+}
+
+// syncTeams adds dn's GitHub login to each of teams it isn't yet in and
+// removes it from the teams the bridge added it to that aren't listed.
+func (b *bridge) syncTeams(ctx context.Context, dn, login string, teams []string) error {
+	current, err := b.users.GetTeams(dn)
+	if err != nil {
+		return err
+	}
+
+	for _, team := range teams {
+		if current[team] == login {
+			continue
+		}
+		if err := b.sp.AddTeamMember(ctx, team, login); err != nil {
+			return fmt.Errorf("team add %s to %s: %s", dn, team, err)
+		}
+		if err := b.users.SetTeamMember(team, dn, login); err != nil {
+			return err
+		}
+	}
+
+	for team, added := range current {
+		if isMember(teams, team) {
+			continue
+		}
+		if err := b.sp.DelTeamMember(ctx, team, added); err != nil {
+			return fmt.Errorf("team remove %s from %s: %s", dn, team, err)
+		}
+		if err := b.users.DelTeamMember(team, dn); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// tombstoned reports whether adding dn should be suppressed because it was
+// deprovisioned within the tombstone grace window. Directory replication lag
+// can briefly show a removed member as present, so a re-add within the window
+// only proceeds when a fresh read of the group confirms the membership.
+func (b *bridge) tombstoned(dn string) (bool, error) {
+	if b.cfg.tombstoneGrace <= 0 {
+		return false, nil
+	}
+
+	removedAt, err := b.users.GetTombstone(dn)
+	if err != nil {
+		return false, err
+	}
+	if removedAt.IsZero() || time.Since(removedAt) > b.cfg.tombstoneGrace {
+		return false, nil
+	}
+
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		return false, err
+	}
+	return !isMember(groupMembers(res.Entries), dn), nil
+}
+
+// publish notifies /events subscribers of a provisioning change, and the
+// attributes it changed, if any, and records it in the audit log.
+func (b *bridge) publish(ctx context.Context, action, dn, guid string, changes []scim.AttributeChange, err error) {
+	e := event{
+		Time:    time.Now(),
+		Action:  action,
+		DN:      dn,
+		GUID:    guid,
+		Changes: changes,
+	}
+	if err != nil {
+		e.Error = err.Error()
+	}
+	b.events.publish(e)
+	b.logs.record(action, err)
+	if r := reportFrom(ctx); r != nil {
+		r.record(action, err)
+	}
+
+	rec := users.AuditRecord{
+		Time:    e.Time,
+		Action:  action,
+		DN:      dn,
+		GUID:    guid,
+		Trigger: triggerFrom(ctx),
+		Result:  "success",
+		Changes: changes,
+		Error:   e.Error,
+	}
+	if err != nil {
+		rec.Result = "failure"
+	}
+	if err := b.users.Audit(rec); err != nil {
+		log.Printf("audit: %s %s: %s", action, dn, err)
+	}
+}
+
+type triggerKey struct{}
+
+// withTrigger records what caused the provisioning done under ctx: the
+// startup "sync", a "watch"ed group change, a "resume" from pause, a
+// deprovision "grace" period ending, or a -reconcile-user run ("reconcile").
+func withTrigger(ctx context.Context, trigger string) context.Context {
+	return context.WithValue(ctx, triggerKey{}, trigger)
+}
+
+func triggerFrom(ctx context.Context) string {
+	if trigger, ok := ctx.Value(triggerKey{}).(string); ok {
+		return trigger
+	}
+	return "unknown"
+}
+
+// auditPrune is how often audit records older than the TTL are dropped.
+const auditPrune = time.Hour
+
+// pruneAudit drops audit records older than the configured TTL.
+func (b *bridge) pruneAudit() {
+	n, err := b.users.PruneAudit(time.Now().Add(-b.cfg.auditTTL))
+	if err != nil {
+		log.Printf("audit: prune: %s", err)
+	} else if n > 0 {
+		log.Printf("audit: pruned %d records older than %s", n, b.cfg.auditTTL)
+	}
+}
+
+// mapEntry takes an LDAP entry, maps to a SCIM user representation, and
+// applies the configured transformers in order
+func (b *bridge) mapEntry(entry *ldap.Entry) (scim.User, error) {
+	user := scim.User{
+		UserName: entry.GetAttributeValue("uid"),
+		Name: scim.Name{
+			GivenName:  entry.GetAttributeValue("givenName"),
+			FamilyName: entry.GetAttributeValue("sn"),
+		},
+		Emails: b.mapEmails(entry),
+		Active: b.mapActive(entry),
+		Photos: b.mapPhotos(entry),
+		Roles:  b.mapRoles(entry),
+	}
+
+	// transformers see the normalized userName, and may replace the
+	// externalId
+	if n := b.cfg.mapping.userName; n != nil {
+		name, err := n.normalize(user.UserName)
+		if err != nil {
+			return user, fmt.Errorf("map %s: %s", entry.DN, err)
+		}
+		user.ExternalID = user.UserName
+		user.UserName = name
+	}
+
+	for _, t := range b.cfg.mapping.transformers {
+		if err := t.transform(entry, &user); err != nil {
+			return user, err
+		}
+	}
+
+	// a userName chosen after a collision sticks
+	name, err := b.users.GetUserName(entry.DN)
+	if err != nil {
+		return user, err
+	}
+	if name != "" {
+		user.UserName = name
+	}
+
+	return user, nil
+}
+
+// maxCollisionSuffix bounds the numeric suffixes tried for a userName that
+// collides with another user's.
+const maxCollisionSuffix = 100
+
+// resolveCollision provisions user, whose userName is already taken by
+// another user, as SYNC_USERNAME_COLLISIONS says: with a numeric suffix, with
+// the externalId as its userName, or not at all. The userName it's
+// provisioned with is recorded for dn so later syncs map it the same way.
+func (b *bridge) resolveCollision(ctx context.Context, dn string, user scim.User) (scim.User, string, error) {
+	taken := user.UserName
+
+	var candidates []string
+	switch b.cfg.collisionAction {
+	case "suffix":
+		for n := 2; n <= maxCollisionSuffix; n++ {
+			candidates = append(candidates, suffixUserName(taken, n))
+		}
+	case "external-id":
+		// the externalId becomes a userName, so it's held to the same rules
+		name := user.ExternalID
+		if n := b.cfg.mapping.userName; n != nil && name != "" {
+			normalized, err := n.normalize(name)
+			if err != nil {
+				return user, "", fmt.Errorf("userName %s is taken by another user, and the externalId can't replace it: %s", taken, err)
+			}
+			name = normalized
+		}
+		if name != "" && name != taken {
+			candidates = append(candidates, name)
+		}
+	}
+
+	for _, name := range candidates {
+		user.UserName = name
+		guid, err := b.sp.Add(ctx, user)
+		if err == sp.ErrConflict {
+			continue
+		}
+		if err != nil {
+			return user, "", err
+		}
+
+		log.Printf("add: %s: userName %s is taken by another user; provisioned as %s", dn, taken, name)
+		if err := b.users.SetUserName(dn, name); err != nil {
+			return user, guid, err
+		}
+		return user, guid, nil
+	}
+
+	return user, "", fmt.Errorf("userName %s is taken by another user", taken)
+}
+
+// suffixUserName appends n to userName, before the domain of an
+// email-style userName: alice becomes alice2, alice@example.com becomes
+// alice2@example.com.
+func suffixUserName(userName string, n int) string {
+	if i := strings.LastIndex(userName, "@"); i > 0 {
+		return fmt.Sprintf("%s%d%s", userName[:i], n, userName[i:])
+	}
+	return fmt.Sprintf("%s%d", userName, n)
+}
+
+// mapPhotos returns the first value of the configured photo attribute, such
+// as jpegPhoto or thumbnailPhoto, as a JPEG data URI.
+func (b *bridge) mapPhotos(entry *ldap.Entry) []scim.MultiValue {
+	attr := b.cfg.mapping.photoAttr
+	if attr == "" {
+		return nil
+	}
+
+	raw := entry.GetRawAttributeValue(attr)
+	if len(raw) == 0 {
+		return nil
+	}
+
+	return []scim.MultiValue{{
+		Value:   "data:image/jpeg;base64," + base64.StdEncoding.EncodeToString(raw),
+		Type:    "photo",
+		Primary: true,
+	}}
+}
+
+// mapRoles returns a role for each value of the configured role attribute,
+// such as memberOf. DN values are shortened to the value of their first RDN,
+// e.g. the group's cn.
+func (b *bridge) mapRoles(entry *ldap.Entry) []scim.MultiValue {
+	attr := b.cfg.mapping.roleAttr
+	if attr == "" {
+		return nil
+	}
+
+	var roles []scim.MultiValue
+	for _, value := range entry.GetAttributeValues(attr) {
+		if dn, err := ldap.ParseDN(value); err == nil && len(dn.RDNs) > 0 && len(dn.RDNs[0].Attributes) > 0 {
+			value = dn.RDNs[0].Attributes[0].Value
+		}
+		if value != "" {
+			roles = append(roles, scim.MultiValue{Value: value, Display: value})
+		}
+	}
+
+	return roles
+}
+
+// adAccountDisable is the ACCOUNTDISABLE flag of Active Directory's
+// userAccountControl attribute.
+const adAccountDisable = 0x2
+
+// adMatchingRuleBitAnd is Active Directory's bitwise AND matching rule OID.
+const adMatchingRuleBitAnd = "1.2.840.113556.1.4.803"
+
+// disabledFilter matches the accounts mapEntry maps as inactive, or is empty
+// when no disabled attribute is configured.
+func disabledFilter(m mappingConfig) string {
+	switch {
+	case m.disabledAttr == "":
+		return ""
+	case m.disabledValue == "":
+		return fmt.Sprintf("(%s:%s:=%d)", m.disabledAttr, adMatchingRuleBitAnd, adAccountDisable)
+	default:
+		return fmt.Sprintf("(%s=%s)", m.disabledAttr, ldap.EscapeFilter(m.disabledValue))
+	}
+}
+
+// mapActive reports whether the entry's account is enabled according to the
+// configured disabled attribute; accounts are active when none is configured.
+func (b *bridge) mapActive(entry *ldap.Entry) bool {
+	attr := b.cfg.mapping.disabledAttr
+	if attr == "" {
+		return true
+	}
+
+	value := entry.GetAttributeValue(attr)
+	if b.cfg.mapping.disabledValue == "" {
+		// Active Directory: test the ACCOUNTDISABLE bit
+		flags, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return true
+		}
+		return flags&adAccountDisable == 0
+	}
+
+	return !strings.EqualFold(value, b.cfg.mapping.disabledValue)
+}
+
+// mapEmails collects every value of the configured email attributes in
+// directory order, skipping empty and duplicate values. The first address in
+// the configured primary domain is marked primary, falling back to the first
+// address.
+func (b *bridge) mapEmails(entry *ldap.Entry) []scim.Email {
+	emails := []scim.Email{}
+	seen := make(map[string]bool)
+
+	for _, attr := range b.cfg.mapping.emailAttrs {
+		for _, value := range entry.GetAttributeValues(attr) {
+			value = strings.TrimSpace(value)
+			if value == "" || seen[value] {
+				continue
+			}
+			seen[value] = true
+
+			emails = append(emails, scim.Email{
+				Type:  "work",
+				Value: value,
+			})
+		}
+	}
+
+	if len(emails) == 0 {
+		return emails
+	}
+
+	primary := 0
+	if domain := b.cfg.mapping.primaryEmailDomain; domain != "" {
+		suffix := "@" + strings.ToLower(domain)
+		for i, email := range emails {
+			if strings.HasSuffix(strings.ToLower(email.Value), suffix) {
+				primary = i
+				break
+			}
+		}
+	}
+	emails[primary].Primary = true
+
+	return emails
+}
+
+func (b *bridge) startHTTP() {
+	mux := http.NewServeMux()
+	mux.Handle("/_debug", b)
+	mux.HandleFunc("/version", versionHandler)
+	mux.Handle("/events", b.events)
+	mux.Handle("/health", b.health)
+	mux.HandleFunc("/pause", b.pauseHandler(true))
+	mux.HandleFunc("/audit", b.auditHandler)
+	mux.HandleFunc("/resume", b.pauseHandler(false))
+	l, _ := net.Listen("tcp", b.cfg.httpAddr)
+	defer l.Close()
+	srv := http.Server{
+		Handler: mux,
+	}
+	log.Printf("listening for web on %s", b.cfg.httpAddr)
+	srv.Serve(l)
+}
+
+// httpError responds to a request that failed with err. The handler
+// must return after calling it.
+func httpError(w http.ResponseWriter, code int, err error) {
+	w.WriteHeader(code)
+	fmt.Fprintf(w, "oops: %s", err)
+}
+
+func (b *bridge) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	log.Println("HTTP debug request")
+
+	list, err := b.users.List()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	queued, err := b.users.Queued()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	pending, err := b.users.PendingDeprovisions()
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	for i, user := range list {
+		list[i] = b.cfg.redactor.Redact(user)
+	}
+
+	buf, err := json.Marshal(struct {
+		Paused              bool                 `json:"paused"`
+		Queued              []users.Change       `json:"queued"`
+		PendingDeprovisions map[string]time.Time `json:"pendingDeprovisions"`
+		Syncs               []*syncReport        `json:"syncs"`
+		Plan                []plannedChange      `json:"plan,omitempty"`
+		Compaction          *compaction          `json:"compaction,omitempty"`
+		Users               []scim.User          `json:"users"`
+	}{b.isPaused(), queued, pending, b.syncs.list(), b.plan.list(), b.compactions.get(), list})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// auditHandler serves the audit log as JSON, optionally limited to the
+// RFC 3339 "since" and "until" query parameters.
+func (b *bridge) auditHandler(w http.ResponseWriter, req *http.Request) {
+	since, until, err := parseRange(req.URL.Query().Get("since"), req.URL.Query().Get("until"))
+	if err != nil {
+		httpError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	records, err := b.users.AuditRange(since, until)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	buf, err := json.Marshal(records)
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
+
+// parseRange parses optional RFC 3339 bounds; empty values are zero times.
+func parseRange(sinceValue, untilValue string) (since, until time.Time, err error) {
+	if sinceValue != "" {
+		if since, err = time.Parse(time.RFC3339, sinceValue); err != nil {
+			return since, until, fmt.Errorf("since: %s", err)
+		}
+	}
+	if untilValue != "" {
+		if until, err = time.Parse(time.RFC3339, untilValue); err != nil {
+			return since, until, fmt.Errorf("until: %s", err)
+		}
+	}
+	return since, until, nil
+}
+
+// exportAudit writes the audit log in [since, until) to stdout, one JSON
+// record per line.
+func exportAudit(dbPath string, since, until time.Time) error {
+	db, err := bolt.Open(dbPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	if err != nil {
+		return fmt.Errorf("open %s: %s", dbPath, err)
+	}
+	defer db.Close()
+
+	store := users.New(db)
+	records, err := store.AuditRange(since, until)
+	if err != nil {
+		return err
+	}
+
+	for _, rec := range records {
+		buf, err := json.Marshal(rec)
+		if err != nil {
+			return err
+		}
+		fmt.Println(string(buf))
+	}
+
+	return nil
+}
+
+func versionHandler(w http.ResponseWriter, req *http.Request) {
+	buf, err := json.Marshal(map[string]string{
+		"version":   scim.Version,
+		"commit":    scim.Commit,
+		"buildDate": scim.BuildDate,
+	})
+	if err != nil {
+		httpError(w, http.StatusInternalServerError, err)
+		return
+	}
+	fmt.Fprintf(w, "%s", buf)
+}
+
+type ldapConfig struct {
+	addr        string
+	bindDn      string
+	bindPw      string
+	baseDn      string
+	group       string
+	filter      string
+	dialTimeout time.Duration
+	timeout     time.Duration
+	sizeLimit   int
+	timeLimit   int
+
+	// userFilter, when set, matches the users to provision directly instead
+	// of the groups they're members of.
+	userFilter string
+
+	// bindMethod is how connections authenticate; see bindLDAP.
+	bindMethod string
+
+	// followReferrals chases search result references, binding to the
+	// referred servers as referralBindDn.
+	followReferrals bool
+	referralBindDn  string
+	referralBindPw  string
+}
+
+type scimConfig struct {
+	org        string
+	token      string
+	authMethod string
+	authHeader string
+	oauth2     clientcredentials.Config
+	userAgent  string
+	dryRun     bool
+	dryRunIDs  string
+	team       string
+	teamToken  string
+
+	breakerThreshold int
+	breakerCooldown  time.Duration
+
+	// rateLimit is the most GitHub API calls a second, across workers.
+	rateLimit float64
+
+	pageSize int
+
+	// logBodies logs request and response bodies, with the fields
+	// bodyRedactor names scrubbed.
+	logBodies    bool
+	bodyRedactor *scim.Redactor
+}
+
+type bridgeConfig struct {
+	concurrency       int
+	incremental       bool
+	tombstoneGrace    time.Duration
+	maxRemovals       int
+	maxRemovalPercent int
+	force             bool
+	auditTTL          time.Duration
+	logSample         int
+	prune             bool
+	warmup            bool
+	readOnly          bool
+	standby           bool
+	httpAddr          string
+	dbCheck           string
+
+	// compactInterval is how often the database is compacted, keeping the
+	// newest backupRetain backups taken beforehand; zero disables it.
+	compactInterval time.Duration
+	backupRetain    int
+
+	mapping  mappingConfig
+	redactor *scim.Redactor
+
+	// mappingSample is how many members validateMapping samples at startup;
+	// zero skips it. strictMapping makes a failed validation fatal.
+	mappingSample int
+	strictMapping bool
+
+	// commitBatchSize and commitBatchDelay bound how many concurrent
+	// store writes bolt coalesces into one transaction, and how long it
+	// waits to fill a batch; zero keeps bolt's defaults.
+	commitBatchSize  int
+	commitBatchDelay time.Duration
+
+	// disabledAction is what happens to provisioned users whose accounts
+	// are disabled in the directory: "suspend" deactivates them, "delete"
+	// deprovisions them, and "ignore" leaves them be.
+	disabledAction string
+
+	// collisionAction is how a user whose userName is taken by another user
+	// is provisioned: "suffix" appends a number, "external-id" uses the
+	// externalId instead, and "skip" doesn't provision it.
+	collisionAction string
+
+	// deprovisionGrace is how long a removed member is pending deprovision
+	// before they're removed; 0 removes them immediately.
+	deprovisionGrace time.Duration
+
+	// driftWebhook is a URL each drift a sync corrects is posted to.
+	driftWebhook string
+}
+
+// mappingConfig controls how LDAP entries map to SCIM users.
+type mappingConfig struct {
+	emailAttrs         []string
+	primaryEmailDomain string
+
+	// disabledAttr marks an account disabled when it equals disabledValue,
+	// or, when disabledValue is empty, when the AD ACCOUNTDISABLE bit is
+	// set in it.
+	disabledAttr  string
+	disabledValue string
+
+	// photoAttr and roleAttr name the attributes mapped to photos and
+	// roles; neither is mapped when empty.
+	photoAttr string
+	roleAttr  string
+
+	// groupTeams maps watched group CNs to the GitHub team their members
+	// are added to.
+	groupTeams map[string]string
+
+	// transformers are applied to each mapped user, in order.
+	transformers []transformer
+
+	// userName normalizes the uid mapped to userName, which is kept as the
+	// externalId; uids are used as they are when it's nil.
+	userName *userNameNormalizer
+}
+
+type config struct {
+	ldap   ldapConfig
+	scim   scimConfig
+	bridge bridgeConfig
+	dbPath string
+}
+
+func loadConfig() config {
+	c := config{
+		ldap: ldapConfig{
+			addr:        "localhost:389",
+			bindDn:      "cn=admin,dc=planetexpress,dc=com",
+			bindPw:      "GoodNewsEveryone",
+			baseDn:      "ou=people,dc=planetexpress,dc=com",
+			group:       "idptool",
+			dialTimeout: 10 * time.Second,
+			timeout:     60 * time.Second,
+			bindMethod:  "simple",
+		},
+		scim: scimConfig{
+			org:        "idptool",
+			authMethod: "bearer",
+			dryRun:     true,
+
+			breakerThreshold: 5,
+			breakerCooldown:  30 * time.Second,
+
+			rateLimit: 10,
+
+			pageSize: 100,
+		},
+		bridge: bridgeConfig{
+			concurrency:     4,
+			httpAddr:        ":4444",
+			dbCheck:         "sample",
+			backupRetain:    3,
+			auditTTL:        90 * 24 * time.Hour,
+			disabledAction:  "suspend",
+			collisionAction: "skip",
+			mappingSample:   20,
+			mapping: mappingConfig{
+				emailAttrs: []string{"mail"},
+			},
+		},
+		dbPath: "bridge.db",
+	}
+
+	if addr := os.Getenv("LDAP_ADDR"); addr != "" {
+		c.ldap.addr = addr
+	}
+	if bindDn := os.Getenv("LDAP_BIND"); bindDn != "" {
+		c.ldap.bindDn = bindDn
 	}
 	if bindPw := os.Getenv("LDAP_PASS"); bindPw != "" {
 		c.ldap.bindPw = bindPw
 	}
+	if path := os.Getenv("LDAP_PASS_FILE"); path != "" {
+		bindPw, err := scim.ReadSecretFile(path)
+		if err != nil {
+			log.Fatalf("LDAP_PASS_FILE: %s", err)
+		}
+		c.ldap.bindPw = bindPw
+	}
+	if method := os.Getenv("LDAP_BIND_METHOD"); method != "" {
+		switch method {
+		case "simple", "anonymous":
+		case "sasl-external", "gssapi":
+			// ldap.v2 has no SASL bind, nor a way to send one ourselves
+			log.Fatalf("LDAP_BIND_METHOD=%s isn't supported: the LDAP client library, gopkg.in/ldap.v2, only implements simple binds", method)
+		default:
+			log.Fatalf("invalid LDAP_BIND_METHOD %q: expected simple, anonymous, sasl-external, or gssapi", method)
+		}
+		c.ldap.bindMethod = method
+	}
+	if referrals := os.Getenv("LDAP_REFERRALS"); referrals != "" {
+		switch referrals {
+		case "follow":
+			c.ldap.followReferrals = true
+		case "ignore":
+		default:
+			log.Fatalf("invalid LDAP_REFERRALS %q: expected follow or ignore", referrals)
+		}
+	}
+	c.ldap.referralBindDn, c.ldap.referralBindPw = c.ldap.bindDn, c.ldap.bindPw
+	if bindDn := os.Getenv("LDAP_REFERRAL_BIND"); bindDn != "" {
+		c.ldap.referralBindDn = bindDn
+	}
+	if bindPw := os.Getenv("LDAP_REFERRAL_PASS"); bindPw != "" {
+		c.ldap.referralBindPw = bindPw
+	}
 	if baseDn := os.Getenv("LDAP_BASE"); baseDn != "" {
 		c.ldap.baseDn = baseDn
 	}
 	if group := os.Getenv("LDAP_GROUP"); group != "" {
 		c.ldap.group = group
 	}
+	if filter := os.Getenv("LDAP_FILTER"); filter != "" {
+		c.ldap.filter = filter
+	}
+	if filter := os.Getenv("LDAP_USER_FILTER"); filter != "" {
+		c.ldap.userFilter = filter
+	}
+	if dialTimeout := os.Getenv("LDAP_DIAL_TIMEOUT"); dialTimeout != "" {
+		if d, err := time.ParseDuration(dialTimeout); err == nil {
+			c.ldap.dialTimeout = d
+		}
+	}
+	if timeout := os.Getenv("LDAP_TIMEOUT"); timeout != "" {
+		if d, err := time.ParseDuration(timeout); err == nil {
+			c.ldap.timeout = d
+		}
+	}
+	if sizeLimit := os.Getenv("LDAP_SIZE_LIMIT"); sizeLimit != "" {
+		if n, err := strconv.Atoi(sizeLimit); err == nil && n >= 0 {
+			c.ldap.sizeLimit = n
+		}
+	}
+	if timeLimit := os.Getenv("LDAP_TIME_LIMIT"); timeLimit != "" {
+		if n, err := strconv.Atoi(timeLimit); err == nil && n >= 0 {
+			c.ldap.timeLimit = n
+		}
+	}
 
 	if org := os.Getenv("SCIM_ORG"); org != "" {
 		c.scim.org = org
@@ -303,9 +1830,259 @@ func loadConfig() config {
 	if token := os.Getenv("SCIM_TOKEN"); token != "" {
 		c.scim.token = token
 	}
+	if path := os.Getenv("SCIM_TOKEN_FILE"); path != "" {
+		token, err := scim.ReadSecretFile(path)
+		if err != nil {
+			log.Fatalf("SCIM_TOKEN_FILE: %s", err)
+		}
+		c.scim.token = token
+	}
+	if authMethod := os.Getenv("SCIM_AUTH"); authMethod != "" {
+		c.scim.authMethod = authMethod
+	}
+	if authHeader := os.Getenv("SCIM_AUTH_HEADER"); authHeader != "" {
+		c.scim.authHeader = authHeader
+	}
+	if tokenURL := os.Getenv("SCIM_OAUTH2_TOKEN_URL"); tokenURL != "" {
+		c.scim.oauth2.TokenURL = tokenURL
+	}
+	if clientID := os.Getenv("SCIM_OAUTH2_CLIENT_ID"); clientID != "" {
+		c.scim.oauth2.ClientID = clientID
+	}
+	if clientSecret := os.Getenv("SCIM_OAUTH2_CLIENT_SECRET"); clientSecret != "" {
+		c.scim.oauth2.ClientSecret = clientSecret
+	}
+	if scopes := os.Getenv("SCIM_OAUTH2_SCOPES"); scopes != "" {
+		c.scim.oauth2.Scopes = strings.Split(scopes, ",")
+	}
+	if userAgent := os.Getenv("SCIM_USER_AGENT"); userAgent != "" {
+		c.scim.userAgent = userAgent
+	}
 	if dryRun := os.Getenv("SCIM_DRY"); dryRun != "" {
 		c.scim.dryRun = dryRun != "false"
 	}
+	if dryRunIDs := os.Getenv("SCIM_DRY_IDS"); dryRunIDs != "" {
+		c.scim.dryRunIDs = dryRunIDs
+	}
+
+	if team := os.Getenv("SCIM_TEAM"); team != "" {
+		c.scim.team = team
+	}
+	if teamToken := os.Getenv("SCIM_TEAM_TOKEN"); teamToken != "" {
+		c.scim.teamToken = teamToken
+	}
+	if threshold := os.Getenv("SCIM_BREAKER_THRESHOLD"); threshold != "" {
+		if n, err := strconv.Atoi(threshold); err == nil && n >= 0 {
+			c.scim.breakerThreshold = n
+		}
+	}
+	if cooldown := os.Getenv("SCIM_BREAKER_COOLDOWN"); cooldown != "" {
+		if d, err := time.ParseDuration(cooldown); err == nil {
+			c.scim.breakerCooldown = d
+		}
+	}
+	if limit := os.Getenv("SCIM_RATE_LIMIT"); limit != "" {
+		n, err := strconv.ParseFloat(limit, 64)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid SCIM_RATE_LIMIT %q: expected a number of calls a second, or 0 for no limit", limit)
+		}
+		c.scim.rateLimit = n
+	}
+	if size := os.Getenv("SCIM_PAGE_SIZE"); size != "" {
+		n, err := strconv.Atoi(size)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid SCIM_PAGE_SIZE %q: expected a number of users, or 0 for the server's default", size)
+		}
+		c.scim.pageSize = n
+	}
+
+	// bodies are only logged with -log-bodies, but scrubbed by default
+	bodyFields := "email,name"
+	if fields, ok := os.LookupEnv("LOG_BODIES_REDACT"); ok {
+		bodyFields = fields
+	}
+	bodyRedactor, err := scim.NewRedactor(bodyFields, os.Getenv("REDACT_HASH") == "true")
+	if err != nil {
+		log.Fatalf("invalid LOG_BODIES_REDACT %q: %s", bodyFields, err)
+	}
+	c.scim.bodyRedactor = bodyRedactor
+
+	if concurrency := os.Getenv("SYNC_CONCURRENCY"); concurrency != "" {
+		n, err := strconv.Atoi(concurrency)
+		if err != nil || n < 1 {
+			log.Fatalf("invalid SYNC_CONCURRENCY %q: expected a number of workers, at least 1", concurrency)
+		}
+		c.bridge.concurrency = n
+	}
+
+	if incremental := os.Getenv("SYNC_INCREMENTAL"); incremental != "" {
+		c.bridge.incremental = incremental != "false"
+	}
+
+	if grace := os.Getenv("SYNC_TOMBSTONE_GRACE"); grace != "" {
+		if d, err := time.ParseDuration(grace); err == nil {
+			c.bridge.tombstoneGrace = d
+		}
+	}
+
+	if grace := os.Getenv("SYNC_DEPROVISION_GRACE"); grace != "" {
+		d, err := time.ParseDuration(grace)
+		if err != nil || d < 0 {
+			log.Fatalf("invalid SYNC_DEPROVISION_GRACE %q: expected a duration, e.g. 24h", grace)
+		}
+		c.bridge.deprovisionGrace = d
+	}
+
+	if webhook := os.Getenv("DRIFT_WEBHOOK"); webhook != "" {
+		if !strings.HasPrefix(webhook, "http://") && !strings.HasPrefix(webhook, "https://") {
+			log.Fatalf("invalid DRIFT_WEBHOOK %q: expected an http or https URL", webhook)
+		}
+		c.bridge.driftWebhook = webhook
+	}
+
+	// a limit that doesn't parse mustn't leave removals unlimited
+	if maxRemovals := os.Getenv("SYNC_MAX_REMOVALS"); maxRemovals != "" {
+		n, err := strconv.Atoi(maxRemovals)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid SYNC_MAX_REMOVALS %q: expected a number of users, or 0 for unlimited", maxRemovals)
+		}
+		c.bridge.maxRemovals = n
+	}
+	if maxRemovalPercent := os.Getenv("SYNC_MAX_REMOVAL_PERCENT"); maxRemovalPercent != "" {
+		n, err := strconv.Atoi(maxRemovalPercent)
+		if err != nil || n < 0 || n > 100 {
+			log.Fatalf("invalid SYNC_MAX_REMOVAL_PERCENT %q: expected a whole percentage from 0 to 100, without %%, or 0 for unlimited", maxRemovalPercent)
+		}
+		c.bridge.maxRemovalPercent = n
+	}
+
+	if size := os.Getenv("SYNC_COMMIT_BATCH_SIZE"); size != "" {
+		if n, err := strconv.Atoi(size); err == nil && n > 0 {
+			c.bridge.commitBatchSize = n
+		}
+	}
+	if delay := os.Getenv("SYNC_COMMIT_BATCH_DELAY"); delay != "" {
+		if d, err := time.ParseDuration(delay); err == nil && d > 0 {
+			c.bridge.commitBatchDelay = d
+		}
+	}
+
+	if addr := os.Getenv("HTTP_ADDR"); addr != "" {
+		c.bridge.httpAddr = addr
+	}
+
+	if warmup := os.Getenv("SYNC_WARMUP"); warmup != "" {
+		c.bridge.warmup = warmup != "false"
+	}
+
+	if action := os.Getenv("SYNC_DISABLED_ACTION"); action != "" {
+		switch action {
+		case "suspend", "delete", "ignore":
+			c.bridge.disabledAction = action
+		default:
+			log.Fatalf("invalid SYNC_DISABLED_ACTION %q: expected suspend, delete, or ignore", action)
+		}
+	}
+
+	if action := os.Getenv("SYNC_USERNAME_COLLISIONS"); action != "" {
+		switch action {
+		case "suffix", "external-id", "skip":
+			c.bridge.collisionAction = action
+		default:
+			log.Fatalf("invalid SYNC_USERNAME_COLLISIONS %q: expected suffix, external-id, or skip", action)
+		}
+	}
+
+	if auditTTL := os.Getenv("AUDIT_TTL"); auditTTL != "" {
+		if d, err := time.ParseDuration(auditTTL); err == nil {
+			c.bridge.auditTTL = d
+		}
+	}
+
+	if emailAttrs := os.Getenv("MAP_EMAIL_ATTRS"); emailAttrs != "" {
+		c.bridge.mapping.emailAttrs = strings.Split(emailAttrs, ",")
+	}
+	if domain := os.Getenv("MAP_PRIMARY_EMAIL_DOMAIN"); domain != "" {
+		c.bridge.mapping.primaryEmailDomain = domain
+	}
+	if rule := os.Getenv("MAP_DISABLED"); rule != "" {
+		if strings.EqualFold(rule, "ad") {
+			c.bridge.mapping.disabledAttr = "userAccountControl"
+		} else {
+			i := strings.Index(rule, "=")
+			if i <= 0 || i == len(rule)-1 {
+				log.Fatalf("invalid MAP_DISABLED %q: expected ad or attribute=value", rule)
+			}
+			c.bridge.mapping.disabledAttr = rule[:i]
+			c.bridge.mapping.disabledValue = rule[i+1:]
+		}
+	}
+	if attr := os.Getenv("MAP_PHOTO_ATTR"); attr != "" {
+		c.bridge.mapping.photoAttr = attr
+	}
+	if attr := os.Getenv("MAP_ROLE_ATTR"); attr != "" {
+		c.bridge.mapping.roleAttr = attr
+	}
+	if groupTeams := os.Getenv("MAP_GROUP_TEAMS"); groupTeams != "" {
+		c.bridge.mapping.groupTeams = make(map[string]string)
+		for _, pair := range strings.Split(groupTeams, ",") {
+			i := strings.Index(pair, ":")
+			if i <= 0 || i == len(pair)-1 {
+				log.Fatalf("invalid MAP_GROUP_TEAMS entry %q: expected group:team", pair)
+			}
+			c.bridge.mapping.groupTeams[pair[:i]] = pair[i+1:]
+		}
+	}
+
+	if fields := os.Getenv("REDACT_FIELDS"); fields != "" {
+		redactor, err := scim.NewRedactor(fields, os.Getenv("REDACT_HASH") == "true")
+		if err != nil {
+			log.Fatalf("invalid REDACT_FIELDS %q: %s", fields, err)
+		}
+		c.bridge.redactor = redactor
+	}
+
+	if sample := os.Getenv("MAP_VALIDATE_SAMPLE"); sample != "" {
+		n, err := strconv.Atoi(sample)
+		if err != nil || n < 0 {
+			log.Fatalf("invalid MAP_VALIDATE_SAMPLE %q: expected a number of members, or 0 to skip validation", sample)
+		}
+		c.bridge.mappingSample = n
+	}
+	if chain := os.Getenv("MAP_TRANSFORMERS"); chain != "" {
+		transformers, err := parseTransformers(chain)
+		if err != nil {
+			log.Fatalf("invalid MAP_TRANSFORMERS %q: %s", chain, err)
+		}
+		c.bridge.mapping.transformers = transformers
+	}
+	if steps := os.Getenv("MAP_USERNAME_NORMALIZE"); steps != "" {
+		normalizer, err := parseUserNameNormalizer(steps)
+		if err != nil {
+			log.Fatalf("invalid MAP_USERNAME_NORMALIZE %q: %s", steps, err)
+		}
+		c.bridge.mapping.userName = normalizer
+	}
+
+	if check := os.Getenv("DB_CHECK"); check != "" {
+		switch check {
+		case "off", "structure", "sample", "full":
+			c.bridge.dbCheck = check
+		default:
+			log.Fatalf("invalid DB_CHECK %q: expected off, structure, sample, or full", check)
+		}
+	}
+
+	if interval := os.Getenv("DB_COMPACT_INTERVAL"); interval != "" {
+		if d, err := time.ParseDuration(interval); err == nil {
+			c.bridge.compactInterval = d
+		}
+	}
+	if retain := os.Getenv("DB_BACKUP_RETAIN"); retain != "" {
+		if n, err := strconv.Atoi(retain); err == nil && n >= 0 {
+			c.bridge.backupRetain = n
+		}
+	}
 
 	if dbPath := os.Getenv("DB"); dbPath != "" {
 		c.dbPath = dbPath
@@ -314,43 +2091,363 @@ func loadConfig() config {
 	return c
 }
 
+// groupFilter matches the group named by cn, or every group in groupTeams
+// when there are any.
+func groupFilter(cn string, groupTeams map[string]string) string {
+	if len(groupTeams) == 0 {
+		return fmt.Sprintf("(cn=%s)", ldap.EscapeFilter(cn))
+	}
+
+	cns := make([]string, 0, len(groupTeams))
+	for group := range groupTeams {
+		cns = append(cns, group)
+	}
+	sort.Strings(cns)
+
+	filter := "(|"
+	for _, group := range cns {
+		filter += fmt.Sprintf("(cn=%s)", ldap.EscapeFilter(group))
+	}
+	return filter + ")"
+}
+
+// standbyRetry is how long a standby bridge waits for the lock on DB between
+// log lines.
+const standbyRetry = time.Minute
+
+// standby opens the database at path, waiting for the bolt file lock while
+// another bridge holds it. Only the holder of the lock provisions, so
+// redundant bridges take over in turn. /health reports the standby role on
+// addr in the meantime.
+func standby(path, addr string) (*bolt.DB, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != bolt.ErrTimeout {
+		return db, err
+	}
+
+	h := newHealth()
+	h.setRole("standby")
+	mux := http.NewServeMux()
+	mux.Handle("/health", h)
+	srv := &http.Server{Addr: addr, Handler: mux}
+	go func() {
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("standby: %s", err)
+		}
+	}()
+	defer srv.Close()
+
+	for {
+		log.Printf("standby: another bridge holds %s; waiting to take over", path)
+		db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: standbyRetry})
+		if err != bolt.ErrTimeout {
+			if err == nil {
+				log.Printf("standby: acquired %s; taking over", path)
+			}
+			return db, err
+		}
+	}
+}
+
+// dialLDAP connects to the directory, bounding the dial by dialTimeout and
+// every subsequent request (searches, binds) by timeout.
+func dialLDAP(c ldapConfig) (*ldap.Conn, error) {
+	d := net.Dialer{Timeout: c.dialTimeout}
+	netConn, err := d.Dial("tcp", c.addr)
+	if err != nil {
+		return nil, ldap.NewError(ldap.ErrorNetwork, err)
+	}
+
+	conn := ldap.NewConn(netConn, false)
+	conn.Start()
+	conn.SetTimeout(c.timeout)
+
+	return conn, nil
+}
+
+// bindLDAP authenticates conn with method: "simple" binds as dn with
+// password pw, and "anonymous" doesn't bind, leaving the connection
+// anonymous.
+func bindLDAP(conn *ldap.Conn, method, dn, pw string) error {
+	switch method {
+	case "simple":
+		return conn.Bind(dn, pw)
+	case "anonymous":
+		return nil
+	default:
+		return fmt.Errorf("unsupported bind method %q", method)
+	}
+}
+
+// checkAnonymousAccess confirms an anonymous connection can read what the
+// bridge needs: the base DN, and members of the watched groups. Directories
+// that don't allow anonymous reads often answer with nothing rather than an
+// error, which would otherwise look like an empty group and deprovision
+// everyone.
+func checkAnonymousAccess(p idp.Provider, c ldapConfig) error {
+	res, err := p.Search(ldap.NewSearchRequest(
+		c.baseDn,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 1, c.timeLimit, false,
+		"(objectClass=*)",
+		[]string{"dn"},
+		nil,
+	))
+	if err != nil {
+		return fmt.Errorf("anonymous: can't read LDAP_BASE %s: %s", c.baseDn, err)
+	}
+	if len(res.Entries) == 0 {
+		return fmt.Errorf("anonymous: LDAP_BASE %s isn't visible; the directory may not allow anonymous reads", c.baseDn)
+	}
+
+	res, err = p.Search(nil)
+	if err != nil {
+		return fmt.Errorf("anonymous: watched search: %s", err)
+	}
+	if len(groupMembers(res.Entries)) == 0 {
+		return fmt.Errorf("anonymous: the watched search found no members; the directory may hide them from anonymous reads")
+	}
+
+	return nil
+}
+
 func main() {
+	showVersion := flag.Bool("version", false, "print the build version and exit")
+	force := flag.Bool("force", false, "apply the startup sync's removals even when they exceed SYNC_MAX_REMOVALS or SYNC_MAX_REMOVAL_PERCENT")
+	auditExport := flag.Bool("export-audit", false, "print the audit log as JSON lines and exit")
+	auditSince := flag.String("since", "", "with -export-audit, the RFC 3339 time to export from")
+	auditUntil := flag.String("until", "", "with -export-audit, the RFC 3339 time to export until")
+	logSample := flag.Int("log-sample", 1, "log the progress of every Nth add or remove; failures and a per-minute summary are always logged")
+	standbyFlag := flag.Bool("standby", false, "if another bridge holds DB, stand by until it's released and then take over")
+	readOnly := flag.Bool("read-only", false, "observe and plan without changing the SP or the database, which is opened read-only")
+	prune := flag.Bool("prune", true, "remove users that left the watched groups during the startup sync; with -prune=false they're only logged")
+	noRedact := flag.Bool("no-redact", false, "show the fields named by REDACT_FIELDS in /_debug, for authorized troubleshooting")
+	strictMapping := flag.Bool("strict-mapping", false, "refuse to start when a mapped LDAP attribute is empty for every sampled member")
+	reconcileUser := flag.String("reconcile-user", "", "print how the bridge would reconcile the user with this uid or DN, and exit")
+	applyFlag := flag.Bool("apply", false, "with -reconcile-user, apply the decision instead of only printing it")
+	logBodies := flag.Bool("log-bodies", false, "log SCIM requests and responses, scrubbing the fields named by LOG_BODIES_REDACT from bodies and credentials from headers")
+	flag.Parse()
+
+	if *showVersion {
+		fmt.Println(scim.VersionString())
+		return
+	}
+
+	if os.Getenv("LOG_FORMAT") == "json" {
+		log.SetFlags(0)
+		log.SetOutput(jsonLogWriter{os.Stderr})
+	}
+
+	log.Printf("ldap-bridged %s", scim.VersionString())
+
 	c := loadConfig()
+	c.bridge.force = *force
+	c.bridge.logSample = *logSample
+	c.bridge.prune = *prune
+	c.bridge.readOnly = *readOnly
+	c.bridge.standby = *standbyFlag
+	c.bridge.strictMapping = *strictMapping
+	c.scim.logBodies = *logBodies
+	if *logBodies {
+		log.Printf("warning: -log-bodies: SCIM request and response bodies are logged; fields outside LOG_BODIES_REDACT are in cleartext")
+	}
+	if *reconcileUser != "" && !*applyFlag {
+		// only planning, so leave the database and the SP alone
+		c.bridge.readOnly = true
+	}
+	if c.bridge.standby && c.bridge.compactInterval > 0 {
+		// compaction replaces the locked file, which would let a waiting
+		// standby take the lock of the old one
+		log.Fatalf("-standby can't be combined with DB_COMPACT_INTERVAL")
+	}
+	if *noRedact && c.bridge.redactor != nil {
+		log.Printf("warning: -no-redact: /_debug shows REDACT_FIELDS in cleartext")
+		c.bridge.redactor = nil
+	}
+
+	if *auditExport {
+		since, until, err := parseRange(*auditSince, *auditUntil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := exportAudit(c.dbPath, since, until); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	// LDAP_FILTER is used verbatim; LDAP_GROUP is a convenience for
+	// (cn=group), replaced by the mapped groups when MAP_GROUP_TEAMS is set.
+	// LDAP_USER_FILTER replaces groups altogether.
+	if c.ldap.userFilter != "" {
+		if c.ldap.filter != "" || c.bridge.mapping.groupTeams != nil {
+			log.Fatalf("LDAP_USER_FILTER can't be combined with LDAP_FILTER or MAP_GROUP_TEAMS")
+		}
+		c.ldap.filter = c.ldap.userFilter
+	} else if c.ldap.filter == "" {
+		c.ldap.filter = groupFilter(c.ldap.group, c.bridge.mapping.groupTeams)
+	}
+	if _, err := ldap.CompileFilter(c.ldap.filter); err != nil {
+		log.Fatalf("invalid LDAP filter %q: %s", c.ldap.filter, err)
+	}
+
+	switch c.scim.authMethod {
+	case "bearer", "basic":
+	case "header":
+		if c.scim.authHeader == "" {
+			log.Fatal("SCIM_AUTH_HEADER is required when SCIM_AUTH=header")
+		}
+	case "oauth2":
+		if c.scim.oauth2.TokenURL == "" || c.scim.oauth2.ClientID == "" {
+			log.Fatal("SCIM_OAUTH2_TOKEN_URL and SCIM_OAUTH2_CLIENT_ID are required when SCIM_AUTH=oauth2")
+		}
+	default:
+		log.Fatalf("unknown SCIM_AUTH %q: expected bearer, basic, header, or oauth2", c.scim.authMethod)
+	}
+
+	shutdown, err := setupTracing()
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer shutdown()
 
-	conn, err := ldap.Dial("tcp", c.ldap.addr)
+	conn, err := dialLDAP(c.ldap)
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer conn.Close()
 
-	if err = conn.Bind(c.ldap.bindDn, c.ldap.bindPw); err != nil {
+	if err = bindLDAP(conn, c.ldap.bindMethod, c.ldap.bindDn, c.ldap.bindPw); err != nil {
 		log.Fatal(err)
 	}
 
-	db, err := bolt.Open(c.dbPath, 0600, nil)
+	var db *bolt.DB
+	switch {
+	case c.bridge.readOnly:
+		// a shared lock, so read-only bridges can share the file
+		db, err = bolt.Open(c.dbPath, 0600, &bolt.Options{ReadOnly: true, Timeout: time.Second})
+	case c.bridge.standby:
+		db, err = standby(c.dbPath, c.bridge.httpAddr)
+	default:
+		db, err = bolt.Open(c.dbPath, 0600, nil)
+	}
 	if err != nil {
 		log.Fatal(err)
 	}
 	defer db.Close()
+	if c.bridge.commitBatchSize > 0 {
+		db.MaxBatchSize = c.bridge.commitBatchSize
+	}
+	if c.bridge.commitBatchDelay > 0 {
+		db.MaxBatchDelay = c.bridge.commitBatchDelay
+	}
 
-	// Search to monitor for changes
+	// Search to monitor for changes; a user search only needs the DNs
+	searchAttrs := []string{"*", "modifyTimestamp"}
+	if c.ldap.userFilter != "" {
+		searchAttrs = []string{"dn"}
+	}
 	searchRequest := ldap.NewSearchRequest(
 		c.ldap.baseDn,
-		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
-		fmt.Sprintf("(cn=%s)", c.ldap.group),
-		[]string{"*", "modifyTimestamp"},
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, c.ldap.sizeLimit, c.ldap.timeLimit, false,
+		c.ldap.filter,
+		searchAttrs,
 		nil,
 	)
 
 	lb := idp.NewLDAPProvider(conn, searchRequest)
-	sp := sp.NewSCIMProvider(c.scim.org, c.scim.token, c.scim.dryRun)
-	b := newBridge(lb, sp, db)
+	lb.UserSearch = c.ldap.userFilter != ""
+	lb.SizeLimit = c.ldap.sizeLimit
+	lb.TimeLimit = c.ldap.timeLimit
+	lb.Attributes = c.bridge.mapping.emailAttrs
+	if c.ldap.followReferrals {
+		lb.ReferralConn = func(addr string) (*ldap.Conn, error) {
+			referred := c.ldap
+			referred.addr = addr
+			conn, err := dialLDAP(referred)
+			if err != nil {
+				return nil, err
+			}
+			if err := bindLDAP(conn, c.ldap.bindMethod, c.ldap.referralBindDn, c.ldap.referralBindPw); err != nil {
+				conn.Close()
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	for _, attr := range []string{c.bridge.mapping.photoAttr, c.bridge.mapping.roleAttr} {
+		if attr != "" {
+			lb.Attributes = append(lb.Attributes, attr)
+		}
+	}
+	for _, t := range c.bridge.mapping.transformers {
+		lb.Attributes = append(lb.Attributes, t.attributes()...)
+	}
+	if attr := c.bridge.mapping.disabledAttr; attr != "" {
+		lb.Attributes = append(lb.Attributes, attr)
+		if c.bridge.disabledAction != "ignore" {
+			lb.DisabledFilter = disabledFilter(c.bridge.mapping)
+		}
+	}
+	if c.ldap.bindMethod == "anonymous" {
+		if err := checkAnonymousAccess(&lb, c.ldap); err != nil {
+			log.Fatal(err)
+		}
+	}
+	sp, err := sp.NewSCIMProvider(sp.Config{
+		Org:        c.scim.org,
+		Token:      c.scim.token,
+		DryRun:     c.scim.dryRun,
+		AuthMethod: c.scim.authMethod,
+		AuthHeader: c.scim.authHeader,
+		OAuth2:     c.scim.oauth2,
+		UserAgent:  c.scim.userAgent,
+		DryRunIDs:  c.scim.dryRunIDs,
+		Team:       c.scim.team,
+		TeamToken:  c.scim.teamToken,
+
+		BreakerThreshold: c.scim.breakerThreshold,
+		BreakerCooldown:  c.scim.breakerCooldown,
+
+		RateLimit: c.scim.rateLimit,
+
+		PageSize: c.scim.pageSize,
+
+		LogBodies:    c.scim.logBodies,
+		BodyRedactor: c.scim.bodyRedactor,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	b := newBridge(&lb, &sp, db, c.bridge)
+	if c.bridge.standby {
+		b.health.setRole("leader")
+	}
+
+	// summaries cover the startup sync as well as watched changes
+	go b.logs.summarize(time.Minute)
 
 	if err = b.Init(); err != nil {
 		log.Fatal(err)
 	}
 
-	if err = b.Sync(); err != nil {
+	if *reconcileUser != "" {
+		d, err := b.reconcileUser(context.Background(), *reconcileUser, *applyFlag)
+		if d.DN != "" {
+			d.print(*applyFlag && err == nil)
+		}
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
+	if err = b.validateMapping(); err != nil {
+		log.Fatal(err)
+	}
+
+	if b.isPaused() {
+		log.Printf("paused: skipping the startup sync until provisioning is resumed")
+	} else if err = b.Sync(); err != nil {
 		log.Fatal(err)
 	}
 
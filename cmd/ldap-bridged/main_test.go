@@ -0,0 +1,862 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/boltdb/bolt"
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/db"
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/idp"
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/sp"
+
+	scim "github.com/mtodd/scimtool"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// openTestDB returns a new database file, closed when t finishes.
+func openTestDB(t testing.TB) *bolt.DB {
+	t.Helper()
+
+	db, err := bolt.Open(filepath.Join(t.TempDir(), "bridge.db"), 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db
+}
+
+// testConfig is the default configuration, without the environment.
+func testConfig() bridgeConfig {
+	return bridgeConfig{
+		concurrency:     1,
+		prune:           true,
+		dbCheck:         "full",
+		disabledAction:  "suspend",
+		collisionAction: "skip",
+		mapping: mappingConfig{
+			emailAttrs:    []string{"mail"},
+			disabledAttr:  "description",
+			disabledValue: "disabled",
+		},
+	}
+}
+
+// newTestBridge returns an initialized bridge between p and s with a new
+// database.
+func newTestBridge(t testing.TB, p idp.Provider, s sp.Provider, cfg bridgeConfig) *bridge {
+	t.Helper()
+
+	b := newBridge(p, s, openTestDB(t), cfg)
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	return &b
+}
+
+// newDryRunSP returns the dry-run SP, which keeps users in memory.
+func newDryRunSP(t testing.TB) sp.Provider {
+	t.Helper()
+
+	p, err := sp.NewSCIMProvider(sp.Config{Org: "org", DryRun: true, DryRunIDs: "sequential"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &p
+}
+
+// fakeIDP is an idp.Provider serving canned entries: the users added with
+// addUser, and a single group, crew, whose members are set with setMembers.
+// Each of those modifies the entry at a later modifyTimestamp. Watch events
+// are scripted by sending DNs on its channels.
+type fakeIDP struct {
+	mu      sync.Mutex
+	entries map[string]*ldap.Entry
+	members []string
+	// clock is the number of modifications, and crewModified the one that
+	// last modified crew
+	clock, crewModified int
+
+	added, removed, disabled, enabled chan string
+}
+
+var _ idp.Provider = (*fakeIDP)(nil)
+
+func newFakeIDP() *fakeIDP {
+	return &fakeIDP{
+		entries:  make(map[string]*ldap.Entry),
+		added:    make(chan string),
+		removed:  make(chan string),
+		disabled: make(chan string),
+		enabled:  make(chan string),
+	}
+}
+
+// addUser adds an entry for uid, with attrs in addition to the defaults
+// derived from uid, and returns its DN.
+func (p *fakeIDP) addUser(uid string, attrs map[string][]string) string {
+	dn := fmt.Sprintf("uid=%s,ou=people,dc=planetexpress,dc=com", uid)
+	values := map[string][]string{
+		"uid":         {uid},
+		"givenName":   {uid},
+		"sn":          {uid},
+		"mail":        {uid + "@planetexpress.com"},
+		"description": {"active"},
+	}
+	for k, v := range attrs {
+		values[k] = v
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clock++
+	values["modifyTimestamp"] = []string{modifyTimestamp(p.clock)}
+	p.entries[dn] = ldap.NewEntry(dn, values)
+	return dn
+}
+
+// setMembers replaces the members of crew.
+func (p *fakeIDP) setMembers(dns ...string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.clock++
+	p.crewModified = p.clock
+	p.members = dns
+}
+
+// modifyTimestamp formats the nth modification as a GeneralizedTime.
+func modifyTimestamp(n int) string {
+	return fmt.Sprintf("20260101%06dZ", n)
+}
+
+func (p *fakeIDP) Start() error { return nil }
+func (p *fakeIDP) Stop()        {}
+
+func (p *fakeIDP) Changes() (added, removed <-chan string) {
+	return p.added, p.removed
+}
+
+func (p *fakeIDP) StatusChanges() (disabled, enabled <-chan string) {
+	return p.disabled, p.enabled
+}
+
+func (p *fakeIDP) Search(req *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return &ldap.SearchResult{Entries: []*ldap.Entry{p.crew()}}, nil
+}
+
+func (p *fakeIDP) crew() *ldap.Entry {
+	return ldap.NewEntry("cn=crew,ou=groups,dc=planetexpress,dc=com", map[string][]string{
+		"cn":              {"crew"},
+		"member":          append([]string(nil), p.members...),
+		"modifyTimestamp": {modifyTimestamp(p.crewModified)},
+	})
+}
+
+func (p *fakeIDP) SearchSince(ts string) (*ldap.SearchResult, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	res := &ldap.SearchResult{}
+	if crew := p.crew(); crew.GetAttributeValue("modifyTimestamp") > ts {
+		res.Entries = append(res.Entries, crew)
+	}
+	return res, nil
+}
+
+func (p *fakeIDP) UsersSince(ts string) ([]*ldap.Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := []*ldap.Entry{}
+	for _, entry := range p.entries {
+		if entry.GetAttributeValue("modifyTimestamp") > ts {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (p *fakeIDP) Fetch(dn string) (*ldap.Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry, ok := p.entries[dn]
+	if !ok {
+		return nil, fmt.Errorf("fetch failed: no such entry %s", dn)
+	}
+	return entry, nil
+}
+
+func (p *fakeIDP) FetchUID(uids ...string) ([]*ldap.Entry, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entries := []*ldap.Entry{}
+	for _, entry := range p.entries {
+		if entry.GetAttributeValue("uid") == uids[0] {
+			entries = append(entries, entry)
+		}
+	}
+	return entries, nil
+}
+
+func (p *fakeIDP) Users() ([]*ldap.Entry, error) {
+	return nil, nil
+}
+
+// recordingSP is an sp.Provider recording the users added and removed, and
+// the patches, as "add <userName>", "del <guid>", and "patch <guid>". The
+// patches themselves are kept in patches.
+type recordingSP struct {
+	sp.Provider
+
+	mu      sync.Mutex
+	calls   []string
+	patches []scim.PatchOp
+}
+
+func newRecordingSP(t *testing.T) *recordingSP {
+	return &recordingSP{Provider: newDryRunSP(t)}
+}
+
+func (r *recordingSP) record(call string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.calls = append(r.calls, call)
+}
+
+// take returns the calls recorded since the last take.
+func (r *recordingSP) take() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	calls := r.calls
+	r.calls = nil
+	return calls
+}
+
+func (r *recordingSP) Add(ctx context.Context, u scim.User) (string, error) {
+	r.record("add " + u.UserName)
+	return r.Provider.Add(ctx, u)
+}
+
+func (r *recordingSP) Del(ctx context.Context, guid string) error {
+	r.record("del " + guid)
+	return r.Provider.Del(ctx, guid)
+}
+
+func (r *recordingSP) Patch(ctx context.Context, guid, version string, op scim.PatchOp) error {
+	r.record("patch " + guid)
+	r.mu.Lock()
+	r.patches = append(r.patches, op)
+	r.mu.Unlock()
+	return r.Provider.Patch(ctx, guid, version, op)
+}
+
+// assertCalls fails t unless the calls recorded since the last take are
+// want, in order.
+func assertCalls(t *testing.T, r *recordingSP, want ...string) {
+	t.Helper()
+
+	got := r.take()
+	if len(got) != len(want) {
+		t.Errorf("SP calls = %q, want %q", got, want)
+		return
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			t.Errorf("SP calls = %q, want %q", got, want)
+			return
+		}
+	}
+}
+
+// guidOf returns the GUID the bridge store maps dn to.
+func guidOf(t *testing.T, b *bridge, dn string) string {
+	t.Helper()
+
+	guid, found, err := b.users.GetGUID(dn)
+	if err != nil || !found {
+		t.Fatalf("GetGUID(%s) = %t, %v", dn, found, err)
+	}
+	return guid
+}
+
+// eventually fails t unless cond becomes true within a few seconds.
+func eventually(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(15 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting until %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// spUser returns the user the SP has with userName.
+func spUser(t *testing.T, p sp.Provider, userName string) (scim.User, bool) {
+	t.Helper()
+
+	list, err := p.List(context.Background(), sp.ListOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range list {
+		if user.UserName == userName {
+			return user, true
+		}
+	}
+	return scim.User{}, false
+}
+
+// provisioned reports whether the SP has userName and the bridge store maps
+// dn to it.
+func provisioned(t *testing.T, b *bridge, dn, userName string) bool {
+	t.Helper()
+
+	user, onSP := spUser(t, b.sp, userName)
+	guid, mapped, err := b.users.GetGUID(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return onSP && mapped && guid == user.ID
+}
+
+// deprovisioned reports whether neither the SP nor the bridge store know dn,
+// whose userName is userName.
+func deprovisioned(t *testing.T, b *bridge, dn, userName string) bool {
+	t.Helper()
+
+	_, onSP := spUser(t, b.sp, userName)
+	_, mapped, err := b.users.GetGUID(dn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return !onSP && !mapped
+}
+
+func TestWatchedChanges(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	leela := p.addUser("leela", nil)
+	p.setMembers(fry)
+
+	b := newTestBridge(t, p, newDryRunSP(t), testConfig())
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	if !provisioned(t, b, fry, "fry") {
+		t.Fatalf("the startup sync didn't provision %s", fry)
+	}
+
+	go b.run()
+
+	p.setMembers(fry, leela)
+	p.added <- leela
+	eventually(t, "leela is provisioned", func() bool { return provisioned(t, b, leela, "leela") })
+
+	p.setMembers(leela)
+	p.removed <- fry
+	eventually(t, "fry is deprovisioned", func() bool { return deprovisioned(t, b, fry, "fry") })
+
+	p.disabled <- leela
+	eventually(t, "leela is suspended", func() bool {
+		user, ok := spUser(t, b.sp, "leela")
+		return ok && !user.Active
+	})
+
+	p.enabled <- leela
+	eventually(t, "leela is reactivated", func() bool {
+		user, ok := spUser(t, b.sp, "leela")
+		return ok && user.Active
+	})
+}
+
+func TestWatchedRemovalKeepsMembers(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	p.setMembers(fry)
+
+	b := newTestBridge(t, p, newDryRunSP(t), testConfig())
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	go b.run()
+
+	// a removal from one group leaves a member of another watched group
+	// provisioned; the next event is only received once it's been handled
+	p.removed <- fry
+	p.added <- fry
+	if !provisioned(t, b, fry, "fry") {
+		t.Errorf("a removal event deprovisioned %s, who is still a member", fry)
+	}
+}
+
+func TestSync(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	leela := p.addUser("leela", nil)
+	zoidberg := p.addUser("zoidberg", nil)
+	p.setMembers(fry, zoidberg)
+
+	r := newRecordingSP(t)
+	b := newTestBridge(t, p, r, testConfig())
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "add fry", "add zoidberg")
+
+	// members that left are removed before those that joined are added
+	p.setMembers(fry, leela)
+	gone := guidOf(t, b, zoidberg)
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "del "+gone, "add leela")
+	if !deprovisioned(t, b, zoidberg, "zoidberg") {
+		t.Errorf("%s is still provisioned", zoidberg)
+	}
+
+	// a sync with nothing to do changes nothing
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r)
+}
+
+func TestIncrementalSync(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	leela := p.addUser("leela", nil)
+	zoidberg := p.addUser("zoidberg", nil)
+	p.setMembers(fry, zoidberg)
+
+	cfg := testConfig()
+	cfg.incremental = true
+	r := newRecordingSP(t)
+	b := newTestBridge(t, p, r, cfg)
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "add fry", "add zoidberg")
+
+	// a member's entry changes without the group changing
+	p.addUser("fry", map[string][]string{"mail": {"philip.fry@planetexpress.com"}})
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "patch "+guidOf(t, b, fry))
+	if ops := r.patches[len(r.patches)-1].Operations; !strings.Contains(fmt.Sprint(ops), "philip.fry@planetexpress.com") {
+		t.Errorf("fry's patch = %+v, want it to add philip.fry@planetexpress.com", ops)
+	}
+	if stored, _, err := b.users.GetUser(guidOf(t, b, fry)); err != nil || len(stored.Emails) != 1 || stored.Emails[0].Value != "philip.fry@planetexpress.com" {
+		t.Errorf("fry's stored emails = %+v, %v; want philip.fry@planetexpress.com", stored.Emails, err)
+	}
+
+	// nothing changed since
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r)
+
+	// the group changes, so its members are diffed; leela's entry changed
+	// before, but she's only added
+	p.setMembers(fry, leela)
+	gone := guidOf(t, b, zoidberg)
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "del "+gone, "add leela")
+	if !deprovisioned(t, b, zoidberg, "zoidberg") {
+		t.Errorf("%s is still provisioned", zoidberg)
+	}
+	if !provisioned(t, b, leela, "leela") {
+		t.Errorf("%s isn't provisioned", leela)
+	}
+	// the SP's users are counted rather than listed
+	reports := b.syncs.list()
+	if report := reports[len(reports)-1]; report.SPBefore != 2 || report.SPAfter != 2 {
+		t.Errorf("sync report SP users = %d->%d, want 2->2", report.SPBefore, report.SPAfter)
+	}
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r)
+}
+
+// TestSyncComputesChanges checks the members Sync finds on the SP: those
+// still on it are left alone, however many there are, and only those missing
+// from it are re-added, under their new ID.
+func TestSyncComputesChanges(t *testing.T) {
+	p := newFakeIDP()
+	uids := []string{"amy", "bender", "fry", "hermes", "leela"}
+	var crew []string
+	for _, uid := range uids {
+		crew = append(crew, p.addUser(uid, nil))
+	}
+	zoidberg := p.addUser("zoidberg", nil)
+	p.setMembers(append(crew, zoidberg)...)
+
+	r := newRecordingSP(t)
+	b := newTestBridge(t, p, r, testConfig())
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	r.take()
+
+	// leela's SP user was removed behind the bridge's back, and zoidberg
+	// left the crew
+	if err := r.Provider.Del(context.Background(), guidOf(t, b, crew[4])); err != nil {
+		t.Fatal(err)
+	}
+	gone := guidOf(t, b, zoidberg)
+	p.setMembers(crew...)
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "del "+gone, "add leela")
+	for i, dn := range crew {
+		if !provisioned(t, b, dn, uids[i]) {
+			t.Errorf("%s isn't provisioned", dn)
+		}
+	}
+}
+
+func TestSyncWithoutPrune(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	leela := p.addUser("leela", nil)
+	p.setMembers(fry, leela)
+
+	r := newRecordingSP(t)
+	cfg := testConfig()
+	cfg.prune = false
+	b := newTestBridge(t, p, r, cfg)
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	r.take()
+
+	p.setMembers(fry)
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r)
+	if !provisioned(t, b, leela, "leela") {
+		t.Errorf("%s was removed with pruning disabled", leela)
+	}
+}
+
+func TestSyncConfirmsRemovalsOverLimit(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	leela := p.addUser("leela", nil)
+	zoidberg := p.addUser("zoidberg", nil)
+	p.setMembers(fry, leela, zoidberg)
+
+	r := newRecordingSP(t)
+	cfg := testConfig()
+	cfg.maxRemovals = 1
+	b := newTestBridge(t, p, r, cfg)
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	r.take()
+
+	// held back by the first sync that computes them...
+	p.setMembers(fry)
+	gone := []string{guidOf(t, b, leela), guidOf(t, b, zoidberg)}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r)
+
+	// ...and applied by the next, in DN order
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "del "+gone[0], "del "+gone[1])
+}
+
+func TestGroupFilterEscapes(t *testing.T) {
+	tests := []struct {
+		cn         string
+		groupTeams map[string]string
+		want       string
+	}{
+		{"idptool", nil, `(cn=idptool)`},
+		{"*)(cn=*", nil, `(cn=\2a\29\28cn=\2a)`},
+		{"a\\b\x00", nil, `(cn=a\5cb\00)`},
+		{"ignored", map[string]string{"eng": "eng", "ops*": "ops"}, `(|(cn=eng)(cn=ops\2a))`},
+	}
+
+	for _, tt := range tests {
+		if got := groupFilter(tt.cn, tt.groupTeams); got != tt.want {
+			t.Errorf("groupFilter(%q, %v) = %s, want %s", tt.cn, tt.groupTeams, got, tt.want)
+		}
+	}
+}
+
+func TestCollisionNormalizesExternalID(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", map[string][]string{"employeeNumber": {"0001"}})
+	p.setMembers(fry)
+
+	cfg := testConfig()
+	cfg.collisionAction = "external-id"
+	normalizer, err := parseUserNameNormalizer("lowercase")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.mapping.userName = normalizer
+	externalID, err := newExternalID("employeeNumber")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg.mapping.transformers = []transformer{externalID}
+
+	r := newRecordingSP(t)
+	b := newTestBridge(t, p, r, cfg)
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	r.take()
+
+	// Fry normalizes to fry's userName, so takes its externalId instead,
+	// normalized the same way
+	other := p.addUser("Fry", map[string][]string{"employeeNumber": {"Philip.Fry"}})
+	p.setMembers(fry, other)
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "add fry", "add philip.fry")
+	if !provisioned(t, b, other, "philip.fry") {
+		t.Errorf("%s isn't provisioned as philip.fry", other)
+	}
+}
+
+func TestReconcileDisabledUser(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	p.setMembers(fry)
+
+	cfg := testConfig()
+	cfg.disabledAction = "delete"
+	b := newTestBridge(t, p, newDryRunSP(t), cfg)
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	p.addUser("fry", map[string][]string{"description": {"disabled"}})
+	d, err := b.reconcileUser(context.Background(), "fry", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Action != "remove" {
+		t.Errorf("reconcileUser(fry) action = %s, want remove", d.Action)
+	}
+	// the reason names the setting, as it's configured
+	if len(d.Reasons) == 0 || d.Reasons[0] != "disabled in the directory, and SYNC_DISABLED_ACTION=delete" {
+		t.Errorf("reconcileUser(fry) reasons = %q", d.Reasons)
+	}
+}
+
+func TestSyncLeavesSPUsersMissingFromDirectory(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	p.setMembers(fry)
+
+	r := newRecordingSP(t)
+	b := newTestBridge(t, p, r, testConfig())
+
+	// nibbler is on the SP, unknown to the bridge store, and has no entry
+	// in the directory
+	if _, err := r.Provider.Add(context.Background(), scim.User{UserName: "nibbler"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+	assertCalls(t, r, "add fry")
+	if _, ok := spUser(t, r, "nibbler"); !ok {
+		t.Errorf("nibbler was removed from the SP")
+	}
+	if dns, err := b.users.GetMemberDNs(); err != nil || len(dns) != 1 || dns[0] != fry {
+		t.Errorf("GetMemberDNs() = %q, %v; want only %s", dns, err, fry)
+	}
+}
+
+func TestPauseSurvivesRestart(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	leela := p.addUser("leela", nil)
+	p.setMembers(fry)
+
+	db := openTestDB(t)
+	s := newDryRunSP(t)
+	b := newBridge(p, s, db, testConfig())
+	if err := b.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Sync(); err != nil {
+		t.Fatal(err)
+	}
+
+	b.setPaused(true)
+	p.setMembers(fry, leela)
+	b.apply(withTrigger(context.Background(), "watch"), "add", leela)
+
+	// the restarted bridge is still paused, with the change still queued
+	restarted := newBridge(p, s, db, testConfig())
+	if err := restarted.Init(); err != nil {
+		t.Fatal(err)
+	}
+	if !restarted.isPaused() {
+		t.Fatal("the bridge isn't paused after a restart")
+	}
+	if queued, err := restarted.users.Queued(); err != nil || len(queued) != 1 {
+		t.Fatalf("Queued() after a restart = %v, %v; want the add of %s", queued, err, leela)
+	}
+	if _, onSP := spUser(t, s, "leela"); onSP {
+		t.Fatalf("%s was provisioned while paused", leela)
+	}
+
+	// resuming runs the startup sync the restart skipped
+	restarted.setPaused(false)
+	if !provisioned(t, &restarted, leela, "leela") {
+		t.Errorf("%s isn't provisioned after resuming", leela)
+	}
+	if queued, err := restarted.users.Queued(); err != nil || len(queued) != 0 {
+		t.Errorf("Queued() after resuming = %v, %v; want none", queued, err)
+	}
+	if paused, err := restarted.users.GetPaused(); err != nil || paused {
+		t.Errorf("GetPaused() after resuming = %t, %v", paused, err)
+	}
+}
+
+func TestPauseHandlerDoesNotWaitForRun(t *testing.T) {
+	b := newTestBridge(t, newFakeIDP(), newDryRunSP(t), testConfig())
+
+	// nothing reads b.pause, as while the run loop applies a long sync
+	w := httptest.NewRecorder()
+	b.pauseHandler(true).ServeHTTP(w, httptest.NewRequest("POST", "/pause", nil))
+	if w.Code != http.StatusAccepted {
+		t.Errorf("POST /pause = %d, want %d", w.Code, http.StatusAccepted)
+	}
+	if paused := <-b.pause; !paused {
+		t.Errorf("POST /pause sent resume to the run loop")
+	}
+}
+
+// failingStore is a bridge store whose reads of pending deprovisions fail.
+type failingStore struct {
+	users.Store
+}
+
+func (failingStore) PendingDeprovisions() (map[string]time.Time, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestDebugHandlerStopsAtError(t *testing.T) {
+	b := newTestBridge(t, newFakeIDP(), newDryRunSP(t), testConfig())
+	b.users = failingStore{b.users}
+
+	w := httptest.NewRecorder()
+	b.ServeHTTP(w, httptest.NewRequest("GET", "/_debug", nil))
+	if w.Code != http.StatusInternalServerError || w.Body.String() != "oops: store unavailable" {
+		t.Errorf("GET /_debug = %d %q, want only the error", w.Code, w.Body.String())
+	}
+}
+
+// teamFailingSP is a recordingSP adding every user to a team, whose
+// membership calls all fail.
+type teamFailingSP struct {
+	*recordingSP
+}
+
+func (teamFailingSP) Team() string { return "planet-express" }
+
+func (teamFailingSP) AddTeamMember(ctx context.Context, team, login string) error {
+	return errors.New("team unavailable")
+}
+
+func (teamFailingSP) DelTeamMember(ctx context.Context, team, login string) error {
+	return errors.New("team unavailable")
+}
+
+func TestTeamErrorsDontFailProvisioning(t *testing.T) {
+	p := newFakeIDP()
+	fry := p.addUser("fry", nil)
+	p.setMembers(fry)
+
+	r := teamFailingSP{newRecordingSP(t)}
+	b := newTestBridge(t, p, r, testConfig())
+	ctx := context.Background()
+
+	if err := b.Add(ctx, fry); err != nil {
+		t.Errorf("Add(%s) = %v, want it provisioned despite its team", fry, err)
+	}
+	if !provisioned(t, b, fry, "fry") {
+		t.Fatalf("%s isn't provisioned", fry)
+	}
+
+	// as if the team add had succeeded before the team went away
+	if err := b.users.SetTeamMember("planet-express", fry, "fry"); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Del(ctx, fry); err != nil {
+		t.Errorf("Del(%s) = %v, want it deprovisioned despite its team", fry, err)
+	}
+	if !deprovisioned(t, b, fry, "fry") {
+		t.Errorf("%s isn't deprovisioned", fry)
+	}
+	if teams, err := b.users.GetTeams(fry); err != nil || len(teams) != 0 {
+		t.Errorf("GetTeams(%s) = %v, %v; want none", fry, teams, err)
+	}
+}
+
+// BenchmarkSync measures a sync of a 10k-member group that's already
+// provisioned, which is dominated by comparing the group to the bridge
+// store.
+func BenchmarkSync(b *testing.B) {
+	p := newFakeIDP()
+	members := make([]string, 10000)
+	for i := range members {
+		members[i] = p.addUser(fmt.Sprintf("crew%05d", i), nil)
+	}
+	p.setMembers(members...)
+
+	cfg := testConfig()
+	cfg.concurrency = 64
+	cfg.logSample = len(members)
+	br := newTestBridge(b, p, newDryRunSP(b), cfg)
+	if err := br.Sync(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := br.Sync(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	scim "github.com/mtodd/scimtool"
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/db"
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/sp"
+)
+
+// planSize is how many planned mutations a read-only bridge keeps.
+const planSize = 100
+
+// plannedChange is a mutation a read-only bridge would have made.
+type plannedChange struct {
+	Time   time.Time `json:"time"`
+	Action string    `json:"action"`
+	Target string    `json:"target"`
+}
+
+// plan records the most recent planned mutations, oldest first.
+type plan struct {
+	mu      sync.Mutex
+	changes []plannedChange
+}
+
+func (p *plan) add(action, target string) {
+	log.Printf("read-only: would %s %s", action, target)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.changes = append(p.changes, plannedChange{Time: time.Now(), Action: action, Target: target})
+	if len(p.changes) > planSize {
+		p.changes = p.changes[len(p.changes)-planSize:]
+	}
+}
+
+// list returns the planned mutations; nil-safe.
+func (p *plan) list() []plannedChange {
+	if p == nil {
+		return nil
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return append([]plannedChange(nil), p.changes...)
+}
+
+// readOnlyProvider passes reads through to the SP but only plans mutations,
+// reporting them as successful so reconciliation carries on as it would.
+type readOnlyProvider struct {
+	sp.Provider
+	plan *plan
+}
+
+func (p readOnlyProvider) Add(ctx context.Context, u scim.User) (string, error) {
+	p.plan.add("add", u.UserName)
+	return "", nil
+}
+
+func (p readOnlyProvider) Del(ctx context.Context, guid string) error {
+	p.plan.add("remove", guid)
+	return nil
+}
+
+func (p readOnlyProvider) Patch(ctx context.Context, guid, version string, op scim.PatchOp) error {
+	p.plan.add("patch", fmt.Sprintf("%s %+v", guid, op.Operations))
+	return nil
+}
+
+func (p readOnlyProvider) AddTeamMember(ctx context.Context, team, login string) error {
+	p.plan.add("add team member", team+"/"+login)
+	return nil
+}
+
+func (p readOnlyProvider) DelTeamMember(ctx context.Context, team, login string) error {
+	p.plan.add("remove team member", team+"/"+login)
+	return nil
+}
+
+// readOnlyStore reads from the bridge store but discards writes, since the
+// database is opened read-only.
+type readOnlyStore struct {
+	users.Store
+}
+
+func (readOnlyStore) Prepare() error                             { return nil }
+func (readOnlyStore) SetWatermark(ts string) error               { return nil }
+func (readOnlyStore) SetPendingRemovals(dns []string) error      { return nil }
+func (readOnlyStore) SetPaused(paused bool) error                { return nil }
+func (readOnlyStore) SetTombstone(dn string, at time.Time) error { return nil }
+func (readOnlyStore) DelTombstone(dn string) error               { return nil }
+func (readOnlyStore) Enqueue(action, dn string) error            { return nil }
+func (readOnlyStore) Dequeue(seq uint64) error                   { return nil }
+func (readOnlyStore) ClearQueue() error                          { return nil }
+func (readOnlyStore) Audit(rec users.AuditRecord) error          { return nil }
+func (readOnlyStore) PruneAudit(before time.Time) (int, error)   { return 0, nil }
+func (readOnlyStore) SetTeamMember(team, dn, login string) error { return nil }
+func (readOnlyStore) DelTeamMember(team, dn string) error        { return nil }
+func (readOnlyStore) SetUserName(dn, userName string) error      { return nil }
+func (readOnlyStore) Add(dn string, user scim.User) error        { return nil }
+func (readOnlyStore) Del(guid, dn string) error                  { return nil }
+
+func (readOnlyStore) SetPendingDeprovision(dn string, deadline time.Time) error { return nil }
+func (readOnlyStore) DelPendingDeprovision(dn string) error                     { return nil }
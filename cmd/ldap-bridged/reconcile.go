@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+
+	scim "github.com/mtodd/scimtool"
+	"github.com/mtodd/scimtool/cmd/ldap-bridged/internal/sp"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// decision is what reconciling a single user would do to bring the SP and
+// the bridge store in line with the directory, and why.
+type decision struct {
+	DN      string
+	Action  string // add, remove, relink, update, or none
+	Reasons []string
+
+	guid    string
+	version string
+	user    scim.User
+	patch   scim.PatchOp
+	changes []scim.AttributeChange
+	teams   []string
+}
+
+func (d *decision) reason(format string, args ...interface{}) {
+	d.Reasons = append(d.Reasons, fmt.Sprintf(format, args...))
+}
+
+// reconcileUser decides how to reconcile the user identified by a DN or a
+// uid, the way Sync and the watcher would, and applies the decision when
+// apply is set.
+func (b *bridge) reconcileUser(ctx context.Context, id string, apply bool) (decision, error) {
+	ctx = withTrigger(ctx, "reconcile")
+
+	entry, err := b.fetchUser(id)
+	if err != nil {
+		return decision{}, err
+	}
+
+	d, err := b.decide(ctx, entry)
+	if err != nil || !apply {
+		return d, err
+	}
+
+	return d, b.applyDecision(ctx, d)
+}
+
+// fetchUser fetches the entry for id, a DN when it has an attribute=value
+// pair and a uid otherwise.
+func (b *bridge) fetchUser(id string) (*ldap.Entry, error) {
+	if strings.Contains(id, "=") {
+		return b.idp.Fetch(id)
+	}
+
+	entries, err := b.idp.FetchUID(id)
+	if err != nil {
+		return nil, err
+	}
+	switch len(entries) {
+	case 0:
+		return nil, fmt.Errorf("no directory entry has uid %s", id)
+	case 1:
+		return entries[0], nil
+	default:
+		return nil, fmt.Errorf("%d directory entries have uid %s; pass a DN instead", len(entries), id)
+	}
+}
+
+// decide compares entry's group membership and mapped attributes with the
+// bridge store and the SP.
+func (b *bridge) decide(ctx context.Context, entry *ldap.Entry) (decision, error) {
+	d := decision{DN: entry.DN, Action: "none"}
+
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		return d, err
+	}
+	member := isMember(groupMembers(res.Entries), d.DN)
+
+	var provisioned bool
+	d.guid, provisioned, err = b.users.GetGUID(d.DN)
+	if err != nil {
+		return d, err
+	}
+
+	d.user, err = b.mapEntry(entry)
+	if err != nil {
+		return d, err
+	}
+
+	spList, err := b.sp.List(ctx, sp.ListOptions{})
+	if err != nil {
+		return d, err
+	}
+	cache := newSPCache(spList)
+	spUser, onSP := cache.byID[d.guid]
+	found, matched := cache.lookup(d.user)
+
+	switch {
+	case !member:
+		if !provisioned {
+			d.reason("not in a watched group and not provisioned by the bridge")
+			if matched {
+				d.reason("the SP has a matching user %s the bridge doesn't manage", found.ID)
+			}
+			return d, nil
+		}
+		d.Action = "remove"
+		d.reason("not in a watched group, but provisioned as %s", d.guid)
+		if !b.cfg.prune {
+			d.reason("pruning is disabled, so the startup sync only logs this removal")
+		}
+		return d, nil
+
+	case b.skipDisabled(entry):
+		d.reason("disabled in the directory, and SYNC_DISABLED_ACTION=delete")
+		if provisioned {
+			d.Action = "remove"
+			d.reason("provisioned as %s", d.guid)
+		}
+		return d, nil
+
+	case !provisioned && matched:
+		d.Action = "relink"
+		d.reason("in a watched group and provisioned as %s, but unknown to the bridge store", found.ID)
+		d.guid = found.ID
+		return d, nil
+
+	case !provisioned:
+		d.Action = "add"
+		d.reason("in a watched group and not provisioned")
+		return d, nil
+
+	case !onSP && matched:
+		d.Action = "relink"
+		d.reason("the bridge store maps it to %s, but the SP has it as %s", d.guid, found.ID)
+		d.guid = found.ID
+		return d, nil
+
+	case !onSP:
+		d.Action = "add"
+		d.reason("the bridge store maps it to %s, which the SP doesn't have", d.guid)
+		return d, nil
+	}
+
+	d.reason("in a watched group and provisioned as %s", d.guid)
+
+	desired := b.desiredUser(d.user, spUser)
+	d.patch, d.changes = scim.DiffChanges(spUser, desired)
+	// the patch is only right for the user as listed
+	d.version = spUser.Metadata.Version
+	for _, op := range d.patch.Operations {
+		d.reason("%s %s differs on the SP", op.Op, op.Path)
+	}
+	d.user = desired
+	changed := len(d.patch.Operations) > 0
+
+	if b.teamsEnabled() {
+		d.teams = b.teamsFor(res.Entries, d.DN)
+		current, err := b.users.GetTeams(d.DN)
+		if err != nil {
+			return d, err
+		}
+		for _, team := range d.teams {
+			if _, ok := current[team]; !ok {
+				d.reason("not yet added to team %s", team)
+				changed = true
+			}
+		}
+		for team := range current {
+			if !isMember(d.teams, team) {
+				d.reason("in team %s, which it no longer belongs in", team)
+				changed = true
+			}
+		}
+	}
+
+	if changed {
+		d.Action = "update"
+	} else {
+		d.reason("up to date")
+	}
+	return d, nil
+}
+
+// desiredUser is the mapped user as current, the provisioned user, should
+// become: only attributes the mapping sets are compared, and current keeps
+// the rest.
+func (b *bridge) desiredUser(mapped, current scim.User) scim.User {
+	desired := mapped.Clone()
+	desired.ID = current.ID
+	if desired.ExternalID == "" {
+		desired.ExternalID = current.ExternalID
+	}
+	if b.cfg.mapping.photoAttr == "" {
+		desired.Photos = current.Photos
+	}
+	if b.cfg.mapping.roleAttr == "" {
+		desired.Roles = current.Roles
+	}
+	desired.IMs = current.IMs
+	desired.Entitlements = current.Entitlements
+	if b.cfg.mapping.disabledAttr == "" || b.cfg.disabledAction == "ignore" {
+		desired.Active = current.Active
+	}
+	return desired
+}
+
+// applyDecision carries out d through the bridge's usual provisioning paths.
+func (b *bridge) applyDecision(ctx context.Context, d decision) error {
+	switch d.Action {
+	case "add":
+		// Add maps the DN to the new GUID; drop the old one's records
+		if guid, found, err := b.users.GetGUID(d.DN); err != nil {
+			return err
+		} else if found {
+			if err := b.users.Del(guid, d.DN); err != nil {
+				return err
+			}
+		}
+		return b.Add(ctx, d.DN)
+	case "remove":
+		return b.Del(ctx, d.DN)
+	case "relink":
+		if stale, found, err := b.users.GetGUID(d.DN); err != nil {
+			return err
+		} else if found {
+			if err := b.users.Del(stale, d.DN); err != nil {
+				return err
+			}
+		}
+		user := d.user.Clone()
+		user.ID = d.guid
+		return b.users.Add(d.DN, user)
+	case "update":
+		if len(d.patch.Operations) > 0 {
+			err := b.sp.Patch(ctx, d.guid, d.version, d.patch)
+			b.publish(ctx, "update", d.DN, d.guid, d.changes, err)
+			if err != nil {
+				return fmt.Errorf("patch %s: %s", d.DN, err)
+			}
+			if err := b.users.Add(d.DN, d.user); err != nil {
+				return err
+			}
+		}
+		if b.teamsEnabled() {
+			return b.syncTeams(ctx, d.DN, d.user.UserName, d.teams)
+		}
+	}
+	return nil
+}
+
+// print writes the decision for a person reading the terminal.
+func (d decision) print(applied bool) {
+	switch {
+	case d.Action == "none":
+		fmt.Printf("%s: no-op\n", d.DN)
+	case applied:
+		fmt.Printf("%s: %s (applied)\n", d.DN, d.Action)
+	default:
+		fmt.Printf("%s: would %s\n", d.DN, d.Action)
+	}
+	for _, reason := range d.Reasons {
+		fmt.Printf("  - %s\n", reason)
+	}
+}
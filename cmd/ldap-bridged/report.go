@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sync"
+	"time"
+)
+
+// syncReport summarizes a single sync: what it changed, how long it took,
+// and the directory and SP totals it saw.
+type syncReport struct {
+	mu sync.Mutex
+
+	Started  time.Time `json:"started"`
+	Duration string    `json:"duration"`
+
+	Added   int `json:"added"`
+	Removed int `json:"removed"`
+	Updated int `json:"updated"`
+	Skipped int `json:"skipped"`
+	Errored int `json:"errored"`
+
+	// Drift counts the adds and removes that corrected drift, a subset of
+	// Added and Removed.
+	Drift int `json:"drift"`
+
+	// SPAfter is derived from SPBefore and the adds and removes rather than
+	// re-listing the SP.
+	LDAPMembers int `json:"ldapMembers"`
+	SPBefore    int `json:"spBefore"`
+	SPAfter     int `json:"spAfter"`
+
+	Error string `json:"error,omitempty"`
+}
+
+// record counts the outcome of an action taken during the sync.
+func (r *syncReport) record(action string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err != nil {
+		r.Errored++
+		return
+	}
+	switch action {
+	case "add":
+		r.Added++
+	case "remove":
+		r.Removed++
+	default:
+		r.Updated++
+	}
+}
+
+func (r *syncReport) drifted() {
+	r.mu.Lock()
+	r.Drift++
+	r.mu.Unlock()
+}
+
+func (r *syncReport) skip(n int) {
+	r.mu.Lock()
+	r.Skipped += n
+	r.mu.Unlock()
+}
+
+// finish completes the report once the sync returns err.
+func (r *syncReport) finish(err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.Duration = time.Since(r.Started).String()
+	r.SPAfter = r.SPBefore + r.Added - r.Removed
+	if err != nil {
+		r.Error = err.Error()
+	}
+
+	log.Printf("sync: report: added=%d removed=%d updated=%d skipped=%d errored=%d drift=%d ldap=%d sp=%d->%d duration=%s",
+		r.Added, r.Removed, r.Updated, r.Skipped, r.Errored, r.Drift, r.LDAPMembers, r.SPBefore, r.SPAfter, r.Duration)
+}
+
+type reportKey struct{}
+
+func withReport(ctx context.Context, r *syncReport) context.Context {
+	return context.WithValue(ctx, reportKey{}, r)
+}
+
+// reportFrom returns the report of the sync running under ctx, or nil.
+func reportFrom(ctx context.Context) *syncReport {
+	r, _ := ctx.Value(reportKey{}).(*syncReport)
+	return r
+}
+
+// reportRing keeps the most recent sync reports, oldest first.
+type reportRing struct {
+	mu      sync.Mutex
+	size    int
+	reports []*syncReport
+}
+
+func newReportRing(size int) *reportRing {
+	return &reportRing{size: size}
+}
+
+func (r *reportRing) add(report *syncReport) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.reports = append(r.reports, report)
+	if len(r.reports) > r.size {
+		r.reports = r.reports[len(r.reports)-r.size:]
+	}
+}
+
+func (r *reportRing) list() []*syncReport {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]*syncReport(nil), r.reports...)
+}
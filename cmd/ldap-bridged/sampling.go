@@ -0,0 +1,91 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// sampler thins per-user logging during bulk provisioning. Only every Nth
+// add or remove logs its progress; failures are always logged, and counts of
+// every outcome are summarized periodically instead.
+type sampler struct {
+	every uint64
+	n     uint64
+
+	mu     sync.Mutex
+	counts map[string]*outcomes
+}
+
+type outcomes struct {
+	succeeded int
+	failed    int
+}
+
+func newSampler(every int) *sampler {
+	if every < 1 {
+		every = 1
+	}
+	return &sampler{
+		every:  uint64(every),
+		counts: make(map[string]*outcomes),
+	}
+}
+
+// sample reports whether the next operation should log its progress.
+func (s *sampler) sample() bool {
+	return s.every == 1 || atomic.AddUint64(&s.n, 1)%s.every == 1
+}
+
+// record counts the outcome of an operation for the next summary.
+func (s *sampler) record(action string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	o, ok := s.counts[action]
+	if !ok {
+		o = &outcomes{}
+		s.counts[action] = o
+	}
+	if err != nil {
+		o.failed++
+	} else {
+		o.succeeded++
+	}
+}
+
+// summarize logs and resets the counts every interval while sampling is
+// enabled.
+func (s *sampler) summarize(interval time.Duration) {
+	if s.every == 1 {
+		return
+	}
+
+	for range time.Tick(interval) {
+		s.mu.Lock()
+		counts := s.counts
+		s.counts = make(map[string]*outcomes)
+		s.mu.Unlock()
+
+		if len(counts) == 0 {
+			continue
+		}
+
+		actions := make([]string, 0, len(counts))
+		for action := range counts {
+			actions = append(actions, action)
+		}
+		sort.Strings(actions)
+
+		parts := make([]string, 0, len(actions))
+		for _, action := range actions {
+			o := counts[action]
+			parts = append(parts, fmt.Sprintf("%s %d succeeded, %d failed", action, o.succeeded, o.failed))
+		}
+		log.Printf("summary: last %s: %s", interval, strings.Join(parts, "; "))
+	}
+}
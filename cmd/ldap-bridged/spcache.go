@@ -0,0 +1,47 @@
+package main
+
+import (
+	"strings"
+
+	scim "github.com/mtodd/scimtool"
+)
+
+// spCache indexes the SP user list fetched at the start of a sync so
+// members can be looked up without rescanning the list or calling the SP
+// again. It's only valid for the sync that built it.
+type spCache struct {
+	byID         map[string]scim.User
+	byUserName   map[string]scim.User
+	byExternalID map[string]scim.User
+}
+
+func newSPCache(list []scim.User) *spCache {
+	c := &spCache{
+		byID:         make(map[string]scim.User, len(list)),
+		byUserName:   make(map[string]scim.User, len(list)),
+		byExternalID: make(map[string]scim.User, len(list)),
+	}
+	for _, u := range list {
+		c.byID[u.ID] = u
+		if u.UserName != "" {
+			// userNames are case-insensitive
+			c.byUserName[strings.ToLower(u.UserName)] = u
+		}
+		if u.ExternalID != "" {
+			c.byExternalID[u.ExternalID] = u
+		}
+	}
+	return c
+}
+
+// lookup finds the SP user matching u by externalId, falling back to
+// userName.
+func (c *spCache) lookup(u scim.User) (scim.User, bool) {
+	if u.ExternalID != "" {
+		if found, ok := c.byExternalID[u.ExternalID]; ok {
+			return found, true
+		}
+	}
+	found, ok := c.byUserName[strings.ToLower(u.UserName)]
+	return found, ok
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	scim "github.com/mtodd/scimtool"
+	ldap "gopkg.in/ldap.v2"
+)
+
+// transformer reshapes a user after mapEntry maps it and before it's
+// provisioned, so operators can adjust users without changing mapEntry.
+type transformer interface {
+	// transform modifies user, which was mapped from entry.
+	transform(entry *ldap.Entry, user *scim.User) error
+
+	// attributes are the LDAP attributes transform reads, fetched for each
+	// user in addition to the mapped ones.
+	attributes() []string
+}
+
+// transformerFunc is a transformer that reads no additional attributes.
+type transformerFunc func(entry *ldap.Entry, user *scim.User) error
+
+func (f transformerFunc) transform(entry *ldap.Entry, user *scim.User) error {
+	return f(entry, user)
+}
+
+func (f transformerFunc) attributes() []string { return nil }
+
+// transformers are the built-in transformers by name. Each is built from the
+// argument following its name in MAP_TRANSFORMERS, e.g. the "example.com" of
+// "domain-email:example.com", which is empty when none is given.
+var transformers = map[string]func(arg string) (transformer, error){
+	"lowercase-username": func(arg string) (transformer, error) {
+		return transformerFunc(func(entry *ldap.Entry, user *scim.User) error {
+			user.UserName = strings.ToLower(user.UserName)
+			return nil
+		}), nil
+	},
+	"lowercase-email": func(arg string) (transformer, error) {
+		return transformerFunc(func(entry *ldap.Entry, user *scim.User) error {
+			for i := range user.Emails {
+				user.Emails[i].Value = strings.ToLower(user.Emails[i].Value)
+			}
+			return nil
+		}), nil
+	},
+	"domain-email": newDomainEmail,
+	"external-id":  newExternalID,
+}
+
+// newDomainEmail appends "@" and the domain to email addresses without one,
+// and gives users without any email the address userName@domain.
+func newDomainEmail(domain string) (transformer, error) {
+	domain = strings.TrimPrefix(domain, "@")
+	if domain == "" {
+		return nil, fmt.Errorf("expected a domain, e.g. domain-email:example.com")
+	}
+
+	return transformerFunc(func(entry *ldap.Entry, user *scim.User) error {
+		for i, email := range user.Emails {
+			if !strings.Contains(email.Value, "@") {
+				user.Emails[i].Value = email.Value + "@" + domain
+			}
+		}
+		if len(user.Emails) == 0 && user.UserName != "" {
+			user.Emails = []scim.Email{{
+				Value:   user.UserName + "@" + domain,
+				Type:    "work",
+				Primary: true,
+			}}
+		}
+		return nil
+	}), nil
+}
+
+// externalID sets the externalId to the values of one or more attributes
+// joined with ":", e.g. external-id:o+employeeNumber.
+type externalID struct {
+	attrs []string
+}
+
+func newExternalID(arg string) (transformer, error) {
+	if arg == "" {
+		return nil, fmt.Errorf("expected attributes, e.g. external-id:o+employeeNumber")
+	}
+	return externalID{attrs: strings.Split(arg, "+")}, nil
+}
+
+func (t externalID) transform(entry *ldap.Entry, user *scim.User) error {
+	values := make([]string, len(t.attrs))
+	for i, attr := range t.attrs {
+		values[i] = entry.GetAttributeValue(attr)
+		if values[i] == "" {
+			return fmt.Errorf("external-id: %s has no %s", entry.DN, attr)
+		}
+	}
+	user.ExternalID = strings.Join(values, ":")
+	return nil
+}
+
+func (t externalID) attributes() []string { return t.attrs }
+
+// parseTransformers builds the chain of transformers named in a
+// comma-separated list like "lowercase-username,domain-email:example.com".
+func parseTransformers(s string) ([]transformer, error) {
+	var chain []transformer
+	for _, spec := range strings.Split(s, ",") {
+		name, arg := spec, ""
+		if i := strings.Index(spec, ":"); i >= 0 {
+			name, arg = spec[:i], spec[i+1:]
+		}
+
+		build, ok := transformers[strings.TrimSpace(name)]
+		if !ok {
+			return nil, fmt.Errorf("unknown transformer %q; expected one of %s", name, strings.Join(transformerNames(), ", "))
+		}
+		t, err := build(strings.TrimSpace(arg))
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", name, err)
+		}
+		chain = append(chain, t)
+	}
+	return chain, nil
+}
+
+func transformerNames() []string {
+	names := make([]string, 0, len(transformers))
+	for name := range transformers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
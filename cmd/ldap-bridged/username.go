@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// userNameNormalizer rewrites the uid mapped to a user's userName for SCIM
+// servers that restrict it, such as GitHub's, which rejects spaces. The steps
+// always run in the same order, whatever order they're configured in: the
+// domain is stripped, the name lowercased, and then invalid characters are
+// stripped or replaced.
+type userNameNormalizer struct {
+	stripDomain bool
+	lowercase   bool
+
+	// invalid is what each run of invalid characters becomes: "" strips
+	// them, and invalid characters are left alone when keepInvalid.
+	invalid     string
+	keepInvalid bool
+}
+
+// validUserNameChars are the characters normalized userNames are limited to,
+// besides ASCII letters and digits.
+const validUserNameChars = "._-@"
+
+// parseUserNameNormalizer builds a normalizer from a comma-separated list of
+// steps like "strip-domain,lowercase,replace-invalid:_".
+func parseUserNameNormalizer(s string) (*userNameNormalizer, error) {
+	n := &userNameNormalizer{keepInvalid: true}
+	for _, spec := range strings.Split(s, ",") {
+		name, arg := strings.TrimSpace(spec), ""
+		if i := strings.Index(name, ":"); i >= 0 {
+			name, arg = name[:i], name[i+1:]
+		}
+
+		switch name {
+		case "strip-domain":
+			n.stripDomain = true
+		case "lowercase":
+			n.lowercase = true
+		case "strip-invalid", "replace-invalid":
+			if !n.keepInvalid {
+				return nil, fmt.Errorf("strip-invalid and replace-invalid can only be given once, and not together")
+			}
+			n.keepInvalid = false
+			if name == "replace-invalid" {
+				n.invalid = arg
+				if n.invalid == "" {
+					n.invalid = "-"
+				}
+				if strings.IndexFunc(n.invalid, func(r rune) bool { return !validUserNameChar(r) }) >= 0 {
+					return nil, fmt.Errorf("replace-invalid: the replacement %q has characters outside letters, digits, and %s", n.invalid, validUserNameChars)
+				}
+			}
+		default:
+			return nil, fmt.Errorf("unknown step %q; expected strip-domain, lowercase, strip-invalid, or replace-invalid", name)
+		}
+	}
+	return n, nil
+}
+
+// normalize returns the normalized userName for uid, e.g. "alice.smith" for
+// "Alice Smith@corp.example.com" with every step and replace-invalid:".".
+func (n *userNameNormalizer) normalize(uid string) (string, error) {
+	name := uid
+	if n.stripDomain {
+		// user@domain, as in an AD userPrincipalName, or DOMAIN\user
+		if i := strings.LastIndex(name, "@"); i >= 0 {
+			name = name[:i]
+		}
+		if i := strings.LastIndex(name, `\`); i >= 0 {
+			name = name[i+1:]
+		}
+	}
+	if n.lowercase {
+		name = strings.ToLower(name)
+	}
+	if !n.keepInvalid {
+		name = n.replaceInvalid(name)
+	}
+
+	if name == "" {
+		return "", fmt.Errorf("userName %q is empty once normalized", uid)
+	}
+	return name, nil
+}
+
+// replaceInvalid replaces each run of invalid characters in name, dropping
+// replacements at either end.
+func (n *userNameNormalizer) replaceInvalid(name string) string {
+	var b strings.Builder
+	replaced := false
+	for _, r := range name {
+		if validUserNameChar(r) {
+			if replaced && b.Len() > 0 {
+				b.WriteString(n.invalid)
+			}
+			replaced = false
+			b.WriteRune(r)
+		} else {
+			replaced = true
+		}
+	}
+	return b.String()
+}
+
+func validUserNameChar(r rune) bool {
+	return r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' ||
+		strings.ContainsRune(validUserNameChars, r)
+}
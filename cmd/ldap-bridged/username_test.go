@@ -0,0 +1,58 @@
+package main
+
+import "testing"
+
+func TestNormalizeUserName(t *testing.T) {
+	tests := []struct {
+		steps string
+		uid   string
+		want  string // "" when the uid normalizes to nothing
+	}{
+		{"strip-domain", "alice@corp.example.com", "alice"},
+		{"strip-domain", `CORP\alice`, "alice"},
+		{"strip-domain", "Alice Smith", "Alice Smith"},
+		{"lowercase", "Alice.Smith", "alice.smith"},
+		{"strip-invalid", "alice smith", "alicesmith"},
+		{"strip-invalid", "josé_o'brien", "jos_obrien"},
+		{"replace-invalid", "alice smith", "alice-smith"},
+		{"replace-invalid:_", " alice  smith!", "alice_smith"},
+		{"replace-invalid:.", "alice@example.com", "alice@example.com"},
+		{"strip-domain,lowercase,replace-invalid:.", "Alice Smith@corp.example.com", "alice.smith"},
+
+		// the steps run in the same order however they're listed
+		{"replace-invalid:.,lowercase,strip-domain", "Alice Smith@corp.example.com", "alice.smith"},
+
+		{"strip-invalid", "!!!", ""},
+		{"strip-domain", "@corp.example.com", ""},
+	}
+
+	for _, tt := range tests {
+		n, err := parseUserNameNormalizer(tt.steps)
+		if err != nil {
+			t.Errorf("parseUserNameNormalizer(%q): %s", tt.steps, err)
+			continue
+		}
+
+		got, err := n.normalize(tt.uid)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%s: normalize(%q) = %q, want an error", tt.steps, tt.uid, got)
+		case tt.want != "" && (err != nil || got != tt.want):
+			t.Errorf("%s: normalize(%q) = %q, %v; want %q", tt.steps, tt.uid, got, err, tt.want)
+		}
+	}
+}
+
+func TestParseUserNameNormalizerErrors(t *testing.T) {
+	for _, steps := range []string{
+		"uppercase",
+		"lowercase,",
+		"strip-invalid,replace-invalid",
+		"strip-invalid,strip-invalid",
+		"replace-invalid:*",
+	} {
+		if _, err := parseUserNameNormalizer(steps); err == nil {
+			t.Errorf("parseUserNameNormalizer(%q) succeeded, want an error", steps)
+		}
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// mappedAttr is an LDAP attribute the mapping reads, and the setting that
+// maps it.
+type mappedAttr struct {
+	name    string
+	setting string
+}
+
+// mappedAttrs returns the LDAP attributes every user is expected to have a
+// value for. The disabled attribute is left out, since it's often only set
+// on disabled accounts.
+func (b *bridge) mappedAttrs() []mappedAttr {
+	m := b.cfg.mapping
+
+	attrs := []mappedAttr{
+		{"uid", "userName"},
+		{"givenName", "name.givenName"},
+		{"sn", "name.familyName"},
+	}
+	for _, attr := range m.emailAttrs {
+		attrs = append(attrs, mappedAttr{attr, "MAP_EMAIL_ATTRS"})
+	}
+	if m.photoAttr != "" {
+		attrs = append(attrs, mappedAttr{m.photoAttr, "MAP_PHOTO_ATTR"})
+	}
+	if m.roleAttr != "" {
+		attrs = append(attrs, mappedAttr{m.roleAttr, "MAP_ROLE_ATTR"})
+	}
+	for _, t := range m.transformers {
+		for _, attr := range t.attributes() {
+			attrs = append(attrs, mappedAttr{attr, "MAP_TRANSFORMERS"})
+		}
+	}
+
+	return attrs
+}
+
+// validateMapping fetches a sample of the watched groups' members, spread
+// across the groups, and warns about each mapped attribute none of them has
+// a value for, which is usually a typo that would provision users with empty
+// fields. With -strict-mapping, any such attribute fails validation.
+func (b *bridge) validateMapping() error {
+	if b.cfg.mappingSample == 0 {
+		return nil
+	}
+
+	res, err := b.idp.Search(nil)
+	if err != nil {
+		return err
+	}
+	members := groupMembers(res.Entries)
+	if len(members) == 0 {
+		log.Printf("mapping: no members to validate the mapping against")
+		return nil
+	}
+
+	step := 1
+	if len(members) > b.cfg.mappingSample {
+		step = len(members) / b.cfg.mappingSample
+	}
+
+	var entries []*ldap.Entry
+	for i := 0; i < len(members) && len(entries) < b.cfg.mappingSample; i += step {
+		entry, err := b.idp.Fetch(members[i])
+		if err != nil {
+			log.Printf("mapping: %s", err)
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	if len(entries) == 0 {
+		return fmt.Errorf("mapping: couldn't fetch any of the sampled members")
+	}
+
+	var empty []string
+	for _, attr := range b.mappedAttrs() {
+		if !anyHasValue(entries, attr.name) {
+			log.Printf("mapping: warning: none of %d sampled members has a value for %s (%s)", len(entries), attr.name, attr.setting)
+			empty = append(empty, attr.name)
+		}
+	}
+
+	if len(empty) > 0 && b.cfg.strictMapping {
+		return fmt.Errorf("mapping: %s empty for every sampled member; fix the mapping, or start without -strict-mapping", strings.Join(empty, ", "))
+	}
+	if len(empty) == 0 {
+		log.Printf("mapping: every mapped attribute has values in %d sampled members", len(entries))
+	}
+	return nil
+}
+
+func anyHasValue(entries []*ldap.Entry, attr string) bool {
+	for _, entry := range entries {
+		for _, value := range entry.GetRawAttributeValues(attr) {
+			if len(strings.TrimSpace(string(value))) > 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
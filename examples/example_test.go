@@ -0,0 +1,44 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/mtodd/ldapwatch"
+
+	ldap "gopkg.in/ldap.v2"
+)
+
+// Example_newWatcher shows the connection-injecting ldapwatch API the bridge
+// and this example use: dial and bind first, then hand the connection to
+// NewWatcher. It's compiled by go vet and go test, so a change to the
+// signature breaks the build here rather than only in the docs.
+func Example_newWatcher() {
+	conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer conn.Close()
+
+	if err := conn.Bind(bindusername, bindpassword); err != nil {
+		log.Fatal(err)
+	}
+
+	watcher, err := ldapwatch.NewWatcher(conn, 1*time.Second, nil)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	searchRequest := ldap.NewSearchRequest(
+		base,
+		ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false,
+		fmt.Sprintf("(uid=%s)", ldap.EscapeFilter(username)),
+		[]string{"dn"},
+		nil,
+	)
+	watcher.Add(searchRequest, &entryCountChecker{})
+
+	defer watcher.Stop()
+	go watcher.Start()
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"fmt"
 	"log"
+	"time"
 
 	"github.com/mtodd/ldapwatch"
 
@@ -21,17 +22,72 @@ var (
 	host = "localhost"
 	port = 3899 // 389
 
-	watcher *ldapwatch.Watcher
+	// reconnect backoff bounds
+	minBackoff = 1 * time.Second
+	maxBackoff = 1 * time.Minute
+
+	// how often the connection is probed for liveness
+	probeInterval = 5 * time.Second
 )
 
+// connect dials and binds, retrying with exponential backoff until both
+// succeed.
+func connect() *ldap.Conn {
+	backoff := minBackoff
+
+	for {
+		conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
+		if err == nil {
+			if err = conn.Bind(bindusername, bindpassword); err == nil {
+				return conn
+			}
+			conn.Close()
+		}
+
+		log.Printf("connect: %s; retrying in %s", err, backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// probe blocks until the connection stops answering a base search, which is
+// how a dropped connection is detected.
+func probe(conn *ldap.Conn) {
+	req := ldap.NewSearchRequest(
+		base,
+		ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false,
+		"(objectClass=*)",
+		[]string{"dn"},
+		nil,
+	)
+
+	for {
+		time.Sleep(probeInterval)
+
+		if _, err := conn.Search(req); ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+			log.Printf("connection lost: %s", err)
+			return
+		}
+	}
+}
+
 func main() {
-	conn, err := ldap.Dial("tcp", fmt.Sprintf("%s:%d", host, port))
-	if err != nil {
-		log.Fatal(err)
+	// redial, rebind, and re-add the search whenever the connection drops
+	for {
+		conn := connect()
+		watch(conn)
+		conn.Close()
 	}
-	conn.Bind(bindusername, bindpassword)
+}
 
-	watcher, err := ldapwatch.NewWatcher(conn)
+// watch registers the search on a new watcher and runs it until the
+// connection is lost.
+func watch(conn *ldap.Conn) {
+	watcher, err := ldapwatch.NewWatcher(conn, 1*time.Second, nil)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -46,37 +102,42 @@ func main() {
 		nil,
 	)
 
-	updates := make(chan ldapwatch.Result)
-	go func(c chan ldapwatch.Result) {
-		for result := range c {
-			log.Println(fmt.Sprintf("updated %#v", result))
-		}
-	}(updates)
+	// err = watcher.Add("uid=defunkt,ou=users,dc=github,dc=com")
+	watcher.Add(searchRequest, &entryCountChecker{})
 
-	compare := func(prev ldapwatch.Result, next ldapwatch.Result) bool {
-		// no previous results (initial search)
-		if (ldapwatch.Result{}) == prev {
-			log.Println("prev is nil")
-			return true
-		}
+	defer watcher.Stop()
+	go watcher.Start()
 
-		// check length differences
-		if len(prev.Results.Entries) != len(next.Results.Entries) {
-			log.Println("entry count does not match")
-			return true
-		}
+	probe(conn)
+}
 
-		return false
-	}
+// Implements the ldapwatch.Checker interface, logging whenever the number of
+// entries returned by the search changes.
+type entryCountChecker struct {
+	prev *ldap.SearchResult
+}
 
-	// err = watcher.Add("uid=defunkt,ou=users,dc=github,dc=com")
-	err = watcher.Add(searchRequest, compare, updates)
+// Check receives the result of each search run by the watcher.
+func (c *entryCountChecker) Check(r *ldap.SearchResult, err error) {
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("%s", err)
+		return
 	}
 
-	defer watcher.Stop()
-	watcher.Start()
+	// no previous results (initial search)
+	if c.prev == nil {
+		log.Println("prev is nil")
+		c.prev = r
+		return
+	}
+
+	// check length differences
+	if len(c.prev.Entries) != len(r.Entries) {
+		log.Println("entry count does not match")
+		log.Println(fmt.Sprintf("updated %#v", r))
+	}
+
+	c.prev = r
 }
 
 func other() {
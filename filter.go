@@ -0,0 +1,525 @@
+package scim
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Filter is a parsed SCIM filter expression (RFC 7644, section 3.4.2.2)
+// that can be evaluated against users locally, for servers that ignore or
+// don't support filtering.
+//
+//	userName sw "a" and (emails[type eq "work"] or not (active eq true))
+//
+// Attribute names and string comparisons are case-insensitive.
+type Filter struct {
+	root expr
+}
+
+// ParseFilter parses a SCIM filter expression.
+func ParseFilter(s string) (*Filter, error) {
+	tokens, err := lexFilter(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p := filterParser{tokens: tokens}
+	root, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.tokens) {
+		return nil, fmt.Errorf("filter: unexpected %q", p.tokens[p.pos].text)
+	}
+
+	return &Filter{root: root}, nil
+}
+
+// Match reports whether u matches the filter.
+func (f *Filter) Match(u User) bool {
+	buf, err := json.Marshal(u)
+	if err != nil {
+		return false
+	}
+
+	var obj map[string]interface{}
+	if err := json.Unmarshal(buf, &obj); err != nil {
+		return false
+	}
+
+	return f.root.match(obj)
+}
+
+// FilterBuilder composes a SCIM filter from comparisons joined by "and",
+// the reverse of ParseFilter, so callers needn't quote values themselves.
+// The zero value is an empty filter.
+type FilterBuilder struct {
+	terms []filterTerm
+}
+
+type filterTerm struct {
+	text string
+	// grouped terms are parenthesized when joined with others
+	grouped bool
+}
+
+// Eq adds the comparison `attr eq value`, where value is a string, a
+// boolean, or a number.
+func (b *FilterBuilder) Eq(attr string, value interface{}) *FilterBuilder {
+	b.terms = append(b.terms, filterTerm{text: attr + " eq " + filterValue(value)})
+	return b
+}
+
+// Expr adds filter, a filter expression as written. It's parenthesized when
+// joined with other terms, so an "or" in it doesn't bind to them.
+func (b *FilterBuilder) Expr(filter string) *FilterBuilder {
+	if filter = strings.TrimSpace(filter); filter != "" {
+		b.terms = append(b.terms, filterTerm{text: filter, grouped: true})
+	}
+	return b
+}
+
+// String returns the filter, or "" when no terms were added.
+func (b *FilterBuilder) String() string {
+	if len(b.terms) == 1 {
+		return b.terms[0].text
+	}
+
+	parts := make([]string, len(b.terms))
+	for i, t := range b.terms {
+		if t.grouped {
+			parts[i] = "(" + t.text + ")"
+		} else {
+			parts[i] = t.text
+		}
+	}
+	return strings.Join(parts, " and ")
+}
+
+// filterValue writes v as a filter value: strings as JSON strings, which is
+// how lexFilter reads them, and other values as JSON literals.
+func filterValue(v interface{}) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	// filters travel in URLs, not HTML
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return "null"
+	}
+	return strings.TrimSuffix(buf.String(), "\n")
+}
+
+type expr interface {
+	match(obj map[string]interface{}) bool
+}
+
+type logicalExpr struct {
+	and         bool
+	left, right expr
+}
+
+func (e logicalExpr) match(obj map[string]interface{}) bool {
+	if e.and {
+		return e.left.match(obj) && e.right.match(obj)
+	}
+	return e.left.match(obj) || e.right.match(obj)
+}
+
+type notExpr struct {
+	e expr
+}
+
+func (e notExpr) match(obj map[string]interface{}) bool {
+	return !e.e.match(obj)
+}
+
+// valuePathExpr matches when any value of a multi-valued attribute matches
+// the bracketed filter, e.g. emails[type eq "work"].
+type valuePathExpr struct {
+	path   []string
+	filter expr
+}
+
+func (e valuePathExpr) match(obj map[string]interface{}) bool {
+	for _, v := range resolve(obj, e.path, false) {
+		if elem, ok := v.(map[string]interface{}); ok && e.filter.match(elem) {
+			return true
+		}
+	}
+	return false
+}
+
+// attrExpr compares an attribute with a value, or tests its presence.
+type attrExpr struct {
+	path  []string
+	op    string
+	value interface{}
+}
+
+func (e attrExpr) match(obj map[string]interface{}) bool {
+	values := resolve(obj, e.path, e.op != "pr")
+	if absent(values) {
+		// an absent attribute equals null and no other value (RFC 7644,
+		// section 3.4.2.2)
+		switch e.op {
+		case "eq":
+			return e.value == nil
+		case "ne":
+			return e.value != nil
+		}
+		return false
+	}
+
+	for _, v := range values {
+		if e.op == "pr" {
+			if v != nil && v != "" {
+				return true
+			}
+			continue
+		}
+		if compare(v, e.op, e.value) {
+			return true
+		}
+	}
+	return false
+}
+
+// absent reports whether values, resolved from an attribute path, hold no
+// value at all.
+func absent(values []interface{}) bool {
+	for _, v := range values {
+		if v != nil {
+			return false
+		}
+	}
+	return true
+}
+
+// resolve returns the values at path in obj. Multi-valued attributes yield
+// each of their values; with simple set, a complex value stands for its
+// "value" sub-attribute, as in emails eq "alice@example.com".
+func resolve(obj map[string]interface{}, path []string, simple bool) []interface{} {
+	current := []interface{}{obj}
+	for _, name := range path {
+		var next []interface{}
+		for _, v := range current {
+			m, ok := v.(map[string]interface{})
+			if !ok {
+				continue
+			}
+			next = append(next, flatten(lookup(m, name))...)
+		}
+		current = next
+	}
+
+	if simple {
+		for i, v := range current {
+			if m, ok := v.(map[string]interface{}); ok {
+				current[i] = lookup(m, "value")
+			}
+		}
+	}
+
+	return current
+}
+
+func flatten(v interface{}) []interface{} {
+	if list, ok := v.([]interface{}); ok {
+		return list
+	}
+	if v == nil {
+		return nil
+	}
+	return []interface{}{v}
+}
+
+// lookup finds the attribute name in m, ignoring case.
+func lookup(m map[string]interface{}, name string) interface{} {
+	if v, ok := m[name]; ok {
+		return v
+	}
+	for k, v := range m {
+		if strings.EqualFold(k, name) {
+			return v
+		}
+	}
+	return nil
+}
+
+func compare(v interface{}, op string, want interface{}) bool {
+	switch w := want.(type) {
+	case nil:
+		switch op {
+		case "eq":
+			return v == nil
+		case "ne":
+			return v != nil
+		}
+		return false
+	case bool:
+		b, ok := v.(bool)
+		switch op {
+		case "eq":
+			return ok && b == w
+		case "ne":
+			return !ok || b != w
+		}
+		return false
+	case float64:
+		n, ok := v.(float64)
+		if !ok {
+			return op == "ne"
+		}
+		return compareOrdered(op, n < w, n == w)
+	case string:
+		s, ok := v.(string)
+		if !ok {
+			return op == "ne"
+		}
+		s, w = strings.ToLower(s), strings.ToLower(w)
+		switch op {
+		case "co":
+			return strings.Contains(s, w)
+		case "sw":
+			return strings.HasPrefix(s, w)
+		case "ew":
+			return strings.HasSuffix(s, w)
+		}
+		return compareOrdered(op, s < w, s == w)
+	}
+	return false
+}
+
+func compareOrdered(op string, less, equal bool) bool {
+	switch op {
+	case "eq":
+		return equal
+	case "ne":
+		return !equal
+	case "gt":
+		return !less && !equal
+	case "ge":
+		return !less
+	case "lt":
+		return less
+	case "le":
+		return less || equal
+	}
+	return false
+}
+
+var compareOps = map[string]bool{
+	"eq": true, "ne": true, "co": true, "sw": true, "ew": true,
+	"gt": true, "ge": true, "lt": true, "le": true,
+}
+
+type filterToken struct {
+	text   string
+	quoted bool
+}
+
+// lexFilter splits s into words, quoted strings, and the characters ( ) [ ].
+func lexFilter(s string) ([]filterToken, error) {
+	var tokens []filterToken
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == ' ' || c == '\t' || c == '\n':
+			i++
+		case strings.IndexByte("()[]", c) >= 0:
+			tokens = append(tokens, filterToken{text: string(c)})
+			i++
+		case c == '"':
+			j := i + 1
+			for ; j < len(s) && s[j] != '"'; j++ {
+				if s[j] == '\\' {
+					j++
+				}
+			}
+			if j >= len(s) {
+				return nil, fmt.Errorf("filter: unterminated string at %d", i)
+			}
+			var str string
+			if err := json.Unmarshal([]byte(s[i:j+1]), &str); err != nil {
+				return nil, fmt.Errorf("filter: invalid string %s: %s", s[i:j+1], err)
+			}
+			tokens = append(tokens, filterToken{text: str, quoted: true})
+			i = j + 1
+		default:
+			j := i
+			for j < len(s) && !unicode.IsSpace(rune(s[j])) && strings.IndexByte("()[]\"", s[j]) < 0 {
+				j++
+			}
+			tokens = append(tokens, filterToken{text: s[i:j]})
+			i = j
+		}
+	}
+	return tokens, nil
+}
+
+type filterParser struct {
+	tokens []filterToken
+	pos    int
+}
+
+func (p *filterParser) peek() (filterToken, bool) {
+	if p.pos >= len(p.tokens) {
+		return filterToken{}, false
+	}
+	return p.tokens[p.pos], true
+}
+
+// keyword consumes the next token if it's the unquoted word kw.
+func (p *filterParser) keyword(kw string) bool {
+	t, ok := p.peek()
+	if ok && !t.quoted && strings.EqualFold(t.text, kw) {
+		p.pos++
+		return true
+	}
+	return false
+}
+
+func (p *filterParser) expect(text string) error {
+	if !p.keyword(text) {
+		if t, ok := p.peek(); ok {
+			return fmt.Errorf("filter: expected %q, found %q", text, t.text)
+		}
+		return fmt.Errorf("filter: expected %q at end of filter", text)
+	}
+	return nil
+}
+
+func (p *filterParser) parseOr() (expr, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("or") {
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseAnd() (expr, error) {
+	left, err := p.parseUnary()
+	if err != nil {
+		return nil, err
+	}
+	for p.keyword("and") {
+		right, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		left = logicalExpr{and: true, left: left, right: right}
+	}
+	return left, nil
+}
+
+func (p *filterParser) parseUnary() (expr, error) {
+	if p.keyword("not") {
+		e, err := p.parseGroup()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{e}, nil
+	}
+	if t, ok := p.peek(); ok && !t.quoted && t.text == "(" {
+		return p.parseGroup()
+	}
+	return p.parseAttr()
+}
+
+func (p *filterParser) parseGroup() (expr, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if err := p.expect(")"); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+func (p *filterParser) parseAttr() (expr, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("filter: expected an attribute at end of filter")
+	}
+	if t.quoted || strings.IndexByte("()[]", t.text[0]) >= 0 {
+		return nil, fmt.Errorf("filter: expected an attribute, found %q", t.text)
+	}
+	p.pos++
+	path := attrPath(t.text)
+
+	if p.keyword("[") {
+		e, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if err := p.expect("]"); err != nil {
+			return nil, err
+		}
+		return valuePathExpr{path: path, filter: e}, nil
+	}
+
+	if p.keyword("pr") {
+		return attrExpr{path: path, op: "pr"}, nil
+	}
+
+	opToken, ok := p.peek()
+	op := strings.ToLower(opToken.text)
+	if !ok || opToken.quoted || !compareOps[op] {
+		return nil, fmt.Errorf("filter: expected an operator after %q", t.text)
+	}
+	p.pos++
+
+	value, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	return attrExpr{path: path, op: op, value: value}, nil
+}
+
+// attrPath splits an attribute path into its names, dropping the core User
+// schema URN prefix.
+func attrPath(s string) []string {
+	if len(s) > len(UserSchema) && strings.EqualFold(s[:len(UserSchema)+1], UserSchema+":") {
+		s = s[len(UserSchema)+1:]
+	}
+	return strings.Split(s, ".")
+}
+
+func (p *filterParser) parseValue() (interface{}, error) {
+	t, ok := p.peek()
+	if !ok {
+		return nil, fmt.Errorf("filter: expected a value at end of filter")
+	}
+	p.pos++
+
+	if t.quoted {
+		return t.text, nil
+	}
+	switch strings.ToLower(t.text) {
+	case "true":
+		return true, nil
+	case "false":
+		return false, nil
+	case "null":
+		return nil, nil
+	}
+	if n, err := strconv.ParseFloat(t.text, 64); err == nil {
+		return n, nil
+	}
+	return nil, fmt.Errorf("filter: invalid value %q", t.text)
+}
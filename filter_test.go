@@ -0,0 +1,197 @@
+package scim
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFilterMatch(t *testing.T) {
+	u := testUser()
+	u.Name.GivenName = `Alice "Al" O\Brien`
+
+	tests := []struct {
+		filter string
+		want   bool
+	}{
+		{`userName eq "alice"`, true},
+		{`userName eq "ALICE"`, true},
+		{`USERNAME eq "alice"`, true},
+		{`urn:ietf:params:scim:schemas:core:2.0:User:userName eq "alice"`, true},
+		{`userName EQ "alice"`, true},
+		{`userName eq "bob"`, false},
+		{`userName ne "bob"`, true},
+		{`userName ne "alice"`, false},
+
+		// sw, ew, co
+		{`userName sw "al"`, true},
+		{`userName sw "ce"`, false},
+		{`userName ew "ce"`, true},
+		{`userName ew "al"`, false},
+		{`userName co "lic"`, true},
+		{`userName co "bob"`, false},
+		{`emails co "@example.com"`, true},
+
+		// ordering
+		{`userName gt "a"`, true},
+		{`userName ge "alice"`, true},
+		{`userName lt "alice"`, false},
+		{`userName le "alice"`, true},
+
+		// pr
+		{`userName pr`, true},
+		{`name.familyName pr`, true},
+		{`externalId pr`, false},
+		{`nickName pr`, false},
+
+		// absent attributes equal null and no other value
+		{`externalId eq "a1"`, false},
+		{`externalId ne "a1"`, true},
+		{`externalId eq null`, true},
+		{`externalId ne null`, false},
+		{`externalId sw "a"`, false},
+		{`externalId gt "a"`, false},
+		{`userName eq null`, false},
+		{`userName ne null`, true},
+		{`emails[display ne "work"]`, true},
+
+		// booleans
+		{`active eq true`, true},
+		{`active eq false`, false},
+		{`active ne false`, true},
+
+		// quoted strings with escapes
+		{`name.givenName eq "Alice \"Al\" O\\Brien"`, true},
+		{`name.givenName co "\"al\""`, true},
+		{`userName eq "and"`, false},
+
+		// sub-attributes and value paths
+		{`NAME.FAMILYNAME eq "example"`, true},
+		{`emails.type eq "work"`, true},
+		{`emails[type eq "work" and value ew "@example.com"]`, true},
+		{`emails[type eq "home"]`, false},
+		{`emails[TYPE eq "work"]`, true},
+
+		// and, or, not
+		{`userName eq "alice" and active eq true`, true},
+		{`userName eq "alice" and active eq false`, false},
+		{`userName eq "bob" or active eq true`, true},
+		{`userName eq "bob" or active eq false`, false},
+		{`not (userName eq "bob")`, true},
+		{`not (userName eq "alice")`, false},
+		{`userName eq "alice" AND NOT (active eq false)`, true},
+
+		// and binds tighter than or
+		{`userName eq "bob" and active eq true or userName eq "alice"`, true},
+		{`userName eq "alice" or userName eq "bob" and active eq false`, true},
+		{`(userName eq "alice" or userName eq "bob") and active eq false`, false},
+		{`userName eq "bob" and (active eq true or userName eq "alice")`, false},
+	}
+
+	for _, tt := range tests {
+		f, err := ParseFilter(tt.filter)
+		if err != nil {
+			t.Errorf("ParseFilter(%s) = %s", tt.filter, err)
+			continue
+		}
+		if got := f.Match(u); got != tt.want {
+			t.Errorf("ParseFilter(%s).Match(alice) = %t, want %t", tt.filter, got, tt.want)
+		}
+	}
+}
+
+func TestParseFilterErrors(t *testing.T) {
+	tests := []struct {
+		filter string
+		want   string
+	}{
+		{``, `filter: expected an attribute at end of filter`},
+		{`userName`, `filter: expected an operator after "userName"`},
+		{`userName eq`, `filter: expected a value at end of filter`},
+		{`userName is "alice"`, `filter: expected an operator after "userName"`},
+		{`userName eq alice`, `filter: invalid value "alice"`},
+		{`userName eq "alice`, `filter: unterminated string at 12`},
+		{`userName eq "alice\"`, `filter: unterminated string at 12`},
+		{`userName eq "\q"`, `filter: invalid string "\q": `},
+		{`"userName" eq "alice"`, `filter: expected an attribute, found "userName"`},
+		{`userName eq "alice" and`, `filter: expected an attribute at end of filter`},
+		{`userName eq "alice" active eq true`, `filter: unexpected "active"`},
+		{`(userName eq "alice"`, `filter: expected ")" at end of filter`},
+		{`userName eq "alice")`, `filter: unexpected ")"`},
+		{`not userName eq "alice"`, `filter: expected "(", found "userName"`},
+		{`emails[type eq "work"`, `filter: expected "]" at end of filter`},
+		{`) eq "alice"`, `filter: expected an attribute, found ")"`},
+	}
+
+	for _, tt := range tests {
+		_, err := ParseFilter(tt.filter)
+		if err == nil {
+			t.Errorf("ParseFilter(%s) succeeded, want %s", tt.filter, tt.want)
+			continue
+		}
+		// the reason an invalid string is invalid depends on the JSON decoder
+		if !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("ParseFilter(%s) = %s, want %s", tt.filter, err, tt.want)
+		}
+	}
+}
+
+func TestFilterBuilder(t *testing.T) {
+	tests := []struct {
+		build func(b *FilterBuilder)
+		want  string
+	}{
+		{func(b *FilterBuilder) {}, ``},
+		{func(b *FilterBuilder) { b.Eq("userName", "alice") }, `userName eq "alice"`},
+		{func(b *FilterBuilder) { b.Eq("active", true) }, `active eq true`},
+		{func(b *FilterBuilder) { b.Eq("userName", `Alice "Al" O\Brien`) }, `userName eq "Alice \"Al\" O\\Brien"`},
+		{func(b *FilterBuilder) { b.Eq("userName", "a<b>&c") }, `userName eq "a<b>&c"`},
+		{func(b *FilterBuilder) { b.Eq("userName", "alice").Eq("active", false) }, `userName eq "alice" and active eq false`},
+		{
+			func(b *FilterBuilder) { b.Eq("active", true).Expr(` userName eq "alice" or userName eq "bob" `) },
+			`active eq true and (userName eq "alice" or userName eq "bob")`,
+		},
+		{func(b *FilterBuilder) { b.Expr(`userName eq "alice" or userName eq "bob"`) }, `userName eq "alice" or userName eq "bob"`},
+		{func(b *FilterBuilder) { b.Expr(" ").Eq("userName", "alice") }, `userName eq "alice"`},
+	}
+
+	for _, tt := range tests {
+		var b FilterBuilder
+		tt.build(&b)
+		if got := b.String(); got != tt.want {
+			t.Errorf("FilterBuilder = %s, want %s", got, tt.want)
+		}
+	}
+}
+
+// TestFilterBuilderRoundTrips parses built filters back, so a value is
+// matched as given however it's quoted.
+func TestFilterBuilderRoundTrips(t *testing.T) {
+	for _, userName := range []string{
+		"alice",
+		`Alice "Al" O\Brien`,
+		`\"`,
+		"and",
+		"alice) or (userName pr",
+		"tab\tnewline\n",
+		"ünïcödé",
+	} {
+		u := testUser()
+		u.UserName = userName
+
+		var b FilterBuilder
+		b.Eq("userName", userName).Eq("active", true)
+		f, err := ParseFilter(b.String())
+		if err != nil {
+			t.Errorf("ParseFilter(%s) = %s", b.String(), err)
+			continue
+		}
+		if !f.Match(u) {
+			t.Errorf("ParseFilter(%s) doesn't match userName %q", b.String(), userName)
+		}
+
+		u.UserName = userName + "x"
+		if f.Match(u) {
+			t.Errorf("ParseFilter(%s) matches userName %q", b.String(), u.UserName)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package scim
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Validate checks p against the PatchOp schema: it must declare
+// PatchOpSchema and carry at least one operation, each op must be "add",
+// "remove", or "replace", remove operations need a path, and add and replace
+// operations need a value.
+func (p PatchOp) Validate() error {
+	if !containsString(p.Schemas, PatchOpSchema) {
+		return fmt.Errorf("patch: schemas must include %s", PatchOpSchema)
+	}
+
+	if len(p.Operations) == 0 {
+		return fmt.Errorf("patch: no Operations")
+	}
+
+	for i, op := range p.Operations {
+		switch strings.ToLower(op.Op) {
+		case "add", "replace":
+			if op.Value == nil {
+				return fmt.Errorf("patch: operation %d (%s): value is required", i, op.Op)
+			}
+		case "remove":
+			if op.Path == "" {
+				return fmt.Errorf("patch: operation %d (remove): path is required", i)
+			}
+		default:
+			return fmt.Errorf("patch: operation %d: unknown op %q: expected add, remove, or replace", i, op.Op)
+		}
+	}
+
+	return nil
+}
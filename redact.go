@@ -0,0 +1,165 @@
+package scim
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+// redactedValue replaces redacted fields that aren't hashed.
+const redactedValue = "[redacted]"
+
+// RedactableFields are the user fields a Redactor can hide.
+var RedactableFields = []string{"email", "name", "userName", "externalId"}
+
+// Redactor hides personal data in users shown on operational surfaces, such
+// as debug pages and exports, so shared dumps and screenshots don't leak it.
+// Fields are replaced with "[redacted]", or with a short hash of their value
+// so the same value can still be recognized across records. A nil Redactor
+// leaves users unchanged.
+type Redactor struct {
+	fields map[string]bool
+	hash   bool
+}
+
+// NewRedactor returns a Redactor for the comma-separated fields, drawn from
+// RedactableFields, or nil when fields is empty.
+func NewRedactor(fields string, hash bool) (*Redactor, error) {
+	if fields == "" {
+		return nil, nil
+	}
+
+	r := &Redactor{fields: make(map[string]bool), hash: hash}
+	for _, field := range strings.Split(fields, ",") {
+		field = strings.TrimSpace(field)
+		if !containsString(RedactableFields, field) {
+			return nil, fmt.Errorf("unknown field %q: expected one of %s", field, strings.Join(RedactableFields, ", "))
+		}
+		r.fields[field] = true
+	}
+
+	return r, nil
+}
+
+// Redact returns a copy of u with the configured fields hidden.
+func (r *Redactor) Redact(u User) User {
+	if r == nil {
+		return u
+	}
+
+	u = u.Clone()
+	if r.fields["email"] {
+		for i := range u.Emails {
+			u.Emails[i].Value = r.value(u.Emails[i].Value)
+		}
+	}
+	if r.fields["name"] {
+		u.Name.GivenName = r.value(u.Name.GivenName)
+		u.Name.FamilyName = r.value(u.Name.FamilyName)
+	}
+	if r.fields["userName"] {
+		u.UserName = r.value(u.UserName)
+	}
+	if r.fields["externalId"] {
+		u.ExternalID = r.value(u.ExternalID)
+	}
+
+	return u
+}
+
+func (r *Redactor) value(v string) string {
+	if v == "" {
+		return v
+	}
+	if r.hash {
+		return fmt.Sprintf("sha256:%x", sha256.Sum256([]byte(v)))[:19]
+	}
+	return redactedValue
+}
+
+// RedactJSON returns a copy of a JSON body, such as a SCIM request or
+// response, with the configured fields hidden wherever they appear: in users,
+// in the Resources of list responses, and in the values of PatchOp operations
+// whose path names them. A body that isn't JSON can't be scrubbed, so it's
+// replaced whole.
+func (r *Redactor) RedactJSON(body []byte) []byte {
+	if r == nil || len(body) == 0 {
+		return body
+	}
+
+	var v interface{}
+	if err := json.Unmarshal(body, &v); err != nil {
+		return []byte(fmt.Sprintf("[%d bytes, not JSON, redacted]", len(body)))
+	}
+
+	buf, err := json.Marshal(r.redactJSONValue(v))
+	if err != nil {
+		return []byte(redactedValue)
+	}
+	return buf
+}
+
+// redactJSONValue hides the configured fields in a decoded JSON value.
+func (r *Redactor) redactJSONValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case []interface{}:
+		for i := range v {
+			v[i] = r.redactJSONValue(v[i])
+		}
+	case map[string]interface{}:
+		// a PatchOp operation
+		if path, ok := v["path"].(string); ok && r.fields[jsonField(path)] {
+			if value, ok := v["value"]; ok {
+				v["value"] = r.redactAll(value)
+			}
+		}
+		for k, value := range v {
+			if r.fields[jsonField(k)] {
+				v[k] = r.redactAll(value)
+			} else {
+				v[k] = r.redactJSONValue(value)
+			}
+		}
+	}
+	return v
+}
+
+// redactAll hides every string in v but the type of multi-valued attributes,
+// such as an email's "work".
+func (r *Redactor) redactAll(v interface{}) interface{} {
+	switch v := v.(type) {
+	case string:
+		return r.value(v)
+	case []interface{}:
+		for i := range v {
+			v[i] = r.redactAll(v[i])
+		}
+	case map[string]interface{}:
+		for k, value := range v {
+			if k != "type" {
+				v[k] = r.redactAll(value)
+			}
+		}
+	}
+	return v
+}
+
+// jsonField returns the redactable field a JSON attribute name or PatchOp
+// path refers to, or "". Attribute names are case-insensitive.
+func jsonField(path string) string {
+	if i := strings.IndexAny(path, ".["); i >= 0 {
+		path = path[:i]
+	}
+	switch strings.ToLower(path) {
+	case "emails":
+		return "email"
+	case "name":
+		return "name"
+	case "username":
+		return "userName"
+	case "externalid":
+		return "externalId"
+	}
+	return ""
+}
@@ -0,0 +1,34 @@
+package scim
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strings"
+)
+
+// ReadSecretFile reads a credential such as a token or password from path,
+// trimming surrounding whitespace. It warns when the file is readable by
+// other users.
+func ReadSecretFile(path string) (string, error) {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return "", err
+	}
+	if fi.Mode().Perm()&0004 != 0 {
+		log.Printf("warning: %s is world-readable; restrict it with chmod 600", path)
+	}
+
+	buf, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	secret := strings.TrimSpace(string(buf))
+	if secret == "" {
+		return "", fmt.Errorf("%s is empty", path)
+	}
+
+	return secret, nil
+}
@@ -0,0 +1,66 @@
+package scim
+
+// ServiceProviderConfigSchema is the schema reference for the
+// ServiceProviderConfig type.
+const ServiceProviderConfigSchema = "urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"
+
+// ServiceProviderConfig maps to the parts of the "ServiceProviderConfig"
+// (urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig) SCIM type
+// that clients act on.
+//
+//	{
+//	  "schemas":["urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"],
+//	  "filter":{"supported":true,"maxResults":100},
+//	  ...
+//	}
+type ServiceProviderConfig struct {
+	Schemas []string      `json:"schemas"`
+	Filter  FilterSupport `json:"filter"`
+}
+
+// FilterSupport maps to the "filter" attribute of a ServiceProviderConfig.
+// MaxResults is the most resources the server returns in one response.
+type FilterSupport struct {
+	Supported  bool `json:"supported"`
+	MaxResults int  `json:"maxResults"`
+}
+
+// PageSize returns the count to request per page: want, clamped to the
+// server's max. Either is 0 when unset; a result of 0 means count shouldn't
+// be sent, leaving the page size to the server.
+func PageSize(want, max int) int {
+	if max > 0 && (want == 0 || want > max) {
+		return max
+	}
+	return want
+}
+
+// CappedPageSize returns the page size a server used when the page starting
+// at startIndex has fewer resources than the requested count while more
+// remain, i.e. the server silently capped it, or 0 when it wasn't capped.
+func CappedPageSize(count, startIndex int, page ListResponse) int {
+	n := len(page.Resources)
+	if count <= 0 || n == 0 || n >= count || startIndex+n > page.TotalResults {
+		return 0
+	}
+	return n
+}
+
+// MorePages reports whether users remain after page, which began at
+// startIndex. totalResults decides unless it contradicts the users already
+// returned, as on servers that report 0; then only a full page, of at least
+// size users, means another may follow. size is the count requested per
+// page, or the size of the first page when none was.
+func MorePages(startIndex, size int, page ListResponse) bool {
+	n := len(page.Resources)
+	next := startIndex + n
+	switch {
+	case n == 0:
+		return false
+	case page.TotalResults >= next:
+		return true
+	case page.TotalResults == next-1:
+		return false
+	}
+	return size > 0 && n >= size
+}
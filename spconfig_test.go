@@ -0,0 +1,36 @@
+package scim
+
+import "testing"
+
+func TestMorePages(t *testing.T) {
+	page := func(totalResults, n int) ListResponse {
+		return ListResponse{TotalResults: totalResults, Resources: make([]User, n)}
+	}
+
+	tests := []struct {
+		name       string
+		startIndex int
+		size       int
+		page       ListResponse
+		want       bool
+	}{
+		{"more than returned", 1, 2, page(5, 2), true},
+		{"last page", 5, 2, page(5, 1), false},
+		{"exactly the last page", 4, 2, page(5, 2), false},
+		{"empty page", 1, 2, page(5, 0), false},
+
+		// a server reporting 0 while returning users: only a full page means
+		// another may follow
+		{"no total, full page", 1, 2, page(0, 2), true},
+		{"no total, later full page", 3, 2, page(0, 2), true},
+		{"no total, short page", 3, 2, page(0, 1), false},
+		{"no total, no size", 1, 0, page(0, 2), false},
+		{"no total, empty page", 1, 2, page(0, 0), false},
+	}
+
+	for _, tt := range tests {
+		if got := MorePages(tt.startIndex, tt.size, tt.page); got != tt.want {
+			t.Errorf("%s: MorePages(%d, %d, %d of %d) = %t, want %t", tt.name, tt.startIndex, tt.size, len(tt.page.Resources), tt.page.TotalResults, got, tt.want)
+		}
+	}
+}
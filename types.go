@@ -14,7 +14,7 @@ type ListResponse struct {
 	TotalResults int      `json:"totalResults"`
 	ItemsPerPage int      `json:"itemsPerPage"`
 	StartIndex   int      `json:"startIndex"`
-	Resources    []User
+	Resources    []User   `json:"Resources"`
 }
 
 // UserSchema is the schema reference for the User type.
@@ -38,9 +38,14 @@ type User struct {
 	ExternalID string   `json:"externalId,omitempty"`
 	UserName   string   `json:"userName"`
 	Name       Name     `json:"name"`
-	Emails     []Email  `json:"emails"`
-	Active     bool     `json:"active,omitempty"`
+	Emails     []Email  `json:"emails,omitempty"`
+	Active     bool     `json:"active"`
 	Metadata   Metadata `json:"meta,omitempty"`
+
+	Photos       []MultiValue `json:"photos,omitempty"`
+	IMs          []MultiValue `json:"ims,omitempty"`
+	Entitlements []MultiValue `json:"entitlements,omitempty"`
+	Roles        []MultiValue `json:"roles,omitempty"`
 }
 
 // Email maps to the "emails" array of objects.
@@ -56,6 +61,22 @@ type Email struct {
 	Primary bool   `json:"primary,omitempty"`
 }
 
+// MultiValue maps to an entry of the "photos", "ims", "entitlements", and
+// "roles" arrays of objects.
+//
+// {
+//   "value":"https://photos.example.com/alice.jpg",
+//   "type":"photo",
+//   "primary":true,
+//   "display":"Alice"
+// }
+type MultiValue struct {
+	Value   string `json:"value"`
+	Type    string `json:"type,omitempty"`
+	Primary bool   `json:"primary,omitempty"`
+	Display string `json:"display,omitempty"`
+}
+
 // Name maps to the "name" object.
 //
 // {
@@ -73,11 +94,41 @@ type Name struct {
 //   "resourceType":"User",
 //   "created":"2018-01-25T14:35:31-05:00",
 //   "lastModified":"2018-01-25T14:35:31-05:00",
-//   "location":"https://api.github.com/scim/v2/organizations/GH4B/Users/e7818cf4-0206-11e8-8526-afbcdd6f73fd"
+//   "location":"https://api.github.com/scim/v2/organizations/GH4B/Users/e7818cf4-0206-11e8-8526-afbcdd6f73fd",
+//   "version":"W/\"a330bc54f0671c9\""
 // }
 type Metadata struct {
 	ResourceType string `json:"resourceType"`
 	Created      string `json:"created"`
 	LastModified string `json:"lastModified"`
 	Location     string `json:"location"`
+	Version      string `json:"version,omitempty"`
+}
+
+// PatchOpSchema is the schema reference for the PatchOp message.
+const PatchOpSchema = "urn:ietf:params:scim:api:messages:2.0:PatchOp"
+
+// PatchOp maps to the "PatchOp"
+// (urn:ietf:params:scim:api:messages:2.0:PatchOp) SCIM message.
+//
+// { "schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],
+//   "Operations":[
+//     {"op":"replace","path":"active","value":false}
+//   ]
+// }
+type PatchOp struct {
+	Schemas    []string    `json:"schemas"`
+	Operations []Operation `json:"Operations"`
+}
+
+// Operation maps to a single entry of the PatchOp "Operations" array.
+//
+// {
+//   "op":"remove",
+//   "path":"emails[value eq \"alice@example.com\"]"
+// }
+type Operation struct {
+	Op    string      `json:"op"`
+	Path  string      `json:"path,omitempty"`
+	Value interface{} `json:"value,omitempty"`
 }
@@ -0,0 +1,105 @@
+package scim
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func TestJSONRoundTrip(t *testing.T) {
+	meta := Metadata{
+		ResourceType: "User",
+		Created:      "2018-01-25T14:35:31-05:00",
+		LastModified: "2018-01-25T14:35:31-05:00",
+		Location:     "https://api.github.com/scim/v2/organizations/GH4B/Users/1",
+		Version:      `W/"a330bc54f0671c9"`,
+	}
+	user := testUser()
+	user.ExternalID = "alice"
+	user.Metadata = meta
+
+	tests := []struct {
+		name  string
+		value interface{}
+		wire  string
+	}{
+		{"User", user, `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"id":"1","externalId":"alice","userName":"alice","name":{"givenName":"Alice","familyName":"Example"},"emails":[{"value":"alice@example.com","type":"work","primary":true}],"active":true,"photos":[{"value":"https://photos.example.com/alice.jpg","type":"photo"}],"ims":[{"value":"alice","type":"xmpp"}],"entitlements":[{"value":"admin"}],"roles":[{"value":"eng","display":"eng"}],"meta":{"resourceType":"User","created":"2018-01-25T14:35:31-05:00","lastModified":"2018-01-25T14:35:31-05:00","location":"https://api.github.com/scim/v2/organizations/GH4B/Users/1","version":"W/\"a330bc54f0671c9\""}}`},
+		{"ListResponse", ListResponse{
+			Schemas:      []string{"urn:ietf:params:scim:api:messages:2.0:ListResponse"},
+			TotalResults: 1,
+			ItemsPerPage: 1,
+			StartIndex:   1,
+			Resources:    []User{{Schemas: []string{UserSchema}, ID: "1", UserName: "alice", Active: true}},
+		}, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:ListResponse"],"totalResults":1,"itemsPerPage":1,"startIndex":1,"Resources":[{"schemas":["urn:ietf:params:scim:schemas:core:2.0:User"],"id":"1","userName":"alice","name":{"givenName":"","familyName":""},"active":true}]}`},
+		{"Email", Email{Value: "alice@example.com", Type: "work", Primary: true}, `{"value":"alice@example.com","type":"work","primary":true}`},
+		{"MultiValue", MultiValue{Value: "eng", Type: "role", Primary: true, Display: "Engineering"}, `{"value":"eng","type":"role","primary":true,"display":"Engineering"}`},
+		{"Name", Name{GivenName: "Alice", FamilyName: "Example"}, `{"givenName":"Alice","familyName":"Example"}`},
+		{"Metadata", meta, `{"resourceType":"User","created":"2018-01-25T14:35:31-05:00","lastModified":"2018-01-25T14:35:31-05:00","location":"https://api.github.com/scim/v2/organizations/GH4B/Users/1","version":"W/\"a330bc54f0671c9\""}`},
+		{"PatchOp", PatchOp{
+			Schemas: []string{PatchOpSchema},
+			Operations: []Operation{
+				{Op: "replace", Path: "active", Value: false},
+				{Op: "remove", Path: `emails[value eq "alice@example.com"]`},
+			},
+		}, `{"schemas":["urn:ietf:params:scim:api:messages:2.0:PatchOp"],"Operations":[{"op":"replace","path":"active","value":false},{"op":"remove","path":"emails[value eq \"alice@example.com\"]"}]}`},
+		{"Operation", Operation{Op: "replace", Path: "name.givenName", Value: "Alice"}, `{"op":"replace","path":"name.givenName","value":"Alice"}`},
+		{"ServiceProviderConfig", ServiceProviderConfig{
+			Schemas: []string{"urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"},
+			Filter:  FilterSupport{Supported: true, MaxResults: 100},
+		}, `{"schemas":["urn:ietf:params:scim:schemas:core:2.0:ServiceProviderConfig"],"filter":{"supported":true,"maxResults":100}}`},
+		{"AttributeChange", AttributeChange{Path: "name.givenName", Old: "Al", New: "Alice"}, `{"path":"name.givenName","old":"Al","new":"Alice"}`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			buf, err := json.Marshal(tt.value)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(buf) != tt.wire {
+				t.Errorf("Marshal() =\n%s\nwant\n%s", buf, tt.wire)
+			}
+
+			got := reflect.New(reflect.TypeOf(tt.value))
+			if err := json.Unmarshal([]byte(tt.wire), got.Interface()); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Elem().Interface(), tt.value) {
+				t.Errorf("Unmarshal() = %+v, want %+v", got.Elem().Interface(), tt.value)
+			}
+		})
+	}
+}
+
+func TestListResponseUnmarshal(t *testing.T) {
+	tests := []struct {
+		name  string
+		body  string
+		total int
+		ids   []string
+	}{
+		{"Resources", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:ListResponse"],"totalResults":2,"itemsPerPage":2,"startIndex":1,"Resources":[{"id":"1","userName":"alice"},{"id":"2","userName":"bob"}]}`, 2, []string{"1", "2"}},
+		{"empty", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:ListResponse"],"totalResults":0,"itemsPerPage":0,"startIndex":1,"Resources":[]}`, 0, nil},
+		{"no Resources", `{"schemas":["urn:ietf:params:scim:api:messages:2.0:ListResponse"],"totalResults":0,"itemsPerPage":0,"startIndex":1}`, 0, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var res ListResponse
+			if err := json.Unmarshal([]byte(tt.body), &res); err != nil {
+				t.Fatal(err)
+			}
+			if res.TotalResults != tt.total {
+				t.Errorf("TotalResults = %d, want %d", res.TotalResults, tt.total)
+			}
+
+			var ids []string
+			for _, user := range res.Resources {
+				ids = append(ids, user.ID)
+			}
+			if !reflect.DeepEqual(ids, tt.ids) {
+				t.Errorf("Resources IDs = %v, want %v", ids, tt.ids)
+			}
+		})
+	}
+}
@@ -0,0 +1,235 @@
+package scim
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// MarshalJSON encodes the user with its schemas list filled in by
+// ensureSchemas, so callers never need to set Schemas themselves. Unset meta
+// is left out, since it's server-assigned and strict servers reject empty
+// values.
+func (u User) MarshalJSON() ([]byte, error) {
+	// user has User's fields but not its methods, avoiding recursion
+	type user User
+
+	u.Schemas = u.ensureSchemas()
+
+	var meta *Metadata
+	if u.Metadata != (Metadata{}) {
+		meta = &u.Metadata
+	}
+
+	// the outer meta field takes precedence over the embedded one
+	return json.Marshal(struct {
+		user
+		Metadata *Metadata `json:"meta,omitempty"`
+	}{user(u), meta})
+}
+
+// ensureSchemas returns the schemas list for u: the core User URN first,
+// followed by the URN of each extension u carries. Extension URNs already in
+// u.Schemas are kept in their original order.
+func (u User) ensureSchemas() []string {
+	schemas := []string{UserSchema}
+	for _, schema := range u.Schemas {
+		if schema != UserSchema && !containsString(schemas, schema) {
+			schemas = append(schemas, schema)
+		}
+	}
+	return schemas
+}
+
+func containsString(list []string, candidate string) bool {
+	for _, v := range list {
+		if v == candidate {
+			return true
+		}
+	}
+	return false
+}
+
+// Clone returns a deep copy of u whose slices don't share backing arrays
+// with u's, so either can be modified without affecting the other.
+func (u User) Clone() User {
+	c := u
+	if u.Schemas != nil {
+		c.Schemas = append([]string(nil), u.Schemas...)
+	}
+	if u.Emails != nil {
+		c.Emails = append([]Email(nil), u.Emails...)
+	}
+	c.Photos = cloneValues(u.Photos)
+	c.IMs = cloneValues(u.IMs)
+	c.Entitlements = cloneValues(u.Entitlements)
+	c.Roles = cloneValues(u.Roles)
+	return c
+}
+
+func cloneValues(values []MultiValue) []MultiValue {
+	if values == nil {
+		return nil
+	}
+	return append([]MultiValue(nil), values...)
+}
+
+// Equal reports whether u and other carry the same provisioning-relevant
+// attributes. Server-assigned fields (ID, Metadata) and the schemas list are
+// ignored, and emails are compared as a set rather than in order.
+func (u User) Equal(other User) bool {
+	return u.UserName == other.UserName &&
+		u.ExternalID == other.ExternalID &&
+		u.Name == other.Name &&
+		u.Active == other.Active &&
+		sameEmails(u.Emails, other.Emails) &&
+		sameValues(u.Photos, other.Photos) &&
+		sameValues(u.IMs, other.IMs) &&
+		sameValues(u.Entitlements, other.Entitlements) &&
+		sameValues(u.Roles, other.Roles)
+}
+
+func sameValues(a, b []MultiValue) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[MultiValue]int, len(a))
+	for _, v := range a {
+		counts[v]++
+	}
+	for _, v := range b {
+		if counts[v] == 0 {
+			return false
+		}
+		counts[v]--
+	}
+
+	return true
+}
+
+func sameEmails(a, b []Email) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	counts := make(map[Email]int, len(a))
+	for _, e := range a {
+		counts[e]++
+	}
+	for _, e := range b {
+		if counts[e] == 0 {
+			return false
+		}
+		counts[e]--
+	}
+
+	return true
+}
+
+// AttributeChange is a change to one of a user's attributes, from Old to
+// New.
+//
+//	{"path":"name.givenName","old":"Al","new":"Alice"}
+type AttributeChange struct {
+	Path string      `json:"path"`
+	Old  interface{} `json:"old"`
+	New  interface{} `json:"new"`
+}
+
+// Diff returns the PATCH operations needed to turn current into desired.
+// Single-valued attributes are replaced, or removed when cleared; emails are
+// added and removed per value, and the other multi-valued attributes are
+// replaced whole, or removed when they have no values left.
+func Diff(current, desired User) PatchOp {
+	patch, _ := DiffChanges(current, desired)
+	return patch
+}
+
+// DiffChanges returns Diff's PATCH operations along with the attributes they
+// change, one AttributeChange per attribute. Emails are a single change of
+// the whole list, however many operations they take.
+func DiffChanges(current, desired User) (PatchOp, []AttributeChange) {
+	patch := PatchOp{
+		Schemas:    []string{PatchOpSchema},
+		Operations: []Operation{},
+	}
+	changes := []AttributeChange{}
+
+	replace := func(path string, old, value interface{}) {
+		patch.Operations = append(patch.Operations, Operation{Op: "replace", Path: path, Value: value})
+		changes = append(changes, AttributeChange{Path: path, Old: old, New: value})
+	}
+	// an attribute with no value left is removed, since a replace with an
+	// empty (or null) value is rejected by some servers
+	remove := func(path string, old, value interface{}) {
+		patch.Operations = append(patch.Operations, Operation{Op: "remove", Path: path})
+		changes = append(changes, AttributeChange{Path: path, Old: old, New: value})
+	}
+	replaceValue := func(path, old, value string) {
+		if old == value {
+			return
+		}
+		if value == "" {
+			remove(path, old, value)
+			return
+		}
+		replace(path, old, value)
+	}
+
+	// userName is required, so it's only ever replaced
+	if current.UserName != desired.UserName {
+		replace("userName", current.UserName, desired.UserName)
+	}
+	replaceValue("externalId", current.ExternalID, desired.ExternalID)
+	replaceValue("name.givenName", current.Name.GivenName, desired.Name.GivenName)
+	replaceValue("name.familyName", current.Name.FamilyName, desired.Name.FamilyName)
+	if current.Active != desired.Active {
+		replace("active", current.Active, desired.Active)
+	}
+	replaceValues := func(path string, old, values []MultiValue) {
+		if sameValues(old, values) {
+			return
+		}
+		if len(values) == 0 {
+			remove(path, old, values)
+			return
+		}
+		replace(path, old, values)
+	}
+	replaceValues("photos", current.Photos, desired.Photos)
+	replaceValues("ims", current.IMs, desired.IMs)
+	replaceValues("entitlements", current.Entitlements, desired.Entitlements)
+	replaceValues("roles", current.Roles, desired.Roles)
+
+	if !sameEmails(current.Emails, desired.Emails) {
+		changes = append(changes, AttributeChange{Path: "emails", Old: current.Emails, New: desired.Emails})
+	}
+	for _, e := range current.Emails {
+		if !containsEmail(desired.Emails, e) {
+			patch.Operations = append(patch.Operations, Operation{
+				Op:   "remove",
+				Path: fmt.Sprintf("emails[value eq %q]", e.Value),
+			})
+		}
+	}
+	for _, e := range desired.Emails {
+		if !containsEmail(current.Emails, e) {
+			patch.Operations = append(patch.Operations, Operation{
+				Op:    "add",
+				Path:  "emails",
+				Value: []Email{e},
+			})
+		}
+	}
+
+	return patch, changes
+}
+
+func containsEmail(list []Email, candidate Email) bool {
+	for _, e := range list {
+		if e == candidate {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,173 @@
+package scim
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+func testUser() User {
+	return User{
+		Schemas:      []string{UserSchema},
+		ID:           "1",
+		UserName:     "alice",
+		Name:         Name{GivenName: "Alice", FamilyName: "Example"},
+		Emails:       []Email{{Value: "alice@example.com", Type: "work", Primary: true}},
+		Active:       true,
+		Photos:       []MultiValue{{Value: "https://photos.example.com/alice.jpg", Type: "photo"}},
+		IMs:          []MultiValue{{Value: "alice", Type: "xmpp"}},
+		Entitlements: []MultiValue{{Value: "admin"}},
+		Roles:        []MultiValue{{Value: "eng", Display: "eng"}},
+	}
+}
+
+func TestCloneDoesNotAlias(t *testing.T) {
+	u := testUser()
+	want := testUser()
+
+	c := u.Clone()
+	if !reflect.DeepEqual(c, u) {
+		t.Fatalf("Clone() = %+v, want %+v", c, u)
+	}
+
+	c.Schemas[0] = "changed"
+	c.Emails[0].Value = "changed"
+	c.Photos[0].Value = "changed"
+	c.IMs[0].Value = "changed"
+	c.Entitlements[0].Value = "changed"
+	c.Roles[0].Value = "changed"
+	if !reflect.DeepEqual(u, want) {
+		t.Errorf("modifying the clone changed the original to %+v", u)
+	}
+
+	// appending within the original's capacity mustn't show in the clone
+	u = testUser()
+	u.Emails = append(make([]Email, 0, 4), u.Emails...)
+	c = u.Clone()
+	_ = append(u.Emails, Email{Value: "other@example.com"})
+	c.Emails = c.Emails[:cap(c.Emails)]
+	for _, e := range c.Emails[1:] {
+		if e.Value == "other@example.com" {
+			t.Errorf("the clone shares its emails' backing array with the original")
+		}
+	}
+}
+
+func TestCloneKeepsNil(t *testing.T) {
+	c := User{UserName: "alice"}.Clone()
+	if c.Schemas != nil || c.Emails != nil || c.Photos != nil || c.IMs != nil || c.Entitlements != nil || c.Roles != nil {
+		t.Errorf("Clone() of a user without lists = %+v, want nil lists", c)
+	}
+}
+
+func TestMarshalOmitsUnsetExternalID(t *testing.T) {
+	tests := []struct {
+		user User
+		want bool
+	}{
+		{User{UserName: "alice"}, false},
+		{User{UserName: "alice", ExternalID: "a1"}, true},
+	}
+
+	for _, tt := range tests {
+		buf, err := json.Marshal(tt.user)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var fields map[string]interface{}
+		if err := json.Unmarshal(buf, &fields); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, got := fields["externalId"]; got != tt.want {
+			t.Errorf("Marshal(%+v) = %s; has externalId %t, want %t", tt.user, buf, got, tt.want)
+		}
+		// nor are the other unset optional attributes sent empty
+		for _, key := range []string{"id", "emails", "meta", "photos", "ims", "entitlements", "roles"} {
+			if _, ok := fields[key]; ok {
+				t.Errorf("Marshal(%+v) = %s; has unset %s", tt.user, buf, key)
+			}
+		}
+	}
+}
+
+func TestDiffRemovesEmptiedValues(t *testing.T) {
+	current := testUser()
+	desired := testUser()
+	desired.Photos = nil
+	desired.IMs = []MultiValue{}
+	desired.Entitlements = nil
+	desired.Roles = []MultiValue{{Value: "ops", Display: "ops"}}
+
+	patch, changes := DiffChanges(current, desired)
+
+	want := []Operation{
+		{Op: "remove", Path: "photos"},
+		{Op: "remove", Path: "ims"},
+		{Op: "remove", Path: "entitlements"},
+		{Op: "replace", Path: "roles", Value: desired.Roles},
+	}
+	if !reflect.DeepEqual(patch.Operations, want) {
+		t.Errorf("DiffChanges() operations = %+v, want %+v", patch.Operations, want)
+	}
+	if err := patch.Validate(); err != nil {
+		t.Error(err)
+	}
+	if len(changes) != 4 {
+		t.Errorf("DiffChanges() changes = %+v, want one per attribute", changes)
+	}
+
+	// removals carry no value at all, rather than a null one
+	buf, err := json.Marshal(patch.Operations[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != `{"op":"remove","path":"photos"}` {
+		t.Errorf("Marshal(%+v) = %s", patch.Operations[0], buf)
+	}
+
+	// attributes that were already empty aren't touched
+	current.Photos = nil
+	desired = current
+	desired.Photos = []MultiValue{}
+	if patch := Diff(current, desired); len(patch.Operations) != 0 {
+		t.Errorf("Diff() of an unset and an empty attribute = %+v, want no operations", patch.Operations)
+	}
+}
+
+func TestDiffRemovesClearedAttributes(t *testing.T) {
+	tests := []struct {
+		path  string
+		clear func(u *User)
+	}{
+		{"externalId", func(u *User) { u.ExternalID = "" }},
+		{"name.givenName", func(u *User) { u.Name.GivenName = "" }},
+		{"name.familyName", func(u *User) { u.Name.FamilyName = "" }},
+	}
+
+	for _, tt := range tests {
+		current := testUser()
+		current.ExternalID = "a1"
+		desired := current.Clone()
+		tt.clear(&desired)
+
+		patch, changes := DiffChanges(current, desired)
+
+		want := []Operation{{Op: "remove", Path: tt.path}}
+		if !reflect.DeepEqual(patch.Operations, want) {
+			t.Errorf("DiffChanges() clearing %s = %+v, want %+v", tt.path, patch.Operations, want)
+		}
+		if err := patch.Validate(); err != nil {
+			t.Errorf("DiffChanges() clearing %s: %s", tt.path, err)
+		}
+		if len(changes) != 1 || changes[0].Path != tt.path || changes[0].New != "" {
+			t.Errorf("DiffChanges() clearing %s changes = %+v", tt.path, changes)
+		}
+
+		// setting it again is a replace
+		patch = Diff(desired, current)
+		if len(patch.Operations) != 1 || patch.Operations[0].Op != "replace" || patch.Operations[0].Path != tt.path {
+			t.Errorf("Diff() setting %s = %+v, want a replace", tt.path, patch.Operations)
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package scim
+
+import "fmt"
+
+// Build information, set at build time with
+//
+//	go build -ldflags "-X github.com/mtodd/scimtool.Version=1.0.0 \
+//	  -X github.com/mtodd/scimtool.Commit=$(git rev-parse HEAD) \
+//	  -X github.com/mtodd/scimtool.BuildDate=$(date -u +%Y-%m-%dT%H:%M:%SZ)"
+var (
+	Version   = "dev"
+	Commit    = "unknown"
+	BuildDate = "unknown"
+)
+
+// UserAgent is the default User-Agent header sent by scimtool clients.
+func UserAgent() string {
+	return "scimtool/" + Version
+}
+
+// VersionString describes the build for -version output.
+func VersionString() string {
+	return fmt.Sprintf("%s (commit %s, built %s)", Version, Commit, BuildDate)
+}